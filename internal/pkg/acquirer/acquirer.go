@@ -25,26 +25,88 @@ import (
 
 type Acquirer interface {
 	acquire(dest string) error
+	inspect(dest string) (*SourceState, error)
+	reset(dest string, stash bool) error
 	Id() (string, error)
 	Name() string
 	Path() string
 }
 
+// The state of a source that's previously been acquired into a directory
+type SourceState struct {
+	Ref      string   `yaml:"ref"`                // the ref the acquirer is configured to acquire
+	Expected string   `yaml:"expected"`           // the version the ref resolves to, if known
+	Actual   string   `yaml:"actual"`             // the version actually in the directory
+	Modified []string `yaml:"modified,omitempty"` // paths of locally modified files
+}
+
+// Returns whether the version in the directory differs from the one the
+// acquirer is configured to acquire
+func (s SourceState) OutOfDate() bool {
+	return s.Expected != s.Actual
+}
+
+// Optionally implemented by acquirers that can verify the signatures of the
+// sources they acquire
+type verifier interface {
+	verify(dest string, trustedKeys []string) error
+}
+
 const ACQUIRER_KEY = "acquirer"
 const GIT = "git"
+const FILE = "file"
 
 // Factory that creates acquirers
 func acquirerFactory(name string, settings map[string]string) (Acquirer, error) {
 	log.Debugf("Returning new %s acquirer", name)
 
 	if name == GIT {
-		if settings[URI] == "" || settings[BRANCH] == "" || settings[PATH] == "" {
-			return nil, errors.New("Invalid git parameters. The uri, " +
-				"branch and path are all mandatory.")
+		if settings[URI] == "" || settings[PATH] == "" {
+			return nil, errors.New("Invalid git parameters. The uri and " +
+				"path are mandatory.")
+		}
+
+		if settings[BRANCH] == "" && settings[TAG] == "" && settings[SHA] == "" {
+			return nil, errors.New("Invalid git parameters. One of a " +
+				"branch, tag or sha is mandatory.")
+		}
+
+		if settings[BRANCH] != "" && settings[TAG] != "" {
+			return nil, errors.New("Invalid git parameters. Only one of " +
+				"a branch or tag can be given.")
+		}
+
+		if settings[SHA] != "" {
+			if err := validateSha(settings[SHA]); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+
+		return NewPinnedGitAcquirer(settings[NAME], settings[URI],
+			settings[BRANCH], settings[TAG], settings[SHA], settings[PATH]), nil
+	}
+
+	if name == FILE {
+		return newFileAcquirerFromSettings(settings)
+	}
+
+	if name == HELM {
+		if settings[REPO] == "" || settings[CHART] == "" || settings[VERSION] == "" {
+			return nil, errors.New("Invalid helm parameters. The repo, " +
+				"chart and version are all mandatory.")
+		}
+
+		return NewHelmAcquirer(settings[NAME], settings[REPO], settings[CHART],
+			settings[VERSION], settings[PATH]), nil
+	}
+
+	if name == HTTP {
+		if settings[URI] == "" {
+			return nil, errors.New("Invalid http parameters. The uri is mandatory.")
 		}
 
-		return NewGitAcquirer(settings[NAME], settings[URI], settings[BRANCH],
-			settings[PATH]), nil
+		return NewHttpAcquirer(settings[NAME], settings[URI], settings[PATH],
+			settings[SHA256]), nil
 	}
 
 	return nil, errors.New(fmt.Sprintf("Acquirer '%s' doesn't exist", name))
@@ -57,10 +119,25 @@ func NewAcquirer(settings map[string]string) (Acquirer, error) {
 
 	uri := settings[URI]
 
-	if strings.Contains(uri, ".git") || acquirer == GIT {
+	if acquirer != "" {
+		return acquirerFactory(acquirer, settings)
+	}
+
+	// check for archives first since their URIs may contain '.git', e.g.
+	// release tarballs on github
+	if isHttpArchive(uri) {
+		return acquirerFactory(HTTP, settings)
+	}
+
+	if strings.Contains(uri, ".git") {
 		return acquirerFactory(GIT, settings)
 	}
 
+	// bare paths are treated as local files
+	if strings.HasPrefix(uri, FILE_PROTOCOL) || !strings.Contains(uri, ":") {
+		return acquirerFactory(FILE, settings)
+	}
+
 	return nil, errors.New(fmt.Sprintf("Couldn't identify acquirer for URI '%s'", uri))
 }
 
@@ -68,3 +145,25 @@ func NewAcquirer(settings map[string]string) (Acquirer, error) {
 func Acquire(a Acquirer, dest string) error {
 	return a.acquire(dest)
 }
+
+// Delegate to an acquirer implementation
+func Inspect(a Acquirer, dest string) (*SourceState, error) {
+	return a.inspect(dest)
+}
+
+// Delegate to an acquirer implementation
+func Reset(a Acquirer, dest string, stash bool) error {
+	return a.reset(dest, stash)
+}
+
+// Verifies that a source acquired into `dest` is signed by one of the trusted
+// keys. Returns an error if it isn't, or if the acquirer can't verify sources.
+func Verify(a Acquirer, dest string, trustedKeys []string) error {
+	verifierImpl, ok := a.(verifier)
+	if !ok {
+		return errors.New(fmt.Sprintf("Acquirer for '%s' can't verify "+
+			"signatures", a.Name()))
+	}
+
+	return verifierImpl.verify(dest, trustedKeys)
+}
@@ -80,3 +80,83 @@ func TestNewAcquirerNilUriError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, actual)
 }
+
+func TestNewGitAcquirerRefs(t *testing.T) {
+	tests := []struct {
+		name        string
+		desc        string
+		settings    map[string]string
+		expected    Acquirer
+		expectError bool
+	}{
+		{
+			name: "tag_and_sha",
+			desc: "tags can be pinned to SHAs",
+			settings: map[string]string{
+				"uri":  "git@github.com:sugarkube/kapps.git",
+				"tag":  "v1.0.0",
+				"sha":  "0123456789ABCDEF0123456789ABCDEF01234567",
+				"path": "incubator/tiller/",
+			},
+			expected: GitAcquirer{
+				name: "tiller",
+				uri:  "git@github.com:sugarkube/kapps.git",
+				tag:  "v1.0.0",
+				sha:  "0123456789abcdef0123456789abcdef01234567",
+				path: "incubator/tiller/",
+			},
+		},
+		{
+			name: "error_short_sha",
+			desc: "abbreviated SHAs are rejected",
+			settings: map[string]string{
+				"uri":  "git@github.com:sugarkube/kapps.git",
+				"tag":  "v1.0.0",
+				"sha":  "0123456789ab",
+				"path": "incubator/tiller/",
+			},
+			expectError: true,
+		},
+		{
+			name: "error_invalid_sha",
+			desc: "SHAs must be hex",
+			settings: map[string]string{
+				"uri":  "git@github.com:sugarkube/kapps.git",
+				"sha":  "0123456789abcdef0123456789abcdef0123456z",
+				"path": "incubator/tiller/",
+			},
+			expectError: true,
+		},
+		{
+			name: "error_branch_and_tag",
+			desc: "branches and tags are mutually exclusive",
+			settings: map[string]string{
+				"uri":    "git@github.com:sugarkube/kapps.git",
+				"branch": "master",
+				"tag":    "v1.0.0",
+				"path":   "incubator/tiller/",
+			},
+			expectError: true,
+		},
+		{
+			name: "error_no_ref",
+			desc: "one of a branch, tag or sha is required",
+			settings: map[string]string{
+				"uri":  "git@github.com:sugarkube/kapps.git",
+				"path": "incubator/tiller/",
+			},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		actual, err := acquirerFactory(GIT, test.settings)
+		if test.expectError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+			assert.Nil(t, actual)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+			assert.Equal(t, test.expected, actual, "unexpected acquirer for %s", test.name)
+		}
+	}
+}
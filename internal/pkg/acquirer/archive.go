@@ -0,0 +1,322 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acquirer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Supported archive formats
+const ARCHIVE_TAR_GZ = "tar.gz"
+const ARCHIVE_ZIP = "zip"
+
+// Returns the format of an archive based on its file extension, or an empty
+// string if it isn't a supported archive
+func archiveFormat(uri string) string {
+	// ignore any query string
+	uri = strings.SplitN(uri, "?", 2)[0]
+
+	if strings.HasSuffix(uri, ".tar.gz") || strings.HasSuffix(uri, ".tgz") {
+		return ARCHIVE_TAR_GZ
+	}
+
+	if strings.HasSuffix(uri, ".zip") {
+		return ARCHIVE_ZIP
+	}
+
+	return ""
+}
+
+// Returns the basename of an archive URI without its extension
+func archiveBaseName(uri string) string {
+	name := filepath.Base(strings.SplitN(uri, "?", 2)[0])
+
+	for _, ext := range []string{".tar.gz", ".tgz", ".zip"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	return name
+}
+
+// Extracts an archive into a directory
+func extractArchive(archivePath string, format string, dest string) error {
+	switch format {
+	case ARCHIVE_TAR_GZ:
+		return extractTarGz(archivePath, dest)
+	case ARCHIVE_ZIP:
+		return extractZip(archivePath, dest)
+	}
+
+	return errors.New(fmt.Sprintf("Unsupported archive format '%s'", format))
+}
+
+// Returns the path to extract an archive entry to, or an error if it would
+// end up outside the destination directory
+func extractPath(dest string, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if !isWithin(dest, target) {
+		return "", errors.New(fmt.Sprintf("Archive entry '%s' would be "+
+			"extracted outside of %s", name, dest))
+	}
+
+	err := checkNoSymlinks(dest, target)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return target, nil
+}
+
+// Returns whether a path is the same as or inside a directory
+func isWithin(dir string, path string) bool {
+	dir = filepath.Clean(dir)
+	path = filepath.Clean(path)
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// Returns an error if the target or any of its parent directories under
+// `dest` already exist as symlinks, so archives can't write through links
+// they've previously extracted
+func checkNoSymlinks(dest string, target string) error {
+	rel, err := filepath.Rel(dest, target)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	current := filepath.Clean(dest)
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		if part == "." {
+			continue
+		}
+
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New(fmt.Sprintf("Refusing to extract to %s "+
+				"through symlink %s", target, current))
+		}
+	}
+
+	return nil
+}
+
+// Returns an error if a symlink extracted to `target` would point outside the
+// destination directory
+func checkLinkTarget(dest string, target string, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		return errors.New(fmt.Sprintf("Symlink %s has absolute target '%s'",
+			target, linkname))
+	}
+
+	// relative targets are resolved against the link's own directory
+	if !isWithin(dest, filepath.Join(filepath.Dir(target), linkname)) {
+		return errors.New(fmt.Sprintf("Symlink %s points outside of %s: '%s'",
+			target, dest, linkname))
+	}
+
+	return nil
+}
+
+// Extracts a gzipped tarball into a directory
+func extractTarGz(archivePath string, dest string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "Error decompressing %s", archivePath)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Error reading tarball %s", archivePath)
+		}
+
+		target, err := extractPath(dest, header.Name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeFile(target, tarReader, mode)
+		case tar.TypeSymlink:
+			err = checkLinkTarget(dest, target, header.Linkname)
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(target), 0755)
+			}
+			if err == nil {
+				err = os.Symlink(header.Linkname, target)
+			}
+		default:
+			// other entries (e.g. devices) have no place in kapps
+			continue
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "Error extracting '%s' from %s",
+				header.Name, archivePath)
+		}
+	}
+
+	return nil
+}
+
+// Extracts a zip file into a directory
+func extractZip(archivePath string, dest string) error {
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return errors.Wrapf(err, "Error opening zip file %s", archivePath)
+	}
+	defer zipReader.Close()
+
+	for _, file := range zipReader.File {
+		target, err := extractPath(dest, file.Name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if file.FileInfo().IsDir() {
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return errors.Wrapf(err, "Error reading '%s' from %s", file.Name,
+				archivePath)
+		}
+
+		err = writeFile(target, reader, file.Mode().Perm())
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Error extracting '%s' from %s",
+				file.Name, archivePath)
+		}
+	}
+
+	return nil
+}
+
+// Writes the contents of a reader to a file, creating parent directories
+func writeFile(target string, reader io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if mode == 0 {
+		mode = 0644
+	}
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, reader)
+	return errors.WithStack(err)
+}
+
+// Returns the sha256 digest of each file under a directory keyed by path
+// relative to the directory. Paths in `exclude` are skipped.
+func digestFiles(root string, exclude ...string) (map[string]string, error) {
+	digests := make(map[string]string)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, excluded := range exclude {
+			if relPath == excluded {
+				return nil
+			}
+		}
+
+		hash := sha256.New()
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			fmt.Fprintf(hash, "-> %s", linkTarget)
+		} else {
+			f, err := os.Open(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			_, err = io.Copy(hash, f)
+			f.Close()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		digests[relPath] = fmt.Sprintf("%x", hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error calculating digests of files in %s", root)
+	}
+
+	return digests, nil
+}
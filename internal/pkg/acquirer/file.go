@@ -0,0 +1,340 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acquirer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Acquires sources from the local filesystem, either by symlinking or copying
+// them into the cache. Symlinking means changes to a local checkout are picked
+// up immediately which is useful when developing kapps.
+type FileAcquirer struct {
+	name   string
+	uri    string // absolute path to a directory or file
+	idPath string // path used to generate IDs, relative to the base dir if any
+	path   string
+	copy   bool
+}
+
+const FILE_PROTOCOL = "file://"
+
+// set to 'true' to copy sources instead of symlinking them
+const COPY = "copy"
+
+// Directory to resolve relative URIs against. If empty, URIs are resolved
+// against the current working directory.
+const BASE_DIR = "base_dir"
+
+// Prefix of files sugarkube generates in cached sources, e.g. rendered
+// templates and terraform backends. They're ignored when checking whether
+// copied sources have changed.
+const GENERATED_FILE_PREFIX = "_generated_"
+
+// Directory terraform initialises in the directories it's run in
+const TERRAFORM_DATA_DIR = ".terraform"
+
+// Returns an instance. Relative URIs are resolved against `baseDir`.
+func NewFileAcquirer(name string, uri string, path string, copy bool,
+	baseDir string) (FileAcquirer, error) {
+	uri = strings.TrimPrefix(uri, FILE_PROTOCOL)
+	idPath := filepath.Clean(uri)
+
+	if !filepath.IsAbs(uri) {
+		uri = filepath.Join(baseDir, uri)
+	}
+
+	absUri, err := filepath.Abs(uri)
+	if err != nil {
+		return FileAcquirer{}, errors.Wrapf(err, "Error getting absolute "+
+			"path for %s", uri)
+	}
+
+	// IDs shouldn't depend on where manifests are checked out, so use paths
+	// relative to the base dir where possible
+	if baseDir != "" {
+		absBaseDir, err := filepath.Abs(baseDir)
+		if err != nil {
+			return FileAcquirer{}, errors.Wrapf(err, "Error getting "+
+				"absolute path for %s", baseDir)
+		}
+
+		idPath, err = filepath.Rel(absBaseDir, absUri)
+		if err != nil {
+			return FileAcquirer{}, errors.Wrapf(err, "Error getting path "+
+				"of %s relative to %s", absUri, absBaseDir)
+		}
+	}
+
+	if name == "" {
+		if path != "" {
+			name = filepath.Base(path)
+		} else {
+			name = filepath.Base(absUri)
+		}
+	}
+
+	return FileAcquirer{
+		name:   name,
+		uri:    absUri,
+		idPath: idPath,
+		path:   path,
+		copy:   copy,
+	}, nil
+}
+
+// Returns a new file acquirer from acquirer settings
+func newFileAcquirerFromSettings(settings map[string]string) (Acquirer, error) {
+	if settings[URI] == "" {
+		return nil, errors.New("Invalid file parameters. The uri is mandatory.")
+	}
+
+	copy := false
+	if settings[COPY] != "" {
+		var err error
+		copy, err = strconv.ParseBool(settings[COPY])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid value for '%s': %s",
+				COPY, settings[COPY])
+		}
+	}
+
+	acquirer, err := NewFileAcquirer(settings[NAME], settings[URI], settings[PATH],
+		copy, settings[BASE_DIR])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return acquirer, nil
+}
+
+// Generate an ID from the path relative to the base dir (or the path as given
+// if there's no base dir) and name. Parent directories are written as 'up'.
+func (a FileAcquirer) Id() (string, error) {
+	segments := strings.Split(strings.Trim(filepath.ToSlash(a.idPath), "/"), "/")
+	for i, segment := range segments {
+		if segment == ".." {
+			segments[i] = "up"
+		}
+	}
+	hyphenatedUri := strings.Join(segments, "-")
+	hyphenatedName := strings.Replace(a.name, "/", "-", -1)
+
+	return strings.Join([]string{FILE, hyphenatedUri, hyphenatedName}, "-"), nil
+}
+
+// return the name
+func (a FileAcquirer) Name() string {
+	return a.name
+}
+
+// return the path
+func (a FileAcquirer) Path() string {
+	return a.path
+}
+
+// Symlinks or copies `a.uri` to `dest`, replacing anything previously acquired
+// there.
+func (a FileAcquirer) acquire(dest string) error {
+	if _, err := os.Stat(a.uri); err != nil {
+		return errors.Wrapf(err, "Local source %s doesn't exist", a.uri)
+	}
+
+	if _, err := os.Lstat(dest); err == nil {
+		log.Debugf("Removing previously acquired source at %s", dest)
+		err = os.RemoveAll(dest)
+		if err != nil {
+			return errors.Wrapf(err, "Error removing %s", dest)
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "Error creating directory %s", filepath.Dir(dest))
+	}
+
+	if a.copy {
+		log.Infof("Copying local source %s into %s", a.uri, dest)
+		return copyPath(a.uri, dest)
+	}
+
+	log.Infof("Symlinking local source %s to %s", a.uri, dest)
+	err = os.Symlink(a.uri, dest)
+	if err != nil {
+		return errors.Wrapf(err, "Error symlinking %s to %s", a.uri, dest)
+	}
+
+	return nil
+}
+
+// Symlinked sources are compared by their targets, copied ones by a digest of
+// their contents excluding files generated in the cache. Local modifications
+// can't be detected since we don't know what the original contents were.
+func (a FileAcquirer) inspect(dest string) (*SourceState, error) {
+	if !a.copy {
+		actual, err := os.Readlink(dest)
+		if err != nil {
+			// the source was copied when it should be symlinked
+			if _, ok := err.(*os.PathError); ok {
+				actual = ""
+			} else {
+				return nil, errors.WithStack(err)
+			}
+		}
+
+		return &SourceState{
+			Ref:      a.uri,
+			Expected: a.uri,
+			Actual:   actual,
+		}, nil
+	}
+
+	expected, err := digestPath(a.uri)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	actual, err := digestPath(dest)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &SourceState{
+		Ref:      a.uri,
+		Expected: expected,
+		Actual:   actual,
+	}, nil
+}
+
+// Nothing to do since sources are replaced whenever they're acquired
+func (a FileAcquirer) reset(dest string, stash bool) error {
+	log.Debugf("Not resetting local source in %s. It'll be replaced when it's "+
+		"next acquired", dest)
+	return nil
+}
+
+// Recursively copies a file or directory. Symlinks are recreated rather than
+// followed.
+func copyPath(src string, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		target := filepath.Join(dest, relPath)
+
+		if info.IsDir() {
+			return errors.WithStack(os.MkdirAll(target, info.Mode()))
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return errors.WithStack(os.Symlink(linkTarget, target))
+		}
+
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+// Copies a single file
+func copyFile(src string, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return errors.Wrapf(err, "Error copying %s to %s", src, dest)
+	}
+
+	return nil
+}
+
+// Returns a digest of the paths and contents of all files under a path apart
+// from generated files and terraform data dirs
+func digestPath(root string) (string, error) {
+	hash := sha256.New()
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if info.IsDir() {
+			if path != root && info.Name() == TERRAFORM_DATA_DIR {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), GENERATED_FILE_PREFIX) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fmt.Fprintf(hash, "%s\n", relPath)
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			fmt.Fprintf(hash, "-> %s\n", linkTarget)
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer f.Close()
+
+		_, err = io.Copy(hash, f)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Error calculating digest of %s", root)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
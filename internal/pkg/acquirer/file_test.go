@@ -0,0 +1,209 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acquirer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewAcquirerFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		desc     string
+		settings map[string]string
+		expected Acquirer
+	}{
+		{
+			name: "file_protocol",
+			desc: "file:// URIs should create file acquirers",
+			settings: map[string]string{
+				"uri":  "file:///home/dev/kapps",
+				"path": "incubator/tiller/",
+			},
+			expected: FileAcquirer{
+				name:   "tiller",
+				uri:    "/home/dev/kapps",
+				idPath: "/home/dev/kapps",
+				path:   "incubator/tiller/",
+			},
+		},
+		{
+			name: "relative_path",
+			desc: "bare relative paths should be resolved against the base dir",
+			settings: map[string]string{
+				"uri":      "../kapps",
+				"path":     "tiller",
+				"copy":     "true",
+				"base_dir": "/home/dev/project",
+			},
+			expected: FileAcquirer{
+				name:   "tiller",
+				uri:    "/home/dev/kapps",
+				idPath: "../kapps",
+				path:   "tiller",
+				copy:   true,
+			},
+		},
+		{
+			name: "file_name",
+			desc: "the name should default to the URI basename when there's no path",
+			settings: map[string]string{
+				"uri": "/manifests/manifest1.yaml",
+			},
+			expected: FileAcquirer{
+				name:   "manifest1.yaml",
+				uri:    "/manifests/manifest1.yaml",
+				idPath: "/manifests/manifest1.yaml",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		actual, err := NewAcquirer(test.settings)
+		assert.Nil(t, err, "unexpected error for %s", test.name)
+		assert.Equal(t, test.expected, actual, "unexpected acquirer for %s", test.name)
+	}
+}
+
+func TestNewAcquirerFileInvalidCopy(t *testing.T) {
+	actual, err := NewAcquirer(map[string]string{
+		"uri":  "/home/dev/kapps",
+		"copy": "nonsense",
+	})
+	assert.NotNil(t, err)
+	assert.Nil(t, actual)
+}
+
+func TestFileId(t *testing.T) {
+	tests := []struct {
+		name     string
+		desc     string
+		uri      string
+		baseDir  string
+		expected string
+	}{
+		{
+			name:     "absolute",
+			desc:     "absolute paths without a base dir are used as-is",
+			uri:      "/home/dev/kapps",
+			expected: "file-home-dev-kapps-tiller",
+		},
+		{
+			name:     "relative",
+			desc:     "relative paths are used as given",
+			uri:      "file://kapps",
+			baseDir:  "/home/dev/manifests",
+			expected: "file-kapps-tiller",
+		},
+		{
+			name:     "absolute_under_base_dir",
+			desc:     "absolute paths are made relative to the base dir",
+			uri:      "/home/dev/manifests/kapps",
+			baseDir:  "/home/dev/manifests",
+			expected: "file-kapps-tiller",
+		},
+		{
+			name:     "parent",
+			desc:     "parent directories are written as 'up'",
+			uri:      "../kapps",
+			baseDir:  "/home/dev/manifests",
+			expected: "file-up-kapps-tiller",
+		},
+	}
+
+	for _, test := range tests {
+		acquirer, err := NewFileAcquirer("", test.uri, "incubator/tiller", false, test.baseDir)
+		assert.Nil(t, err, "unexpected error in test %s", test.name)
+
+		actual, err := acquirer.Id()
+		assert.Nil(t, err, "unexpected error in test %s", test.name)
+		assert.Equal(t, test.expected, actual, "unexpected ID for test %s: %s", test.name, test.desc)
+	}
+
+	// IDs don't depend on where manifests are checked out
+	first, err := NewFileAcquirer("", "kapps", "", false, "/home/alice/manifests")
+	assert.Nil(t, err)
+	second, err := NewFileAcquirer("", "kapps", "", false, "/builds/1234/manifests")
+	assert.Nil(t, err)
+
+	firstId, err := first.Id()
+	assert.Nil(t, err)
+	secondId, err := second.Id()
+	assert.Nil(t, err)
+	assert.Equal(t, firstId, secondId)
+}
+
+func TestFileAcquire(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "file-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	srcDir := filepath.Join(tempDir, "src")
+	err = os.MkdirAll(filepath.Join(srcDir, "kapp"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(srcDir, "kapp", "Makefile"), []byte("all:\n"), 0644)
+	assert.Nil(t, err)
+
+	for _, copy := range []bool{false, true} {
+		acquirer, err := NewFileAcquirer("", srcDir, "kapp", copy, "")
+		assert.Nil(t, err)
+
+		dest := filepath.Join(tempDir, "dest")
+
+		// acquire twice to make sure existing sources are replaced
+		for i := 0; i < 2; i++ {
+			err = acquirer.acquire(dest)
+			assert.Nil(t, err)
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(dest, "kapp", "Makefile"))
+		assert.Nil(t, err)
+		assert.Equal(t, "all:\n", string(contents))
+
+		state, err := acquirer.inspect(dest)
+		assert.Nil(t, err)
+		assert.False(t, state.OutOfDate(), "copy=%v", copy)
+	}
+
+	// files generated in copied sources shouldn't make them out-of-date
+	acquirer, err := NewFileAcquirer("", srcDir, "kapp", true, "")
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(tempDir, "dest", "kapp",
+		GENERATED_FILE_PREFIX+"backend.tf"), []byte("terraform {}\n"), 0644)
+	assert.Nil(t, err)
+	err = os.MkdirAll(filepath.Join(tempDir, "dest", "kapp", TERRAFORM_DATA_DIR), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(tempDir, "dest", "kapp", TERRAFORM_DATA_DIR,
+		"terraform.tfstate"), []byte("{}\n"), 0644)
+	assert.Nil(t, err)
+
+	state, err := acquirer.inspect(filepath.Join(tempDir, "dest"))
+	assert.Nil(t, err)
+	assert.False(t, state.OutOfDate())
+
+	// copied sources should be out-of-date when the source changes
+	err = ioutil.WriteFile(filepath.Join(srcDir, "kapp", "Makefile"), []byte("changed\n"), 0644)
+	assert.Nil(t, err)
+
+	state, err = acquirer.inspect(filepath.Join(tempDir, "dest"))
+	assert.Nil(t, err)
+	assert.True(t, state.OutOfDate())
+}
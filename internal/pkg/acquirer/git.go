@@ -21,9 +21,11 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -31,6 +33,8 @@ type GitAcquirer struct {
 	name   string
 	uri    string
 	branch string
+	tag    string
+	sha    string // optional commit the branch/tag must resolve to
 	path   string
 }
 
@@ -40,11 +44,28 @@ const GIT_PATH = "git"
 const NAME = "name"
 const URI = "uri"
 const BRANCH = "branch"
+const TAG = "tag"
+const SHA = "sha"
 const PATH = "path"
 
+// File in a repo's .git directory recording the commit that was checked out
+const RESOLVED_COMMIT_FILE = "SUGARKUBE_COMMIT"
+
+// Matches full commit SHAs. Abbreviated SHAs aren't accepted since they could
+// become ambiguous or match a different commit.
+var fullShaRegex = regexp.MustCompile("^[0-9a-fA-F]{40}$")
+
 // Returns an instance. This allows us to build objects for testing instead of
 // directly instantiating objects in the acquirer factory.
 func NewGitAcquirer(name string, uri string, branch string, path string) GitAcquirer {
+	return NewPinnedGitAcquirer(name, uri, branch, "", "", path)
+}
+
+// Returns an instance that checks out a branch, tag or commit SHA. If a SHA is
+// given along with a branch or tag, acquiring will fail unless the branch/tag
+// resolves to that SHA.
+func NewPinnedGitAcquirer(name string, uri string, branch string, tag string,
+	sha string, path string) GitAcquirer {
 	if name == "" {
 		name = filepath.Base(path)
 	}
@@ -53,10 +74,36 @@ func NewGitAcquirer(name string, uri string, branch string, path string) GitAcqu
 		name:   name,
 		uri:    uri,
 		branch: branch,
+		tag:    tag,
+		sha:    strings.ToLower(sha),
 		path:   path,
 	}
 }
 
+// Returns an error unless a SHA a source is pinned to is a full commit SHA
+func validateSha(sha string) error {
+	if !fullShaRegex.MatchString(sha) {
+		return errors.New(fmt.Sprintf("Invalid git sha '%s'. Pinned "+
+			"commits must be given as full 40 character SHAs.", sha))
+	}
+
+	return nil
+}
+
+// Returns the ref to check out. This is the branch or tag, or the SHA if
+// neither are set.
+func (a GitAcquirer) ref() string {
+	if a.branch != "" {
+		return a.branch
+	}
+
+	if a.tag != "" {
+		return a.tag
+	}
+
+	return a.sha
+}
+
 // Generate an ID
 func (a GitAcquirer) Id() (string, error) {
 	// testing here simplifies testing but does mean invalid objects can be created...
@@ -69,10 +116,11 @@ func (a GitAcquirer) Id() (string, error) {
 	orgRepo := strings.SplitAfter(a.uri, ":")
 	hyphenatedOrg := strings.Replace(orgRepo[1], "/", "-", -1)
 	hyphenatedOrg = strings.TrimSuffix(hyphenatedOrg, ".git")
-	hyphenatedBranc := strings.Replace(a.branch, "/", "-", -1)
+	// pinning a branch/tag to a SHA doesn't change the ID
+	hyphenatedRef := strings.Replace(a.ref(), "/", "-", -1)
 	hyphenatedName := strings.Replace(a.name, "/", "-", -1)
 
-	return strings.Join([]string{hyphenatedOrg, hyphenatedBranc, hyphenatedName}, "-"), nil
+	return strings.Join([]string{hyphenatedOrg, hyphenatedRef, hyphenatedName}, "-"), nil
 }
 
 // return the name
@@ -85,7 +133,9 @@ func (a GitAcquirer) Path() string {
 	return a.path
 }
 
-// Acquires kapps via git and saves them to `dest`.
+// Acquires kapps via git and saves them to `dest`. If `dest` already contains
+// a repo it's updated in place by fetching and checking out the configured
+// branch/tag.
 func (a GitAcquirer) acquire(dest string) error {
 
 	log.Infof("Acquiring git source %s into %s", a.uri, dest)
@@ -96,83 +146,356 @@ func (a GitAcquirer) acquire(dest string) error {
 		return errors.Wrapf(err, "Error creating directory %s", dest)
 	}
 
-	userEnv := os.Environ()
+	// fetch from a shared mirror of the remote if they're enabled
+	remoteUri := a.uri
+	if gitMirrors != nil {
+		remoteUri, err = gitMirrors.sync(a.uri)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, ".git")); err == nil {
+		log.Debugf("Updating existing git repo in %s", dest)
+
+		// the URI may have changed since the source was first acquired
+		_, err = runGit(dest, "remote", "set-url", "origin", remoteUri)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		_, err = runGit(dest, "init")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = runGit(dest, "remote", "add", "origin", remoteUri)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
 
-	var stderrBuf bytes.Buffer
+	if gitMirrors != nil {
+		// borrow objects from the mirror instead of copying them
+		_, err = appendLineIfMissing(
+			filepath.Join(dest, ".git/objects/info/alternates"),
+			filepath.Join(remoteUri, "objects"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// force fetching tags so we notice if they've moved. Fetching from
+		// the mirror is local so doesn't count towards concurrent fetches.
+		_, err = runGit(dest, "fetch", "--tags", "--force", "origin")
+	} else {
+		err = fetchRemote(dest, "--tags", "--force", "origin")
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-	// git init
-	initCmd := exec.Command(GIT_PATH, "init")
-	initCmd.Dir = dest
-	initCmd.Env = userEnv
-	initCmd.Stderr = &stderrBuf
-	err = initCmd.Run()
+	_, err = runGit(dest, "config", "core.sparsecheckout", "true")
 	if err != nil {
-		return errors.Wrapf(err, "Error running: %s. Stderr: %s",
-			strings.Join(initCmd.Args, " "), stderrBuf.String())
+		return errors.WithStack(err)
 	}
 
-	stderrBuf.Reset()
+	// anchor the path to the root of the repo. It may be a directory or a
+	// single file (e.g. a manifest)
+	sparseCheckoutAdded, err := appendLineIfMissing(
+		filepath.Join(dest, ".git/info/sparse-checkout"),
+		fmt.Sprintf("/%s", strings.Trim(a.path, "/")))
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-	// add origin
-	remoteAddCmd := exec.Command(GIT_PATH, "remote", "add", "origin", a.uri)
-	remoteAddCmd.Dir = dest
-	remoteAddCmd.Env = userEnv
-	remoteAddCmd.Stderr = &stderrBuf
-	err = remoteAddCmd.Run()
+	commit, err := a.resolve(dest, true)
 	if err != nil {
-		return errors.Wrapf(err, "Error running: %s. Stderr=%s",
-			strings.Join(remoteAddCmd.Args, " "), stderrBuf.String())
+		return errors.WithStack(err)
 	}
 
-	stderrBuf.Reset()
+	if a.sha != "" && commit != a.sha {
+		return errors.New(fmt.Sprintf("Git ref '%s' of %s resolves to commit "+
+			"%s but it's pinned to %s. Has it moved?", a.ref(), a.uri, commit, a.sha))
+	}
 
-	fetchCmd := exec.Command(GIT_PATH, "fetch")
-	fetchCmd.Dir = dest
-	fetchCmd.Env = userEnv
-	fetchCmd.Stderr = &stderrBuf
-	err = fetchCmd.Run()
+	// check out branches by resetting the local branch to the remote one so
+	// existing caches are fast-forwarded. Tags and SHAs are checked out by
+	// commit so they're detached.
+	checkoutArgs := []string{"checkout", commit}
+	if a.branch != "" {
+		checkoutArgs = []string{"checkout", "-B", a.branch, commit}
+	}
+
+	_, err = runGit(dest, checkoutArgs...)
 	if err != nil {
-		return errors.Wrapf(err, "Error running: %s. Stderr=%s",
-			strings.Join(fetchCmd.Args, " "), stderrBuf.String())
+		return errors.Wrapf(err, "Error checking out %s with path '%s'",
+			a.uri, a.path)
 	}
 
-	stderrBuf.Reset()
+	err = ioutil.WriteFile(filepath.Join(dest, ".git", RESOLVED_COMMIT_FILE),
+		[]byte(commit+"\n"), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Error recording resolved commit in %s", dest)
+	}
+
+	// the checkout won't update the working tree if the commit is unchanged
+	// but the path isn't checked out yet
+	if sparseCheckoutAdded {
+		_, err = runGit(dest, "read-tree", "-mu", "HEAD")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
 
-	configCmd := exec.Command(GIT_PATH, "config", "core.sparsecheckout", "true")
-	configCmd.Dir = dest
-	configCmd.Env = userEnv
-	configCmd.Stderr = &stderrBuf
-	err = configCmd.Run()
+// Verifies that the checked out tag is signed by one of the trusted GPG keys.
+// Keys must be 16 character long key IDs or 40 character fingerprints.
+func (a GitAcquirer) verify(dest string, trustedKeys []string) error {
+	if a.tag == "" {
+		return errors.New(fmt.Sprintf("Only signed tags can be verified but "+
+			"%s is acquired from '%s'", a.uri, a.ref()))
+	}
+
+	var stderrBuf bytes.Buffer
+
+	// gpg writes the machine-readable status to stderr
+	verifyCmd := exec.Command(GIT_PATH, "verify-tag", "--raw", a.tag)
+	verifyCmd.Dir = dest
+	verifyCmd.Env = os.Environ()
+	verifyCmd.Stderr = &stderrBuf
+	err := verifyCmd.Run()
 	if err != nil {
-		return errors.Wrapf(err, "Error running: %s. Stderr=%s",
-			strings.Join(configCmd.Args, " "), stderrBuf.String())
+		return errors.Wrapf(err, "Tag '%s' of %s doesn't have a valid "+
+			"signature. Stderr=%s", a.tag, a.uri, stderrBuf.String())
+	}
+
+	signers := gpgSigners(stderrBuf.String())
+	if !isTrustedSigner(signers, trustedKeys) {
+		return errors.New(fmt.Sprintf("Tag '%s' of %s is signed by %s which "+
+			"isn't one of the trusted keys: %s", a.tag, a.uri,
+			strings.Join(signers, ", "), strings.Join(trustedKeys, ", ")))
+	}
+
+	log.Infof("Tag '%s' of %s has a trusted signature", a.tag, a.uri)
+
+	return nil
+}
+
+// Returns the key IDs and fingerprints of good signatures in gpg status output
+func gpgSigners(status string) []string {
+	signers := make([]string, 0)
+
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+
+		switch fields[1] {
+		case "GOODSIG":
+			signers = append(signers, fields[2])
+		case "VALIDSIG":
+			signers = append(signers, fields[2])
+			// the last field is the primary key fingerprint if signed by a subkey
+			if len(fields) > 11 {
+				signers = append(signers, fields[len(fields)-1])
+			}
+		}
 	}
 
-	err = appendToFile(filepath.Join(dest, ".git/info/sparse-checkout"),
-		fmt.Sprintf("%s/*\n", strings.TrimSuffix(a.path, "/")))
+	return signers
+}
+
+// Returns a trusted GPG key in the form gpg reports signers in, i.e.
+// upper-case hex without spaces or a '0x' prefix. Short key IDs are trivial to
+// forge, so only 16 character long key IDs and 40 character fingerprints are
+// accepted.
+func NormaliseGpgKey(key string) (string, error) {
+	normalised := strings.ToUpper(strings.Replace(key, " ", "", -1))
+	normalised = strings.TrimPrefix(normalised, "0X")
+
+	if len(normalised) != 16 && len(normalised) != 40 {
+		return "", errors.New(fmt.Sprintf("Invalid trusted GPG key '%s'. "+
+			"Keys must be 16 character long key IDs or 40 character "+
+			"fingerprints", key))
+	}
+
+	for _, char := range normalised {
+		if !strings.ContainsRune("0123456789ABCDEF", char) {
+			return "", errors.New(fmt.Sprintf("Invalid trusted GPG key '%s'. "+
+				"Keys must be hexadecimal", key))
+		}
+	}
+
+	return normalised, nil
+}
+
+// Returns whether any of the signers are trusted. Signers are long key IDs or
+// fingerprints, so long key IDs match the end of fingerprints. Invalid keys
+// are never trusted.
+func isTrustedSigner(signers []string, trustedKeys []string) bool {
+	for _, trustedKey := range trustedKeys {
+		key, err := NormaliseGpgKey(trustedKey)
+		if err != nil {
+			log.Warnf("Ignoring trusted key: %s", err)
+			continue
+		}
+
+		for _, signer := range signers {
+			signer = strings.ToUpper(signer)
+			if signer == key || (len(key) == 16 && strings.HasSuffix(signer, key)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the commit the branch, tag or SHA resolves to in a repo. Remote
+// branches are used instead of local ones since local branches may not have
+// been updated. SHAs that haven't been fetched are fetched if `fetch` is true.
+func (a GitAcquirer) resolve(dest string, fetch bool) (string, error) {
+	var ref string
+
+	if a.branch != "" {
+		ref = "refs/remotes/origin/" + a.branch
+	} else if a.tag != "" {
+		ref = "refs/tags/" + a.tag
+	} else {
+		// commits that aren't reachable from any fetched refs need fetching
+		// explicitly (if the remote allows it)
+		ref = a.sha
+		if _, err := runGit(dest, "rev-parse", "--verify", "--quiet",
+			ref+"^{commit}"); err != nil && fetch {
+			err = fetchRemote(dest, "origin", a.sha)
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+		}
+	}
+
+	commit, err := runGit(dest, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
 	if err != nil {
+		return "", errors.Wrapf(err, "Couldn't resolve git ref '%s' of %s",
+			a.ref(), a.uri)
+	}
+
+	return commit, nil
+}
+
+// Discards local modifications to a source previously acquired into `dest`,
+// optionally stashing them first so they can be recovered.
+func (a GitAcquirer) reset(dest string, stash bool) error {
+	if stash {
+		log.Infof("Stashing local changes to %s in %s", a.uri, dest)
+		_, err := runGit(dest, "stash", "push", "--include-untracked",
+			"--message", "Stashed by sugarkube")
 		return errors.WithStack(err)
 	}
 
-	stderrBuf.Reset()
+	log.Infof("Discarding local changes to %s in %s", a.uri, dest)
 
-	checkoutCmd := exec.Command(GIT_PATH, "checkout", a.branch)
-	checkoutCmd.Dir = dest
-	checkoutCmd.Env = userEnv
-	checkoutCmd.Stderr = &stderrBuf
-	err = checkoutCmd.Run()
+	_, err := runGit(dest, "reset", "--hard", "HEAD")
 	if err != nil {
-		return errors.Wrapf(err, "Error running: '%s' on %s with path '%s'. "+
-			"Stderr=%s", strings.Join(
-			checkoutCmd.Args, " "), a.uri, a.path, stderrBuf.String())
+		return errors.WithStack(err)
 	}
 
-	// we could optionally verify tags with:
-	// git tag -v a.branch 2>&1 >/dev/null | grep -E '{{ trusted_gpg_keys|join('|') }}'
+	_, err = runGit(dest, "clean", "-fd")
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
 	return nil
 }
 
+// Inspects a source previously acquired into `dest`. This doesn't fetch from
+// the remote, so only reports whether the checked out commit matches the
+// branch/tag as of the last fetch. Only changes to tracked files count as
+// modifications, so untracked files sugarkube generates in sources (e.g.
+// rendered templates or terraform backends) don't make the cache look dirty.
+func (a GitAcquirer) inspect(dest string) (*SourceState, error) {
+	actual, err := runGit(dest, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// pinned SHAs take priority over the branch/tag. If we can't resolve the
+	// ref it hasn't been fetched yet.
+	expected, err := a.resolve(dest, false)
+	if a.sha != "" {
+		expected, err = runGit(dest, "rev-parse", "--verify", "--quiet",
+			a.sha+"^{commit}")
+	}
+	if err != nil {
+		log.Debugf("Couldn't resolve '%s' in %s: %s", a.ref(), dest, err)
+		expected = ""
+	}
+
+	status, err := runGit(dest, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	modified := make([]string, 0)
+	for _, line := range strings.Split(status, "\n") {
+		// lines are of the form 'XY path'
+		if len(line) > 3 {
+			modified = append(modified, line[3:])
+		}
+	}
+
+	return &SourceState{
+		Ref:      a.ref(),
+		Expected: expected,
+		Actual:   actual,
+		Modified: modified,
+	}, nil
+}
+
+// Runs a git command in a directory and returns its stdout without trailing
+// newlines
+func runGit(dir string, args ...string) (string, error) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+
+	gitCmd := exec.Command(GIT_PATH, args...)
+	gitCmd.Dir = dir
+	gitCmd.Env = os.Environ()
+	gitCmd.Stdout = &stdoutBuf
+	gitCmd.Stderr = &stderrBuf
+	err := gitCmd.Run()
+	if err != nil {
+		return "", errors.Wrapf(err, "Error running: %s in %s. Stderr=%s",
+			strings.Join(gitCmd.Args, " "), dir, stderrBuf.String())
+	}
+
+	return strings.TrimRight(stdoutBuf.String(), "\n"), nil
+}
+
+// Appends a line to a file unless the file already contains it. Returns
+// whether the line was added.
+func appendLineIfMissing(filename string, line string) (bool, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrapf(err, "Error reading file %s", filename)
+	}
+
+	for _, existing := range strings.Split(string(contents), "\n") {
+		if existing == line {
+			return false, nil
+		}
+	}
+
+	err = appendToFile(filename, line+"\n")
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return true, nil
+}
+
 // Appends text to a file
 func appendToFile(filename string, text string) error {
 	// create the file if it doesn't exist
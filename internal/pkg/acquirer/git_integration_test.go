@@ -23,6 +23,7 @@ import (
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -39,3 +40,311 @@ func TestGitAcquire(t *testing.T) {
 	err = acquirer.acquire(tempDir)
 	assert.Nil(t, err)
 }
+
+// Creates a local git repo with a single commit on master
+func createLocalRepo(t *testing.T, dir string) {
+	for _, args := range [][]string{
+		{"init"},
+		{"checkout", "-b", "master"},
+	} {
+		_, err := runGit(dir, args...)
+		assert.Nil(t, err)
+	}
+
+	err := os.MkdirAll(filepath.Join(dir, "kapp"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "kapp", "Makefile"), []byte("all:\n"), 0644)
+	assert.Nil(t, err)
+
+	commitAll(t, dir, "initial")
+}
+
+// Commits all changes in a local git repo
+func commitAll(t *testing.T, dir string, message string) {
+	for _, args := range [][]string{
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com",
+			"commit", "-m", message},
+	} {
+		_, err := runGit(dir, args...)
+		assert.Nil(t, err)
+	}
+}
+
+func TestGitInspect(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "git-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	repoDir := filepath.Join(tempDir, "repo")
+	err = os.MkdirAll(repoDir, 0755)
+	assert.Nil(t, err)
+	createLocalRepo(t, repoDir)
+
+	commit, err := runGit(repoDir, "rev-parse", "HEAD")
+	assert.Nil(t, err)
+
+	acquirer := NewGitAcquirer("", repoDir, "master", "kapp")
+	dest := filepath.Join(tempDir, "dest")
+	err = acquirer.acquire(dest)
+	assert.Nil(t, err)
+
+	state, err := acquirer.inspect(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, commit, state.Actual)
+	assert.False(t, state.OutOfDate())
+	assert.Empty(t, state.Modified)
+
+	// modify a file
+	err = ioutil.WriteFile(filepath.Join(dest, "kapp", "Makefile"), []byte("changed\n"), 0644)
+	assert.Nil(t, err)
+
+	state, err = acquirer.inspect(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kapp/Makefile"}, state.Modified)
+
+	// untracked files aren't modifications
+	err = ioutil.WriteFile(filepath.Join(dest, "kapp", "_generated_values.yaml"), []byte("a: b\n"), 0644)
+	assert.Nil(t, err)
+
+	state, err = acquirer.inspect(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kapp/Makefile"}, state.Modified)
+
+	// a different branch that's not been fetched can't be resolved
+	otherAcquirer := NewGitAcquirer("", repoDir, "other", "kapp")
+	state, err = otherAcquirer.inspect(dest)
+	assert.Nil(t, err)
+	assert.Empty(t, state.Expected)
+	assert.True(t, state.OutOfDate())
+}
+
+func TestGitAcquireExisting(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "git-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	repoDir := filepath.Join(tempDir, "repo")
+	err = os.MkdirAll(repoDir, 0755)
+	assert.Nil(t, err)
+	createLocalRepo(t, repoDir)
+
+	acquirer := NewGitAcquirer("", repoDir, "master", "kapp")
+	dest := filepath.Join(tempDir, "dest")
+	err = acquirer.acquire(dest)
+	assert.Nil(t, err)
+
+	// add a new commit upstream, then reacquire into the same directory
+	err = ioutil.WriteFile(filepath.Join(repoDir, "kapp", "values.yaml"), []byte("a: b\n"), 0644)
+	assert.Nil(t, err)
+	commitAll(t, repoDir, "second")
+
+	err = acquirer.acquire(dest)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(dest, "kapp", "values.yaml"))
+	assert.Nil(t, err)
+
+	sparseCheckout, err := ioutil.ReadFile(filepath.Join(dest, ".git/info/sparse-checkout"))
+	assert.Nil(t, err)
+	assert.Equal(t, "/kapp\n", string(sparseCheckout))
+
+	state, err := acquirer.inspect(dest)
+	assert.Nil(t, err)
+	assert.False(t, state.OutOfDate())
+}
+
+func TestGitReset(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "git-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// stashing requires an identity
+	os.Setenv("GIT_AUTHOR_NAME", "test")
+	os.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	os.Setenv("GIT_COMMITTER_NAME", "test")
+	os.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	repoDir := filepath.Join(tempDir, "repo")
+	err = os.MkdirAll(repoDir, 0755)
+	assert.Nil(t, err)
+	createLocalRepo(t, repoDir)
+
+	acquirer := NewGitAcquirer("", repoDir, "master", "kapp")
+	dest := filepath.Join(tempDir, "dest")
+	err = acquirer.acquire(dest)
+	assert.Nil(t, err)
+
+	for _, stash := range []bool{true, false} {
+		err = ioutil.WriteFile(filepath.Join(dest, "kapp", "Makefile"), []byte("changed\n"), 0644)
+		assert.Nil(t, err)
+
+		err = acquirer.reset(dest, stash)
+		assert.Nil(t, err)
+
+		state, err := acquirer.inspect(dest)
+		assert.Nil(t, err)
+		assert.Empty(t, state.Modified, "stash=%v", stash)
+	}
+
+	stashes, err := runGit(dest, "stash", "list")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, stashes)
+}
+
+func TestGitAcquireFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "git-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	repoDir := filepath.Join(tempDir, "repo")
+	err = os.MkdirAll(repoDir, 0755)
+	assert.Nil(t, err)
+	createLocalRepo(t, repoDir)
+
+	acquirer := NewGitAcquirer("", repoDir, "master", "kapp/Makefile")
+	dest := filepath.Join(tempDir, "dest")
+	err = acquirer.acquire(dest)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(dest, "kapp", "Makefile"))
+	assert.Nil(t, err)
+}
+
+func TestGitAcquirePinned(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "git-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	repoDir := filepath.Join(tempDir, "repo")
+	err = os.MkdirAll(repoDir, 0755)
+	assert.Nil(t, err)
+	createLocalRepo(t, repoDir)
+
+	firstCommit, err := runGit(repoDir, "rev-parse", "HEAD")
+	assert.Nil(t, err)
+	_, err = runGit(repoDir, "tag", "v1.0.0")
+	assert.Nil(t, err)
+
+	// add a commit to master after the tag
+	err = ioutil.WriteFile(filepath.Join(repoDir, "kapp", "values.yaml"), []byte("a: b\n"), 0644)
+	assert.Nil(t, err)
+	commitAll(t, repoDir, "second")
+
+	secondCommit, err := runGit(repoDir, "rev-parse", "HEAD")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name     string
+		acquirer GitAcquirer
+		expected string
+	}{
+		{
+			name:     "tag",
+			acquirer: NewPinnedGitAcquirer("", repoDir, "", "v1.0.0", "", "kapp"),
+			expected: firstCommit,
+		},
+		{
+			name:     "tag_pinned",
+			acquirer: NewPinnedGitAcquirer("", repoDir, "", "v1.0.0", firstCommit, "kapp"),
+			expected: firstCommit,
+		},
+		{
+			name:     "sha",
+			acquirer: NewPinnedGitAcquirer("", repoDir, "", "", firstCommit, "kapp"),
+			expected: firstCommit,
+		},
+		{
+			name:     "branch",
+			acquirer: NewGitAcquirer("", repoDir, "master", "kapp"),
+			expected: secondCommit,
+		},
+	}
+
+	for _, test := range tests {
+		dest := filepath.Join(tempDir, test.name)
+		err = test.acquirer.acquire(dest)
+		assert.Nil(t, err, "error acquiring %s", test.name)
+
+		actual, err := runGit(dest, "rev-parse", "HEAD")
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, actual, "unexpected commit for %s", test.name)
+
+		recorded, err := ioutil.ReadFile(filepath.Join(dest, ".git", RESOLVED_COMMIT_FILE))
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected+"\n", string(recorded), "unexpected recorded commit for %s", test.name)
+
+		state, err := test.acquirer.inspect(dest)
+		assert.Nil(t, err)
+		assert.False(t, state.OutOfDate(), "%s shouldn't be out-of-date", test.name)
+	}
+
+	// move the tag
+	_, err = runGit(repoDir, "tag", "--force", "v1.0.0", secondCommit)
+	assert.Nil(t, err)
+
+	pinned := NewPinnedGitAcquirer("", repoDir, "", "v1.0.0", firstCommit, "kapp")
+	err = pinned.acquire(filepath.Join(tempDir, "tag_pinned"))
+	assert.NotNil(t, err, "moved tags should cause an error")
+
+	// commits are compared in full
+	pinned = NewPinnedGitAcquirer("", repoDir, "", "v1.0.0", secondCommit[:8], "kapp")
+	err = pinned.acquire(filepath.Join(tempDir, "tag_pinned"))
+	assert.NotNil(t, err, "abbreviated SHAs shouldn't match")
+}
+
+func TestGitAcquireMirrored(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "git-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	repoDir := filepath.Join(tempDir, "repo")
+	err = os.MkdirAll(repoDir, 0755)
+	assert.Nil(t, err)
+	createLocalRepo(t, repoDir)
+
+	firstCommit, err := runGit(repoDir, "rev-parse", "HEAD")
+	assert.Nil(t, err)
+
+	mirrorDir := filepath.Join(tempDir, "mirrors")
+	ConfigureGit(mirrorDir, 1)
+	defer ConfigureGit("", 0)
+
+	firstDest := filepath.Join(tempDir, "first")
+	err = NewGitAcquirer("", repoDir, "master", "kapp").acquire(firstDest)
+	assert.Nil(t, err)
+
+	mirrors, err := ioutil.ReadDir(mirrorDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(mirrors))
+	mirrorPath := filepath.Join(mirrorDir, mirrors[0].Name())
+
+	alternates, err := ioutil.ReadFile(filepath.Join(firstDest, ".git/objects/info/alternates"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(mirrorPath, "objects")+"\n", string(alternates))
+
+	// commits pushed upstream after the mirror was fetched shouldn't be seen
+	// by other sources from the same repo in the same run
+	err = ioutil.WriteFile(filepath.Join(repoDir, "kapp", "values.yaml"), []byte("a: b\n"), 0644)
+	assert.Nil(t, err)
+	commitAll(t, repoDir, "second")
+
+	secondDest := filepath.Join(tempDir, "second")
+	err = NewGitAcquirer("", repoDir, "master", "kapp").acquire(secondDest)
+	assert.Nil(t, err)
+
+	head, err := runGit(secondDest, "rev-parse", "HEAD")
+	assert.Nil(t, err)
+	assert.Equal(t, firstCommit, head)
+
+	// the next run fetches the mirror again
+	ConfigureGit(mirrorDir, 1)
+	err = NewGitAcquirer("", repoDir, "master", "kapp").acquire(secondDest)
+	assert.Nil(t, err)
+
+	secondCommit, err := runGit(repoDir, "rev-parse", "HEAD")
+	assert.Nil(t, err)
+	head, err = runGit(secondDest, "rev-parse", "HEAD")
+	assert.Nil(t, err)
+	assert.Equal(t, secondCommit, head)
+}
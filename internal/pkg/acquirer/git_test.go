@@ -59,6 +59,42 @@ func TestId(t *testing.T) {
 				"examples/values/wordpress/site1/"),
 			expectValues: "sugarkube-sugarkube-master-site1-values",
 		},
+		{
+			name: "good_tag",
+			desc: "check tags are used in IDs",
+			input: NewPinnedGitAcquirer(
+				"",
+				"git@github.com:helm/charts.git",
+				"",
+				"v1.0.0",
+				"",
+				"stable/wordpress"),
+			expectValues: "helm-charts-v1.0.0-wordpress",
+		},
+		{
+			name: "good_pinned_tag",
+			desc: "check pinning a tag to a SHA doesn't change the ID",
+			input: NewPinnedGitAcquirer(
+				"",
+				"git@github.com:helm/charts.git",
+				"",
+				"v1.0.0",
+				"0123456789abcdef0123456789abcdef01234567",
+				"stable/wordpress"),
+			expectValues: "helm-charts-v1.0.0-wordpress",
+		},
+		{
+			name: "good_sha",
+			desc: "check SHAs are used in IDs if there's no branch or tag",
+			input: NewPinnedGitAcquirer(
+				"",
+				"git@github.com:helm/charts.git",
+				"",
+				"",
+				"0123456789abcdef0123456789abcdef01234567",
+				"stable/wordpress"),
+			expectValues: "helm-charts-0123456789abcdef0123456789abcdef01234567-wordpress",
+		},
 		{
 			name: "error_invalid_uri",
 			desc: "check invalid git URIs cause errors",
@@ -83,3 +119,121 @@ func TestId(t *testing.T) {
 		}
 	}
 }
+
+func TestIsTrustedSigner(t *testing.T) {
+	status := `[GNUPG:] NEWSIG
+[GNUPG:] KEY_CONSIDERED 0123456789ABCDEF0123456789ABCDEF01234567 0
+[GNUPG:] SIG_ID abc 2018-10-01 1538352000
+[GNUPG:] GOODSIG 89ABCDEF01234567 Dev <dev@example.com>
+[GNUPG:] VALIDSIG FEDCBA9876543210FEDCBA9876543210FEDCBA98 2018-10-01 1538352000 0 4 0 1 8 00 0123456789ABCDEF0123456789ABCDEF01234567
+[GNUPG:] TRUST_ULTIMATE 0 pgp
+`
+
+	signers := gpgSigners(status)
+	assert.Equal(t, []string{
+		"89ABCDEF01234567",
+		"FEDCBA9876543210FEDCBA9876543210FEDCBA98",
+		"0123456789ABCDEF0123456789ABCDEF01234567",
+	}, signers)
+
+	tests := []struct {
+		name        string
+		desc        string
+		trustedKeys []string
+		expected    bool
+	}{
+		{
+			name:        "fingerprint",
+			desc:        "primary key fingerprints should be trusted",
+			trustedKeys: []string{"0123 4567 89ab cdef 0123  4567 89AB CDEF 0123 4567"},
+			expected:    true,
+		},
+		{
+			name:        "long_id",
+			desc:        "long key IDs should be trusted",
+			trustedKeys: []string{"0x89abcdef01234567"},
+			expected:    true,
+		},
+		{
+			name:        "long_id_of_fingerprint",
+			desc:        "long key IDs should match the end of fingerprints",
+			trustedKeys: []string{"89ABCDEF01234567"},
+			expected:    true,
+		},
+		{
+			name:        "short_id",
+			desc:        "short key IDs can be forged so shouldn't be trusted",
+			trustedKeys: []string{"0x01234567"},
+			expected:    false,
+		},
+		{
+			name:        "untrusted",
+			desc:        "signatures by other keys shouldn't be trusted",
+			trustedKeys: []string{"1234123412341234", ""},
+			expected:    false,
+		},
+		{
+			name:        "no_keys",
+			desc:        "nothing should be trusted without keys",
+			trustedKeys: []string{},
+			expected:    false,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isTrustedSigner(signers, test.trustedKeys),
+			"unexpected result for %s", test.name)
+	}
+}
+
+func TestNormaliseGpgKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		desc        string
+		key         string
+		expected    string
+		expectedErr bool
+	}{
+		{
+			name:     "fingerprint",
+			desc:     "fingerprints should have spaces removed and be upper-cased",
+			key:      "0123 4567 89ab cdef 0123  4567 89AB CDEF 0123 4567",
+			expected: "0123456789ABCDEF0123456789ABCDEF01234567",
+		},
+		{
+			name:     "long_id",
+			desc:     "long key IDs should have any 0x prefix removed",
+			key:      "0x89abcdef01234567",
+			expected: "89ABCDEF01234567",
+		},
+		{
+			name:        "short_id",
+			desc:        "short key IDs should be rejected",
+			key:         "01234567",
+			expectedErr: true,
+		},
+		{
+			name:        "not_hex",
+			desc:        "keys must be hexadecimal",
+			key:         "0123456789ABCDEG",
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		actual, err := NormaliseGpgKey(test.key)
+		if test.expectedErr {
+			assert.NotNil(t, err, "expected an error for %s: %s", test.name, test.desc)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+			assert.Equal(t, test.expected, actual, "unexpected key for %s: %s", test.name, test.desc)
+		}
+	}
+}
+
+func TestVerifyUntagged(t *testing.T) {
+	acquirer := NewGitAcquirer("", "git@github.com:helm/charts.git", "master",
+		"stable/wordpress")
+	err := Verify(acquirer, "/nonexistent", []string{"89ABCDEF01234567"})
+	assert.NotNil(t, err)
+}
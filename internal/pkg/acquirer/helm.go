@@ -0,0 +1,206 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acquirer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Acquires charts from helm chart repositories
+type HelmAcquirer struct {
+	name    string
+	repo    string
+	chart   string
+	version string
+	path    string
+}
+
+const HELM = "helm"
+
+// settings keys for helm sources
+const REPO = "repo"
+const CHART = "chart"
+const VERSION = "version"
+
+// The parts of a chart repository's index.yaml file we care about
+type helmIndex struct {
+	Entries map[string][]helmChartVersion `yaml:"entries"`
+}
+
+type helmChartVersion struct {
+	Name    string   `yaml:"name"`
+	Version string   `yaml:"version"`
+	Urls    []string `yaml:"urls"`
+	Digest  string   `yaml:"digest"`
+}
+
+// The parts of a chart's Chart.yaml file we care about
+type helmChart struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+}
+
+// Returns an instance. Charts are extracted into a directory named after the
+// chart, so the path defaults to the chart name.
+func NewHelmAcquirer(name string, repo string, chart string, version string,
+	path string) HelmAcquirer {
+	if path == "" {
+		path = chart
+	}
+
+	if name == "" {
+		name = chart
+	}
+
+	return HelmAcquirer{
+		name:    name,
+		repo:    strings.TrimSuffix(repo, "/"),
+		chart:   chart,
+		version: version,
+		path:    path,
+	}
+}
+
+// Generate an ID from the chart, version, a hash of the repo URL and the name
+func (a HelmAcquirer) Id() (string, error) {
+	repoHash := fmt.Sprintf("%x", sha256.Sum256([]byte(a.repo)))[:12]
+	hyphenatedName := strings.Replace(a.name, "/", "-", -1)
+
+	return strings.Join([]string{a.chart, a.version, repoHash, hyphenatedName}, "-"), nil
+}
+
+// return the name
+func (a HelmAcquirer) Name() string {
+	return a.name
+}
+
+// return the path
+func (a HelmAcquirer) Path() string {
+	return a.path
+}
+
+// Looks the chart up in the repository's index and acquires its archive
+func (a HelmAcquirer) acquire(dest string) error {
+	log.Infof("Acquiring helm chart %s-%s from %s into %s", a.chart, a.version,
+		a.repo, dest)
+
+	chartVersion, err := a.resolve()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	chartUrl, err := resolveUrl(a.repo, chartVersion.Urls[0])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return NewHttpAcquirer(a.name, chartUrl, a.path, chartVersion.Digest).acquire(dest)
+}
+
+// Returns the entry for the chart version from the repository's index
+func (a HelmAcquirer) resolve() (*helmChartVersion, error) {
+	indexUrl := a.repo + "/index.yaml"
+
+	var indexBuf bytes.Buffer
+	_, err := download(indexUrl, &indexBuf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	index := helmIndex{}
+	err = yaml.Unmarshal(indexBuf.Bytes(), &index)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing helm repository index %s",
+			indexUrl)
+	}
+
+	for _, chartVersion := range index.Entries[a.chart] {
+		if chartVersion.Version == a.version {
+			if len(chartVersion.Urls) == 0 {
+				return nil, errors.New(fmt.Sprintf("No URLs for chart %s-%s "+
+					"in %s", a.chart, a.version, indexUrl))
+			}
+
+			return &chartVersion, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("Chart %s-%s not found in %s", a.chart,
+		a.version, indexUrl))
+}
+
+// Compares the name and version in the extracted Chart.yaml file against the
+// configured chart and version
+func (a HelmAcquirer) inspect(dest string) (*SourceState, error) {
+	metadata, err := loadArchiveMetadata(dest)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	actual := ""
+	chartBytes, err := ioutil.ReadFile(filepath.Join(dest, a.chart, "Chart.yaml"))
+	if err == nil {
+		chart := helmChart{}
+		err = yaml.Unmarshal(chartBytes, &chart)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing Chart.yaml in %s", dest)
+		}
+		actual = fmt.Sprintf("%s-%s", chart.Name, chart.Version)
+	}
+
+	modified, err := modifiedArchiveFiles(dest, metadata)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &SourceState{
+		Ref:      a.version,
+		Expected: fmt.Sprintf("%s-%s", a.chart, a.version),
+		Actual:   actual,
+		Modified: modified,
+	}, nil
+}
+
+// Charts are reset the same way as other archives
+func (a HelmAcquirer) reset(dest string, stash bool) error {
+	return NewHttpAcquirer(a.name, a.repo, a.path, "").reset(dest, stash)
+}
+
+// Resolves a possibly relative URL against a base URL. Chart URLs in indexes
+// may be relative to the repository.
+func resolveUrl(base string, ref string) (string, error) {
+	baseUrl, err := url.Parse(base + "/")
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid URL %s", base)
+	}
+
+	refUrl, err := url.Parse(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid URL %s", ref)
+	}
+
+	return baseUrl.ResolveReference(refUrl).String(), nil
+}
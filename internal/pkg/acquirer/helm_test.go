@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acquirer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewAcquirerHelm(t *testing.T) {
+	actual, err := NewAcquirer(map[string]string{
+		"acquirer": "helm",
+		"repo":     "https://charts.example.com/",
+		"chart":    "nginx-ingress",
+		"version":  "1.2.3",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, HelmAcquirer{
+		name:    "nginx-ingress",
+		repo:    "https://charts.example.com",
+		chart:   "nginx-ingress",
+		version: "1.2.3",
+		path:    "nginx-ingress",
+	}, actual)
+
+	_, err = NewAcquirer(map[string]string{
+		"acquirer": "helm",
+		"repo":     "https://charts.example.com/",
+		"chart":    "nginx-ingress",
+	})
+	assert.NotNil(t, err, "the version should be mandatory")
+}
+
+func TestHelmAcquire(t *testing.T) {
+	chart := createTarGz(t, map[string]string{
+		"nginx-ingress/Chart.yaml":            "name: nginx-ingress\nversion: 1.2.3\n",
+		"nginx-ingress/templates/deploy.yaml": "kind: Deployment\n",
+	})
+	digest := fmt.Sprintf("%x", sha256.Sum256(chart))
+
+	// chart URLs in the index are relative to the repo
+	index := fmt.Sprintf(`apiVersion: v1
+entries:
+  nginx-ingress:
+  - name: nginx-ingress
+    version: 1.2.4
+    urls:
+    - charts/nginx-ingress-1.2.4.tgz
+  - name: nginx-ingress
+    version: 1.2.3
+    digest: %s
+    urls:
+    - charts/nginx-ingress-1.2.3.tgz
+`, digest)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stable/index.yaml":
+			w.Write([]byte(index))
+		case "/stable/charts/nginx-ingress-1.2.3.tgz":
+			w.Write(chart)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "helm-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	acquirer := NewHelmAcquirer("", server.URL+"/stable", "nginx-ingress", "1.2.3", "")
+	dest := filepath.Join(tempDir, "dest")
+	err = acquirer.acquire(dest)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(dest, acquirer.Path(), "templates/deploy.yaml"))
+	assert.Nil(t, err)
+
+	state, err := acquirer.inspect(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, "nginx-ingress-1.2.3", state.Actual)
+	assert.False(t, state.OutOfDate())
+	assert.Empty(t, state.Modified)
+
+	newerAcquirer := NewHelmAcquirer("", server.URL+"/stable", "nginx-ingress", "1.2.4", "")
+	state, err = newerAcquirer.inspect(dest)
+	assert.Nil(t, err)
+	assert.True(t, state.OutOfDate())
+
+	missingAcquirer := NewHelmAcquirer("", server.URL+"/stable", "nginx-ingress", "9.9.9", "")
+	err = missingAcquirer.acquire(filepath.Join(tempDir, "missing"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acquirer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Acquires sources by downloading and extracting archives (tarballs or zip
+// files) over HTTP(S)
+type HttpAcquirer struct {
+	name   string
+	uri    string
+	path   string
+	sha256 string // optional checksum of the archive
+}
+
+const HTTP = "http"
+
+// settings key for the expected sha256 checksum of an archive
+const SHA256 = "sha256"
+
+// Name of the file recording what was extracted into a destination directory
+const ARCHIVE_METADATA_FILE = ".sugarkube-archive.yaml"
+
+// Details of an archive extracted into a directory. Used to work out whether
+// the directory is out-of-date or has been modified.
+type archiveMetadata struct {
+	Uri    string            `yaml:"uri"`
+	Sha256 string            `yaml:"sha256"`
+	Files  map[string]string `yaml:"files"` // digests of extracted files
+}
+
+// Returns an instance. This allows us to build objects for testing instead of
+// directly instantiating objects in the acquirer factory.
+func NewHttpAcquirer(name string, uri string, path string, sha256 string) HttpAcquirer {
+	if name == "" {
+		if path != "" {
+			name = filepath.Base(path)
+		} else {
+			name = archiveBaseName(uri)
+		}
+	}
+
+	return HttpAcquirer{
+		name:   name,
+		uri:    uri,
+		path:   path,
+		sha256: strings.ToLower(sha256),
+	}
+}
+
+// Returns whether a URI looks like an archive that can be downloaded over HTTP
+func isHttpArchive(uri string) bool {
+	return (strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")) &&
+		archiveFormat(uri) != ""
+}
+
+// Generate an ID from the archive name, a hash of the URI and checksum (so
+// different versions of an archive with the same name don't clash) and the name
+func (a HttpAcquirer) Id() (string, error) {
+	if archiveFormat(a.uri) == "" {
+		return "", errors.New(fmt.Sprintf("Unsupported archive URI %s. "+
+			"Expected a .tar.gz, .tgz or .zip file", a.uri))
+	}
+
+	hash := sha256.Sum256([]byte(a.uri + "#" + a.sha256))
+	hyphenatedName := strings.Replace(a.name, "/", "-", -1)
+
+	return strings.Join([]string{archiveBaseName(a.uri),
+		fmt.Sprintf("%x", hash)[:12], hyphenatedName}, "-"), nil
+}
+
+// return the name
+func (a HttpAcquirer) Name() string {
+	return a.name
+}
+
+// return the path
+func (a HttpAcquirer) Path() string {
+	return a.path
+}
+
+// Downloads the archive, verifies its checksum and extracts it to `dest`,
+// replacing anything previously acquired there. If the archive has a checksum
+// and it's already been extracted to `dest`, the download is skipped.
+func (a HttpAcquirer) acquire(dest string) error {
+	if a.sha256 != "" {
+		metadata, err := loadArchiveMetadata(dest)
+		if err == nil && metadata.Uri == a.uri && metadata.Sha256 == a.sha256 {
+			log.Infof("Archive %s already extracted into %s", a.uri, dest)
+			return nil
+		}
+	}
+
+	log.Infof("Acquiring archive %s into %s", a.uri, dest)
+
+	archiveFile, err := ioutil.TempFile("", "sugarkube-archive-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(archiveFile.Name())
+
+	checksum, err := download(a.uri, archiveFile)
+	archiveFile.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if a.sha256 != "" && checksum != a.sha256 {
+		return errors.New(fmt.Sprintf("Checksum mismatch for %s. Expected "+
+			"sha256 %s but got %s", a.uri, a.sha256, checksum))
+	}
+
+	err = os.RemoveAll(dest)
+	if err != nil {
+		return errors.Wrapf(err, "Error removing %s", dest)
+	}
+
+	err = os.MkdirAll(dest, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "Error creating directory %s", dest)
+	}
+
+	err = extractArchive(archiveFile.Name(), archiveFormat(a.uri), dest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	files, err := digestFiles(dest, ARCHIVE_METADATA_FILE)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	metadataBytes, err := yaml.Marshal(archiveMetadata{
+		Uri:    a.uri,
+		Sha256: checksum,
+		Files:  files,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dest, ARCHIVE_METADATA_FILE), metadataBytes, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Compares the archive extracted to `dest` against the configured URI and
+// checksum, and reports files that have changed since it was extracted
+func (a HttpAcquirer) inspect(dest string) (*SourceState, error) {
+	metadata, err := loadArchiveMetadata(dest)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	expected := a.uri
+	actual := metadata.Uri
+
+	// only compare checksums if we know what to expect
+	if a.sha256 != "" {
+		expected += "#" + a.sha256
+		actual += "#" + metadata.Sha256
+	}
+
+	modified, err := modifiedArchiveFiles(dest, metadata)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &SourceState{
+		Ref:      a.uri,
+		Expected: expected,
+		Actual:   actual,
+		Modified: modified,
+	}, nil
+}
+
+// Archives can't be stashed, but local changes can be discarded by deleting
+// the extracted archive so it's extracted again when it's next acquired
+func (a HttpAcquirer) reset(dest string, stash bool) error {
+	if stash {
+		return errors.New(fmt.Sprintf("Local changes to archive %s in %s "+
+			"can't be stashed", a.uri, dest))
+	}
+
+	log.Infof("Discarding local changes to %s in %s", a.uri, dest)
+	err := os.RemoveAll(dest)
+	if err != nil {
+		return errors.Wrapf(err, "Error removing %s", dest)
+	}
+
+	return nil
+}
+
+// Returns the paths of files that have been added, changed or removed since
+// an archive was extracted to a directory
+func modifiedArchiveFiles(dir string, metadata *archiveMetadata) ([]string, error) {
+	files, err := digestFiles(dir, ARCHIVE_METADATA_FILE)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	modified := make([]string, 0)
+	for path, digest := range files {
+		if metadata.Files[path] != digest {
+			modified = append(modified, path)
+		}
+	}
+	for path := range metadata.Files {
+		if _, ok := files[path]; !ok {
+			modified = append(modified, path)
+		}
+	}
+	sort.Strings(modified)
+
+	return modified, nil
+}
+
+// Downloads a URI to a writer and returns the sha256 checksum of the content
+func download(uri string, writer io.Writer) (string, error) {
+	response, err := http.Get(uri)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error downloading %s", uri)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Error downloading %s. Got "+
+			"status: %s", uri, response.Status))
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(writer, hash), response.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error downloading %s", uri)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// Loads the metadata written when an archive was extracted to a directory
+func loadArchiveMetadata(dir string) (*archiveMetadata, error) {
+	metadataBytes, err := ioutil.ReadFile(filepath.Join(dir, ARCHIVE_METADATA_FILE))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading archive metadata in %s", dir)
+	}
+
+	metadata := archiveMetadata{}
+	err = yaml.Unmarshal(metadataBytes, &metadata)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing archive metadata in %s", dir)
+	}
+
+	return &metadata, nil
+}
@@ -0,0 +1,319 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acquirer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// files in each test archive
+var archiveFiles = map[string]string{
+	"chart/Chart.yaml":            "name: chart\n",
+	"chart/templates/deploy.yaml": "kind: Deployment\n",
+}
+
+// Returns a gzipped tarball containing files
+func createTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for name, contents := range files {
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+			Typeflag: tar.TypeReg,
+		})
+		assert.Nil(t, err)
+		_, err = tarWriter.Write([]byte(contents))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, tarWriter.Close())
+	assert.Nil(t, gzipWriter.Close())
+
+	return buf.Bytes()
+}
+
+// Returns a zip file containing archiveFiles
+func createZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+
+	for name, contents := range archiveFiles {
+		writer, err := zipWriter.Create(name)
+		assert.Nil(t, err)
+		_, err = writer.Write([]byte(contents))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, zipWriter.Close())
+
+	return buf.Bytes()
+}
+
+func TestNewAcquirerHttp(t *testing.T) {
+	actual, err := NewAcquirer(map[string]string{
+		"uri":    "https://github.com/org/repo.github.io/archive/v1.0.0.tar.gz",
+		"path":   "repo/chart",
+		"sha256": "ABC123",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, HttpAcquirer{
+		name:   "chart",
+		uri:    "https://github.com/org/repo.github.io/archive/v1.0.0.tar.gz",
+		path:   "repo/chart",
+		sha256: "abc123",
+	}, actual)
+}
+
+func TestHttpId(t *testing.T) {
+	acquirer := NewHttpAcquirer("", "https://example.com/chart-1.0.0.tgz", "chart", "abc")
+	id, err := acquirer.Id()
+	assert.Nil(t, err)
+
+	// IDs should be deterministic
+	sameAcquirer := NewHttpAcquirer("", "https://example.com/chart-1.0.0.tgz", "chart", "abc")
+	sameId, err := sameAcquirer.Id()
+	assert.Nil(t, err)
+	assert.Equal(t, id, sameId)
+	assert.Regexp(t, "^chart-1.0.0-[0-9a-f]{12}-chart$", id)
+
+	// different checksums should give different IDs
+	otherAcquirer := NewHttpAcquirer("", "https://example.com/chart-1.0.0.tgz", "chart", "def")
+	otherId, err := otherAcquirer.Id()
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, otherId)
+
+	badAcquirer := NewHttpAcquirer("", "https://example.com/chart", "chart", "")
+	_, err = badAcquirer.Id()
+	assert.NotNil(t, err)
+}
+
+func TestHttpAcquire(t *testing.T) {
+	archives := map[string][]byte{
+		"/chart.tar.gz": createTarGz(t, archiveFiles),
+		"/chart.zip":    createZip(t),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archive, ok := archives[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "http-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	for path, archive := range archives {
+		checksum := fmt.Sprintf("%x", sha256.Sum256(archive))
+		acquirer := NewHttpAcquirer("", server.URL+path, "chart", checksum)
+		dest := filepath.Join(tempDir, path)
+
+		err = acquirer.acquire(dest)
+		assert.Nil(t, err, "error acquiring %s", path)
+
+		for name, contents := range archiveFiles {
+			actual, err := ioutil.ReadFile(filepath.Join(dest, name))
+			assert.Nil(t, err)
+			assert.Equal(t, contents, string(actual))
+		}
+
+		state, err := acquirer.inspect(dest)
+		assert.Nil(t, err)
+		assert.False(t, state.OutOfDate())
+		assert.Empty(t, state.Modified)
+
+		// local modifications should be reported
+		err = ioutil.WriteFile(filepath.Join(dest, "chart/Chart.yaml"), []byte("changed"), 0644)
+		assert.Nil(t, err)
+
+		state, err = acquirer.inspect(dest)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"chart/Chart.yaml"}, state.Modified)
+
+		// a different checksum should be out-of-date
+		otherAcquirer := NewHttpAcquirer("", server.URL+path, "chart", "abc")
+		state, err = otherAcquirer.inspect(dest)
+		assert.Nil(t, err)
+		assert.True(t, state.OutOfDate())
+	}
+}
+
+func TestHttpAcquireErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chart.tgz" {
+			w.Write(createTarGz(t, archiveFiles))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "http-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	badChecksum := NewHttpAcquirer("", server.URL+"/chart.tgz", "chart", "abc")
+	err = badChecksum.acquire(filepath.Join(tempDir, "bad-checksum"))
+	assert.NotNil(t, err)
+
+	missing := NewHttpAcquirer("", server.URL+"/missing.tgz", "chart", "")
+	err = missing.acquire(filepath.Join(tempDir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestExtractPath(t *testing.T) {
+	_, err := extractPath("/tmp/dest", "../../etc/passwd")
+	assert.NotNil(t, err)
+
+	actual, err := extractPath("/tmp/dest", "chart/Chart.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/dest/chart/Chart.yaml", actual)
+}
+
+// An entry in a test tarball
+type tarEntry struct {
+	name     string
+	linkname string
+	contents string
+}
+
+// Returns a gzipped tarball containing entries in order. Entries with a
+// linkname are symlinks.
+func createTarGzEntries(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Mode:     0644,
+			Size:     int64(len(entry.contents)),
+			Typeflag: tar.TypeReg,
+		}
+		if entry.linkname != "" {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.linkname
+			header.Size = 0
+		}
+
+		err := tarWriter.WriteHeader(header)
+		assert.Nil(t, err)
+		_, err = tarWriter.Write([]byte(entry.contents))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, tarWriter.Close())
+	assert.Nil(t, gzipWriter.Close())
+
+	return buf.Bytes()
+}
+
+func TestExtractTarGzSymlinks(t *testing.T) {
+	tests := []struct {
+		name        string
+		desc        string
+		entries     []tarEntry
+		expectedErr bool
+	}{
+		{
+			name: "internal_link",
+			desc: "links to files inside the archive are allowed",
+			entries: []tarEntry{
+				{name: "chart/values.yaml", contents: "a: b\n"},
+				{name: "chart/values-dev.yaml", linkname: "values.yaml"},
+			},
+		},
+		{
+			name: "absolute_link",
+			desc: "links with absolute targets are rejected",
+			entries: []tarEntry{
+				{name: "chart/passwd", linkname: "/etc/passwd"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "escaping_relative_link",
+			desc: "relative links are resolved against the link's directory",
+			entries: []tarEntry{
+				{name: "a/b/link", linkname: "../../../outside"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "write_through_link",
+			desc: "files can't be written through previously extracted links",
+			entries: []tarEntry{
+				{name: "chart/dir", linkname: "."},
+				{name: "chart/dir/file", contents: "x\n"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "replace_link",
+			desc: "links can't be overwritten by files",
+			entries: []tarEntry{
+				{name: "chart/values.yaml", contents: "a: b\n"},
+				{name: "chart/link", linkname: "values.yaml"},
+				{name: "chart/link", contents: "x\n"},
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		tempDir, err := ioutil.TempDir("", "archive-")
+		assert.Nil(t, err)
+
+		archivePath := filepath.Join(tempDir, "archive.tar.gz")
+		err = ioutil.WriteFile(archivePath, createTarGzEntries(t, test.entries), 0644)
+		assert.Nil(t, err)
+
+		dest := filepath.Join(tempDir, "dest")
+		err = extractTarGz(archivePath, dest)
+		if test.expectedErr {
+			assert.NotNil(t, err, "expected an error for test %s: %s", test.name, test.desc)
+		} else {
+			assert.Nil(t, err, "unexpected error for test %s: %s", test.name, test.desc)
+		}
+
+		_, err = os.Lstat(filepath.Join(tempDir, "outside"))
+		assert.True(t, os.IsNotExist(err), "file written outside dest for test %s", test.name)
+
+		os.RemoveAll(tempDir)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acquirer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Bare mirrors of remote git repos shared by all git acquirers. Each remote is
+// fetched into its mirror at most once per run, and kapp checkouts borrow
+// objects from the mirror with git alternates so acquiring them is a cheap
+// local operation.
+type mirrorStore struct {
+	dir     string
+	mutex   sync.Mutex
+	locks   map[string]*sync.Mutex // one per remote URI
+	fetched map[string]bool
+}
+
+var gitMirrors *mirrorStore
+
+// Limits the number of concurrent fetches from remotes. Nil means unlimited.
+var fetchSemaphore chan struct{}
+
+// Configures git acquirers to share bare mirrors of remote repos in
+// `mirrorDir` (disabled if empty), and to run at most `maxFetches` fetches
+// from remotes concurrently (unlimited if less than 1). This should be called
+// before acquiring any sources.
+func ConfigureGit(mirrorDir string, maxFetches int) {
+	gitMirrors = nil
+	if mirrorDir != "" {
+		gitMirrors = &mirrorStore{
+			dir:     mirrorDir,
+			locks:   make(map[string]*sync.Mutex),
+			fetched: make(map[string]bool),
+		}
+	}
+
+	fetchSemaphore = nil
+	if maxFetches > 0 {
+		fetchSemaphore = make(chan struct{}, maxFetches)
+	}
+}
+
+// Runs a git fetch from a remote, waiting if the maximum number of concurrent
+// fetches are already running
+func fetchRemote(dir string, args ...string) error {
+	if fetchSemaphore != nil {
+		fetchSemaphore <- struct{}{}
+		defer func() { <-fetchSemaphore }()
+	}
+
+	_, err := runGit(dir, append([]string{"fetch"}, args...)...)
+	return errors.WithStack(err)
+}
+
+var unsafePathChars = regexp.MustCompile("[^a-zA-Z0-9._-]+")
+
+// Returns the path to the mirror for a URI. A hash is included since
+// sanitising URIs may make different URIs look the same.
+func (m *mirrorStore) path(uri string) string {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(uri)))[:8]
+	return filepath.Join(m.dir, fmt.Sprintf("%s-%s.git",
+		strings.Trim(unsafePathChars.ReplaceAllString(uri, "-"), "-"), hash))
+}
+
+// Returns the lock for a URI so each mirror is only updated by one acquirer
+// at a time
+func (m *mirrorStore) lock(uri string) *sync.Mutex {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lock, ok := m.locks[uri]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.locks[uri] = lock
+	}
+
+	return lock
+}
+
+// Creates or updates the mirror for a URI unless it's already been fetched,
+// and returns its path
+func (m *mirrorStore) sync(uri string) (string, error) {
+	lock := m.lock(uri)
+	lock.Lock()
+	defer lock.Unlock()
+
+	mirrorPath := m.path(uri)
+
+	if m.fetched[uri] {
+		return mirrorPath, nil
+	}
+
+	if _, err := os.Stat(mirrorPath); err != nil {
+		log.Debugf("Creating git mirror of %s in %s", uri, mirrorPath)
+
+		err = os.MkdirAll(mirrorPath, 0755)
+		if err != nil {
+			return "", errors.Wrapf(err, "Error creating directory %s", mirrorPath)
+		}
+
+		_, err = runGit(mirrorPath, "init", "--bare")
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		_, err = runGit(mirrorPath, "remote", "add", "--mirror=fetch", "origin", uri)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	log.Infof("Fetching %s into mirror %s", uri, mirrorPath)
+	err := fetchRemote(mirrorPath, "--prune", "--tags", "--force", "origin")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	m.fetched[uri] = true
+
+	return mirrorPath, nil
+}
@@ -17,10 +17,12 @@
 package cacher
 
 import (
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
 	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -28,6 +30,37 @@ import (
 
 const CACHE_DIR = ".sugarkube"
 
+// Directory under CACHE_DIR in the root of a cache to keep git mirrors in
+const MIRRORS_DIR = "mirrors"
+
+// Settings for verifying sources after they've been acquired
+type Verification struct {
+	// if true, all sources must be git tags signed by one of the trusted keys
+	RequireSignedTags bool
+	TrustedGpgKeys    []string
+}
+
+// Returns an error if the verification settings can't be satisfied
+func (v *Verification) validate() error {
+	if v == nil {
+		return nil
+	}
+
+	if v.RequireSignedTags && len(v.TrustedGpgKeys) == 0 {
+		return errors.New("Signed tags are required but no trusted GPG " +
+			"keys are configured")
+	}
+
+	for _, key := range v.TrustedGpgKeys {
+		_, err := acquirer.NormaliseGpgKey(key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
 // Returns the cache dir for a manifest
 func GetManifestCachePath(cacheDir string, manifest kapp.Manifest) string {
 	return filepath.Join(cacheDir, manifest.Id)
@@ -44,35 +77,70 @@ func getKappCachePath(kappRootPath string) string {
 	return filepath.Join(kappRootPath, CACHE_DIR)
 }
 
-// Build a cache for a manifest into a directory
-func CacheManifest(manifest kapp.Manifest, cacheDir string, dryRun bool) error {
+// Build a cache for a manifest into a directory. Sources are verified
+// according to `verification` which may be nil to skip verification.
+func CacheManifest(manifest kapp.Manifest, cacheDir string,
+	verification *Verification, dryRun bool) error {
+
+	err := verification.validate()
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
 	// create a directory to cache all kapps in this manifest in
 	manifestCacheDir := GetManifestCachePath(cacheDir, manifest)
 
 	log.Debugf("Creating manifest cache dir: %s", manifestCacheDir)
-	err := os.MkdirAll(manifestCacheDir, 0755)
+	err = os.MkdirAll(manifestCacheDir, 0755)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	// acquire each kapp and cache it
 	for _, kappObj := range manifest.Kapps {
-		// build a directory path for the kapp in the manifest cache directory
-		kappRootPath := GetKappRootPath(manifestCacheDir, kappObj)
-		// build a directory path for the kapp's .sugarkube cache directory
-		kappCacheDir := getKappCachePath(kappRootPath)
-
-		log.Debugf("Creating kapp cache dir: %s", kappCacheDir)
-		err := os.MkdirAll(kappCacheDir, 0755)
+		err := cacheKapp(manifest, kappObj, manifestCacheDir, verification, dryRun)
 		if err != nil {
 			return errors.WithStack(err)
 		}
+	}
 
-		err = acquireSource(manifest, kappObj.Sources, kappRootPath, kappCacheDir, dryRun)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	return nil
+}
+
+// Acquires a kapp's sources into its directory in a manifest cache directory
+func cacheKapp(manifest kapp.Manifest, kappObj kapp.Kapp, manifestCacheDir string,
+	verification *Verification, dryRun bool) error {
+	// build a directory path for the kapp in the manifest cache directory
+	kappRootPath := GetKappRootPath(manifestCacheDir, kappObj)
+	// build a directory path for the kapp's .sugarkube cache directory
+	kappCacheDir := getKappCachePath(kappRootPath)
+
+	log.Debugf("Creating kapp cache dir: %s", kappCacheDir)
+	err := os.MkdirAll(kappCacheDir, 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = acquireSource(manifest, kappObj, kappRootPath, kappCacheDir, verification, dryRun)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	// fail early if the kapp's descriptor is invalid instead of when it's
+	// installed
+	descriptor, err := kapp.LoadDescriptor(kappRootPath)
+	if err != nil {
+		return errors.Wrapf(err, "Error loading descriptor of kapp '%s' in "+
+			"manifest '%s'", kappObj.Id, manifest.Id)
+	}
+
+	if descriptor != nil {
+		log.Debugf("Kapp '%s' in manifest '%s' has descriptor: %#v", kappObj.Id,
+			manifest.Id, descriptor)
 	}
 
 	return nil
@@ -80,10 +148,13 @@ func CacheManifest(manifest kapp.Manifest, cacheDir string, dryRun bool) error {
 
 // Acquires each source and symlinks it to the target path in the cache directory.
 // Runs all acquirers in parallel.
-func acquireSource(manifest kapp.Manifest, acquirers []acquirer.Acquirer, rootDir string,
-	cacheDir string, dryRun bool) error {
-	doneCh := make(chan bool)
-	errCh := make(chan error)
+func acquireSource(manifest kapp.Manifest, kappObj kapp.Kapp, rootDir string,
+	cacheDir string, verification *Verification, dryRun bool) error {
+	acquirers := kappObj.Sources
+
+	// buffer the channels so goroutines can finish even if we return early
+	doneCh := make(chan bool, len(acquirers))
+	errCh := make(chan error, len(acquirers))
 
 	log.Debugf("Acquiring sources for manifest: %s", manifest.Id)
 
@@ -92,6 +163,7 @@ func acquireSource(manifest kapp.Manifest, acquirers []acquirer.Acquirer, rootDi
 			acquirerId, err := a.Id()
 			if err != nil {
 				errCh <- errors.Wrap(err, "Invalid acquirer ID")
+				return
 			}
 
 			sourceDest := filepath.Join(cacheDir, acquirerId)
@@ -102,6 +174,16 @@ func acquireSource(manifest kapp.Manifest, acquirers []acquirer.Acquirer, rootDi
 				err := acquirer.Acquire(a, sourceDest)
 				if err != nil {
 					errCh <- errors.WithStack(err)
+					return
+				}
+
+				if verification != nil && verification.RequireSignedTags {
+					err = acquirer.Verify(a, sourceDest, verification.TrustedGpgKeys)
+					if err != nil {
+						errCh <- errors.Wrapf(err, "Source '%s' of kapp '%s' "+
+							"failed verification", acquirerId, kappObj.Id)
+						return
+					}
 				}
 			}
 
@@ -118,12 +200,31 @@ func acquireSource(manifest kapp.Manifest, acquirers []acquirer.Acquirer, rootDi
 			} else {
 				if _, err := os.Stat(filepath.Join(rootDir, sourcePath)); err != nil {
 					errCh <- errors.Wrapf(err, "Symlink source '%s' doesn't exist", sourcePath)
+					return
+				}
+
+				// replace symlinks left by previous runs in case the source's
+				// path has changed
+				if info, err := os.Lstat(symLinkTarget); err == nil {
+					if info.Mode()&os.ModeSymlink == 0 {
+						errCh <- errors.New(fmt.Sprintf("Can't symlink source "+
+							"to '%s'. Path already exists and isn't a symlink",
+							symLinkTarget))
+						return
+					}
+
+					err = os.Remove(symLinkTarget)
+					if err != nil {
+						errCh <- errors.Wrapf(err, "Error removing old symlink")
+						return
+					}
 				}
 
 				log.Debugf("Symlinking cached source %s to %s", sourcePath, symLinkTarget)
 				err := os.Symlink(sourcePath, symLinkTarget)
 				if err != nil {
 					errCh <- errors.Wrapf(err, "Error symlinking source")
+					return
 				}
 			}
 
@@ -134,7 +235,6 @@ func acquireSource(manifest kapp.Manifest, acquirers []acquirer.Acquirer, rootDi
 	for success := 0; success < len(acquirers); success++ {
 		select {
 		case err := <-errCh:
-			close(doneCh)
 			log.Warnf("Error in acquirer goroutines: %s", err)
 			return errors.Wrapf(err, "Error running acquirer in goroutine "+
 				"for manifest '%s'", manifest.Id)
@@ -149,7 +249,244 @@ func acquireSource(manifest kapp.Manifest, acquirers []acquirer.Acquirer, rootDi
 	return nil
 }
 
-// Diffs a set of manifests against a cache directory and reports any differences
-//func DiffCache(manifests []kapp.Manifest, cacheDir string) (???, error) {
-// todo - implement
-//}
+// Differences between a source in the cache and how it's defined in a kapp
+type SourceDiff struct {
+	Id      string                `yaml:"id"`
+	Missing bool                  `yaml:"missing,omitempty"` // in the kapp but not the cache
+	Extra   bool                  `yaml:"extra,omitempty"`   // in the cache but not the kapp
+	State   *acquirer.SourceState `yaml:"state,omitempty"`
+}
+
+// Differences between a kapp in the cache and how it's defined in a manifest
+type KappDiff struct {
+	ManifestId string       `yaml:"manifest"`
+	KappId     string       `yaml:"kapp"`
+	Missing    bool         `yaml:"missing,omitempty"` // in the manifest but not the cache
+	Extra      bool         `yaml:"extra,omitempty"`   // in the cache but not the manifest
+	Sources    []SourceDiff `yaml:"sources,omitempty"`
+}
+
+// Differences between a cache directory and a set of manifests
+type CacheDiff struct {
+	Kapps []KappDiff `yaml:"kapps"`
+}
+
+// Returns true if the cache matches the manifests
+func (d CacheDiff) IsEmpty() bool {
+	return len(d.Kapps) == 0
+}
+
+// Diffs a set of manifests against a cache directory and reports any
+// differences, e.g. missing or extra kapps, sources checked out at different
+// versions or containing locally modified files.
+func DiffCache(manifests []kapp.Manifest, cacheDir string) (*CacheDiff, error) {
+	kappDiffs := make([]KappDiff, 0)
+	manifestIds := make(map[string]bool)
+
+	for _, manifest := range manifests {
+		manifestIds[manifest.Id] = true
+		manifestCacheDir := GetManifestCachePath(cacheDir, manifest)
+		kappIds := make(map[string]bool)
+
+		for _, kappObj := range manifest.Kapps {
+			kappIds[kappObj.Id] = true
+
+			kappDiff, err := diffKapp(manifest, kappObj, manifestCacheDir)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			if kappDiff != nil {
+				kappDiffs = append(kappDiffs, *kappDiff)
+			}
+		}
+
+		extraKapps, err := listDirs(manifestCacheDir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		for _, kappId := range extraKapps {
+			if !kappIds[kappId] {
+				kappDiffs = append(kappDiffs, KappDiff{
+					ManifestId: manifest.Id,
+					KappId:     kappId,
+					Extra:      true,
+				})
+			}
+		}
+	}
+
+	// report kapps cached for manifests that no longer exist
+	cachedManifests, err := listDirs(cacheDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, manifestId := range cachedManifests {
+		if manifestIds[manifestId] {
+			continue
+		}
+
+		extraKapps, err := listDirs(filepath.Join(cacheDir, manifestId))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		for _, kappId := range extraKapps {
+			kappDiffs = append(kappDiffs, KappDiff{
+				ManifestId: manifestId,
+				KappId:     kappId,
+				Extra:      true,
+			})
+		}
+	}
+
+	return &CacheDiff{Kapps: kappDiffs}, nil
+}
+
+// Diffs a kapp against its directory in a manifest's cache directory. Returns
+// nil if there are no differences.
+func diffKapp(manifest kapp.Manifest, kappObj kapp.Kapp, manifestCacheDir string) (*KappDiff, error) {
+	kappRootPath := GetKappRootPath(manifestCacheDir, kappObj)
+
+	if _, err := os.Stat(kappRootPath); err != nil {
+		if os.IsNotExist(err) {
+			return &KappDiff{
+				ManifestId: manifest.Id,
+				KappId:     kappObj.Id,
+				Missing:    true,
+			}, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	kappCacheDir := getKappCachePath(kappRootPath)
+	sourceDiffs := make([]SourceDiff, 0)
+	sourceIds := make(map[string]bool)
+
+	for _, acquirerImpl := range kappObj.Sources {
+		sourceId, err := acquirerImpl.Id()
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid acquirer ID")
+		}
+		sourceIds[sourceId] = true
+
+		sourceDest := filepath.Join(kappCacheDir, sourceId)
+		symLinkTarget := filepath.Join(kappRootPath, acquirerImpl.Name())
+
+		// the source must have been acquired and symlinked into the kapp
+		missing := false
+		for _, path := range []string{sourceDest, symLinkTarget} {
+			if _, err := os.Stat(path); err != nil {
+				if !os.IsNotExist(err) {
+					return nil, errors.WithStack(err)
+				}
+				missing = true
+			}
+		}
+
+		if missing {
+			sourceDiffs = append(sourceDiffs, SourceDiff{
+				Id:      sourceId,
+				Missing: true,
+			})
+			continue
+		}
+
+		state, err := acquirer.Inspect(acquirerImpl, sourceDest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error inspecting source '%s' of "+
+				"kapp '%s' in manifest '%s'", sourceId, kappObj.Id, manifest.Id)
+		}
+
+		if state.OutOfDate() || len(state.Modified) > 0 {
+			log.Debugf("Source '%s' of kapp '%s' in manifest '%s' differs from "+
+				"the cache: %#v", sourceId, kappObj.Id, manifest.Id, state)
+			sourceDiffs = append(sourceDiffs, SourceDiff{
+				Id:    sourceId,
+				State: state,
+			})
+		}
+	}
+
+	extraSources, err := listDirs(kappCacheDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, sourceId := range extraSources {
+		if !sourceIds[sourceId] {
+			sourceDiffs = append(sourceDiffs, SourceDiff{
+				Id:    sourceId,
+				Extra: true,
+			})
+		}
+	}
+
+	if len(sourceDiffs) == 0 {
+		return nil, nil
+	}
+
+	return &KappDiff{
+		ManifestId: manifest.Id,
+		KappId:     kappObj.Id,
+		Sources:    sourceDiffs,
+	}, nil
+}
+
+// Returns the versions of a kapp's sources in a manifest's cache directory
+// keyed by source ID, e.g. the commit checked out for git sources. Sources that
+// haven't been acquired are omitted.
+func SourceVersions(manifestCacheDir string, kappObj kapp.Kapp) (map[string]string, error) {
+	kappCacheDir := getKappCachePath(GetKappRootPath(manifestCacheDir, kappObj))
+	versions := make(map[string]string)
+
+	for _, acquirerImpl := range kappObj.Sources {
+		sourceId, err := acquirerImpl.Id()
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid acquirer ID")
+		}
+
+		sourceDest := filepath.Join(kappCacheDir, sourceId)
+		if _, err := os.Stat(sourceDest); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		state, err := acquirer.Inspect(acquirerImpl, sourceDest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error inspecting source '%s' of "+
+				"kapp '%s'", sourceId, kappObj.Id)
+		}
+
+		versions[sourceId] = state.Actual
+	}
+
+	return versions, nil
+}
+
+// Returns the names of non-hidden directories in a directory. Hidden
+// directories (e.g. the cache's own `.sugarkube` directory) are ignored. If the
+// directory doesn't exist an empty list is returned.
+func listDirs(dir string) ([]string, error) {
+	dirs := make([]string, 0)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dirs, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			dirs = append(dirs, file.Name())
+		}
+	}
+
+	return dirs, nil
+}
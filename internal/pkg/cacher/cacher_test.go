@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cacher
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffCache(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cache-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	source := acquirer.NewGitAcquirer("", "git@github.com:sugarkube/kapps.git",
+		"master", "incubator/tiller")
+	sourceId, err := source.Id()
+	assert.Nil(t, err)
+
+	manifests := []kapp.Manifest{
+		{
+			Id: "manifest1",
+			Kapps: []kapp.Kapp{
+				{Id: "kappA", Sources: []acquirer.Acquirer{source}},
+				{Id: "kappB", Sources: []acquirer.Acquirer{source}},
+			},
+		},
+	}
+
+	for _, dir := range []string{
+		// kappA's source hasn't been acquired, and it has an extra source
+		"manifest1/kappA/.sugarkube/old-source",
+		// kapps that aren't in the manifests
+		"manifest1/kappC",
+		"manifest2/kappD",
+		// hidden directories should be ignored
+		".sugarkube/logs",
+	} {
+		err = os.MkdirAll(filepath.Join(tempDir, dir), 0755)
+		assert.Nil(t, err)
+	}
+
+	expected := &CacheDiff{
+		Kapps: []KappDiff{
+			{
+				ManifestId: "manifest1",
+				KappId:     "kappA",
+				Sources: []SourceDiff{
+					{Id: sourceId, Missing: true},
+					{Id: "old-source", Extra: true},
+				},
+			},
+			{ManifestId: "manifest1", KappId: "kappB", Missing: true},
+			{ManifestId: "manifest1", KappId: "kappC", Extra: true},
+			{ManifestId: "manifest2", KappId: "kappD", Extra: true},
+		},
+	}
+
+	actual, err := DiffCache(manifests, tempDir)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+	assert.False(t, actual.IsEmpty())
+}
+
+func TestDiffCacheEmpty(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cache-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	actual, err := DiffCache([]kapp.Manifest{}, tempDir)
+	assert.Nil(t, err)
+	assert.True(t, actual.IsEmpty())
+}
+
+func TestRefreshCachePrunes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cache-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	manifests := []kapp.Manifest{
+		{
+			Id: "manifest1",
+			Kapps: []kapp.Kapp{
+				{Id: "kappA"},
+			},
+		},
+	}
+
+	for _, dir := range []string{
+		"manifest1/kappA/.sugarkube/old-source/path",
+		"manifest1/kappC/.sugarkube",
+		"manifest2/kappD/.sugarkube",
+		".sugarkube/logs",
+	} {
+		err = os.MkdirAll(filepath.Join(tempDir, dir), 0755)
+		assert.Nil(t, err)
+	}
+
+	symLink := filepath.Join(tempDir, "manifest1/kappA/old")
+	err = os.Symlink(".sugarkube/old-source/path", symLink)
+	assert.Nil(t, err)
+
+	err = RefreshCache(manifests, tempDir, EDITED_ABORT, nil, false)
+	assert.Nil(t, err)
+
+	for _, path := range []string{
+		"manifest1/kappA/.sugarkube",
+		".sugarkube/logs",
+	} {
+		_, err = os.Stat(filepath.Join(tempDir, path))
+		assert.Nil(t, err, "%s should exist", path)
+	}
+
+	for _, path := range []string{
+		"manifest1/kappA/old",
+		"manifest1/kappA/.sugarkube/old-source",
+		"manifest1/kappC",
+		"manifest2",
+	} {
+		_, err = os.Lstat(filepath.Join(tempDir, path))
+		assert.True(t, os.IsNotExist(err), "%s should have been pruned", path)
+	}
+
+	actual, err := DiffCache(manifests, tempDir)
+	assert.Nil(t, err)
+	assert.True(t, actual.IsEmpty())
+}
+
+func TestRefreshCacheInvalidPolicy(t *testing.T) {
+	err := RefreshCache([]kapp.Manifest{}, "/nonexistent", "nonsense", nil, false)
+	assert.NotNil(t, err)
+}
+
+func TestCacheManifestVerification(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cache-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "src")
+	err = os.MkdirAll(filepath.Join(sourceDir, "kapp"), 0755)
+	assert.Nil(t, err)
+
+	source, err := acquirer.NewFileAcquirer("", sourceDir, "kapp", false, "")
+	assert.Nil(t, err)
+
+	manifest := kapp.Manifest{
+		Id: "manifest1",
+		Kapps: []kapp.Kapp{
+			{Id: "kappA", Sources: []acquirer.Acquirer{source}},
+		},
+	}
+
+	cacheDir := filepath.Join(tempDir, "cache")
+
+	// local sources can't be signed
+	err = CacheManifest(manifest, cacheDir, &Verification{
+		RequireSignedTags: true,
+		TrustedGpgKeys:    []string{"89ABCDEF01234567"},
+	}, false)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "kappA")
+
+	err = CacheManifest(manifest, cacheDir, &Verification{
+		RequireSignedTags: true,
+		TrustedGpgKeys:    []string{"01234567"},
+	}, false)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Invalid trusted GPG key",
+		"short key IDs should be rejected")
+
+	err = CacheManifest(manifest, cacheDir, &Verification{
+		RequireSignedTags: true,
+	}, false)
+	assert.NotNil(t, err, "trusted keys should be required")
+
+	err = CacheManifest(manifest, cacheDir, nil, false)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cacher
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Policies for dealing with kapps that have been edited in the cache
+const EDITED_ABORT = "abort"         // return an error without changing the cache
+const EDITED_SKIP = "skip"           // don't refresh edited kapps
+const EDITED_OVERWRITE = "overwrite" // discard local changes
+const EDITED_STASH = "stash"         // stash local changes (if the acquirer supports it)
+
+var editedPolicies = []string{EDITED_ABORT, EDITED_SKIP, EDITED_OVERWRITE, EDITED_STASH}
+
+// Updates an existing cache in place so it matches the manifests. Sources are
+// updated to the versions in the manifests, new kapps are acquired and kapps
+// that have been removed from the manifests are pruned. Kapps containing
+// locally modified files are dealt with according to `editedPolicy`. Sources
+// are verified according to `verification` which may be nil.
+func RefreshCache(manifests []kapp.Manifest, cacheDir string, editedPolicy string,
+	verification *Verification, dryRun bool) error {
+
+	err := verification.validate()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !isValidEditedPolicy(editedPolicy) {
+		return errors.New(fmt.Sprintf("Invalid policy for edited kapps '%s'. "+
+			"Valid values are: %s", editedPolicy, strings.Join(editedPolicies, ", ")))
+	}
+
+	cacheDiff, err := DiffCache(manifests, cacheDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// check for edited kapps before touching the cache in case we need to abort
+	edited := make([]string, 0)
+	for _, kappDiff := range cacheDiff.Kapps {
+		for _, sourceDiff := range kappDiff.Sources {
+			if sourceDiff.State != nil && len(sourceDiff.State.Modified) > 0 {
+				edited = append(edited, fmt.Sprintf("%s/%s (source '%s': %s)",
+					kappDiff.ManifestId, kappDiff.KappId, sourceDiff.Id,
+					strings.Join(sourceDiff.State.Modified, ", ")))
+			}
+		}
+	}
+
+	if len(edited) > 0 && editedPolicy == EDITED_ABORT {
+		return errors.New(fmt.Sprintf("Aborting refresh because the following "+
+			"kapps have been edited in the cache: %s", strings.Join(edited, "; ")))
+	}
+
+	skipped := make(map[string]bool)
+
+	for _, kappDiff := range cacheDiff.Kapps {
+		kappRootPath := filepath.Join(cacheDir, kappDiff.ManifestId, kappDiff.KappId)
+
+		if kappDiff.Extra {
+			err = prune(kappRootPath, dryRun)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+
+		for _, sourceDiff := range kappDiff.Sources {
+			if sourceDiff.Extra {
+				err = pruneSource(kappRootPath, sourceDiff.Id, dryRun)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				continue
+			}
+
+			if sourceDiff.State == nil || len(sourceDiff.State.Modified) == 0 {
+				continue
+			}
+
+			if editedPolicy == EDITED_SKIP {
+				log.Infof("Skipping edited kapp '%s' in manifest '%s'",
+					kappDiff.KappId, kappDiff.ManifestId)
+				skipped[kappDiff.ManifestId+"/"+kappDiff.KappId] = true
+				continue
+			}
+
+			acquirerImpl, err := findSource(manifests, kappDiff, sourceDiff.Id)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			sourceDest := filepath.Join(getKappCachePath(kappRootPath), sourceDiff.Id)
+
+			if dryRun {
+				log.Infof("Dry run: Would %s local changes in %s", editedPolicy,
+					sourceDest)
+				continue
+			}
+
+			err = acquirer.Reset(acquirerImpl, sourceDest, editedPolicy == EDITED_STASH)
+			if err != nil {
+				return errors.Wrapf(err, "Error resetting source '%s' of kapp "+
+					"'%s' in manifest '%s'", sourceDiff.Id, kappDiff.KappId,
+					kappDiff.ManifestId)
+			}
+		}
+	}
+
+	err = pruneManifestDirs(manifests, cacheDir, dryRun)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, manifest := range manifests {
+		manifestCacheDir := GetManifestCachePath(cacheDir, manifest)
+
+		for _, kappObj := range manifest.Kapps {
+			if skipped[manifest.Id+"/"+kappObj.Id] {
+				continue
+			}
+
+			err = cacheKapp(manifest, kappObj, manifestCacheDir, verification, dryRun)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns whether the policy for edited kapps is valid
+func isValidEditedPolicy(policy string) bool {
+	for _, validPolicy := range editedPolicies {
+		if policy == validPolicy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the acquirer for a source of a kapp in a manifest
+func findSource(manifests []kapp.Manifest, kappDiff KappDiff,
+	sourceId string) (acquirer.Acquirer, error) {
+	for _, manifest := range manifests {
+		if manifest.Id != kappDiff.ManifestId {
+			continue
+		}
+
+		for _, kappObj := range manifest.Kapps {
+			if kappObj.Id != kappDiff.KappId {
+				continue
+			}
+
+			for _, acquirerImpl := range kappObj.Sources {
+				id, err := acquirerImpl.Id()
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+
+				if id == sourceId {
+					return acquirerImpl, nil
+				}
+			}
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("No source '%s' for kapp '%s' in "+
+		"manifest '%s'", sourceId, kappDiff.KappId, kappDiff.ManifestId))
+}
+
+// Deletes a path from the cache
+func prune(path string, dryRun bool) error {
+	if dryRun {
+		log.Infof("Dry run: Would prune %s from the cache", path)
+		return nil
+	}
+
+	log.Infof("Pruning %s from the cache", path)
+	err := os.RemoveAll(path)
+	if err != nil {
+		return errors.Wrapf(err, "Error pruning %s", path)
+	}
+
+	return nil
+}
+
+// Deletes a source from a kapp's cache directory along with any symlinks
+// pointing into it
+func pruneSource(kappRootPath string, sourceId string, dryRun bool) error {
+	files, err := ioutil.ReadDir(kappRootPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sourcePath := filepath.Join(CACHE_DIR, sourceId)
+
+	for _, file := range files {
+		if file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		symLink := filepath.Join(kappRootPath, file.Name())
+		target, err := os.Readlink(symLink)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if target == sourcePath || strings.HasPrefix(target, sourcePath+"/") {
+			err = prune(symLink, dryRun)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return prune(filepath.Join(getKappCachePath(kappRootPath), sourceId), dryRun)
+}
+
+// Deletes directories for manifests that no longer exist once all their kapps
+// have been pruned
+func pruneManifestDirs(manifests []kapp.Manifest, cacheDir string, dryRun bool) error {
+	manifestIds := make(map[string]bool)
+	for _, manifest := range manifests {
+		manifestIds[manifest.Id] = true
+	}
+
+	cachedManifests, err := listDirs(cacheDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, manifestId := range cachedManifests {
+		if manifestIds[manifestId] {
+			continue
+		}
+
+		manifestCacheDir := filepath.Join(cacheDir, manifestId)
+		kappIds, err := listDirs(manifestCacheDir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// in a dry run kapps won't actually have been pruned
+		if len(kappIds) == 0 || dryRun {
+			err = prune(manifestCacheDir, dryRun)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return nil
+}
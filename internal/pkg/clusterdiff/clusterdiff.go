@@ -0,0 +1,206 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clusterdiff
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/kappsot"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"time"
+)
+
+// Version of the cluster diff format. Increment this whenever a change is made
+// that means older diffs can't be loaded.
+const FORMAT_VERSION = 1
+
+// Actions that need to be taken on a kapp to make the target cluster match
+// the manifests
+const ACTION_INSTALL = "install"
+const ACTION_DESTROY = "destroy"
+const ACTION_IGNORE = "ignore"
+
+// A kapp in a manifest along with the action that needs taking on it
+type KappDiff struct {
+	Id      string   `yaml:"id" json:"id"`
+	Action  string   `yaml:"action" json:"action"`
+	Version string   `yaml:"version,omitempty" json:"version,omitempty"`
+	Sources []string `yaml:"sources" json:"sources"` // IDs of the kapp's acquirers
+	// the kapp's `sugarkube.yaml` file. Only included in extended diffs.
+	Descriptor *kapp.Descriptor `yaml:"descriptor,omitempty" json:"descriptor,omitempty"`
+}
+
+// The kapps in a manifest that need installing, destroying or ignoring
+type ManifestDiff struct {
+	Id    string     `yaml:"id" json:"id"`
+	Kapps []KappDiff `yaml:"kapps" json:"kapps"`
+}
+
+// Identifies the stack a diff was generated for
+type StackIdentity struct {
+	Name        string `yaml:"name" json:"name"`
+	Provider    string `yaml:"provider" json:"provider"`
+	Provisioner string `yaml:"provisioner" json:"provisioner"`
+	Account     string `yaml:"account,omitempty" json:"account,omitempty"`
+	Region      string `yaml:"region,omitempty" json:"region,omitempty"`
+	Profile     string `yaml:"profile" json:"profile"`
+	Cluster     string `yaml:"cluster" json:"cluster"`
+}
+
+// The differences between the kapps that are actually installed in a cluster
+// and the kapps that should be present/absent according to the manifests.
+type ClusterDiff struct {
+	FormatVersion int            `yaml:"version" json:"version"`
+	Generated     time.Time      `yaml:"generated" json:"generated"`
+	Stack         StackIdentity  `yaml:"stack" json:"stack"`
+	Manifests     []ManifestDiff `yaml:"manifests" json:"manifests"`
+}
+
+// Returns the fields that identify a stack
+func identifyStack(stackConfig *kapp.StackConfig) StackIdentity {
+	return StackIdentity{
+		Name:        stackConfig.Name,
+		Provider:    stackConfig.Provider,
+		Provisioner: stackConfig.Provisioner,
+		Account:     stackConfig.Account,
+		Region:      stackConfig.Region,
+		Profile:     stackConfig.Profile,
+		Cluster:     stackConfig.Cluster,
+	}
+}
+
+// Returns the action to take on a kapp given whether it should be present in
+// the cluster and whether it's already installed
+func actionFor(shouldBePresent bool, installed bool) string {
+	if shouldBePresent && !installed {
+		return ACTION_INSTALL
+	}
+
+	if !shouldBePresent && installed {
+		return ACTION_DESTROY
+	}
+
+	return ACTION_IGNORE
+}
+
+// Consults a KappSot to find out which of the kapps in the stack's manifests
+// are already installed and returns a diff of the kapps that need installing,
+// destroying or can be ignored.
+func Create(stackConfig *kapp.StackConfig, kappSot kappsot.KappSot) (*ClusterDiff, error) {
+	manifestDiffs := make([]ManifestDiff, 0)
+
+	for _, manifest := range stackConfig.Manifests {
+		kappDiffs := make([]KappDiff, 0)
+
+		for _, kappObj := range manifest.Kapps {
+			installed, err := kappsot.IsInstalled(kappSot, kappObj.Id, kappObj.Version)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error checking whether kapp '%s' "+
+					"in manifest '%s' is installed", kappObj.Id, manifest.Id)
+			}
+
+			sourceIds, err := getSourceIds(kappObj)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			action := actionFor(kappObj.ShouldBePresent, installed)
+
+			log.Debugf("Action for kapp '%s' in manifest '%s': %s", kappObj.Id,
+				manifest.Id, action)
+
+			kappDiffs = append(kappDiffs, KappDiff{
+				Id:      kappObj.Id,
+				Action:  action,
+				Version: kappObj.Version,
+				Sources: sourceIds,
+			})
+		}
+
+		manifestDiffs = append(manifestDiffs, ManifestDiff{
+			Id:    manifest.Id,
+			Kapps: kappDiffs,
+		})
+	}
+
+	return &ClusterDiff{
+		FormatVersion: FORMAT_VERSION,
+		Generated:     time.Now().UTC(),
+		Stack:         identifyStack(stackConfig),
+		Manifests:     manifestDiffs,
+	}, nil
+}
+
+// Returns the diff for a kapp in a manifest, or nil if the diff doesn't
+// contain it
+func (d *ClusterDiff) KappDiff(manifestId string, kappId string) *KappDiff {
+	for _, manifestDiff := range d.Manifests {
+		if manifestDiff.Id != manifestId {
+			continue
+		}
+
+		for i, kappDiff := range manifestDiff.Kapps {
+			if kappDiff.Id == kappId {
+				return &manifestDiff.Kapps[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Adds the descriptor of each kapp in a cache dir to the diff, so e.g. CI/CD
+// systems know in advance which secrets kapps need. Kapps that haven't been
+// cached or don't have a descriptor are left as they are.
+func (d *ClusterDiff) AddDescriptors(cacheDir string) error {
+	for i, manifestDiff := range d.Manifests {
+		manifestCacheDir := cacher.GetManifestCachePath(cacheDir,
+			kapp.Manifest{Id: manifestDiff.Id})
+
+		for j, kappDiff := range manifestDiff.Kapps {
+			kappRootDir := cacher.GetKappRootPath(manifestCacheDir,
+				kapp.Kapp{Id: kappDiff.Id})
+
+			descriptor, err := kapp.LoadDescriptor(kappRootDir)
+			if err != nil {
+				return errors.Wrapf(err, "Error loading descriptor of kapp "+
+					"'%s' in manifest '%s'", kappDiff.Id, manifestDiff.Id)
+			}
+
+			d.Manifests[i].Kapps[j].Descriptor = descriptor
+		}
+	}
+
+	return nil
+}
+
+// Returns the IDs of each of a kapp's sources
+func getSourceIds(kappObj kapp.Kapp) ([]string, error) {
+	sourceIds := make([]string, 0)
+
+	for _, acquirerImpl := range kappObj.Sources {
+		sourceId, err := acquirerImpl.Id()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		sourceIds = append(sourceIds, sourceId)
+	}
+
+	return sourceIds, nil
+}
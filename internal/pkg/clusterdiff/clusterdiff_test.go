@@ -0,0 +1,122 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clusterdiff
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestActionFor(t *testing.T) {
+	tests := []struct {
+		name            string
+		desc            string
+		shouldBePresent bool
+		installed       bool
+		expected        string
+	}{
+		{
+			name:            "install",
+			desc:            "missing kapps that should be present should be installed",
+			shouldBePresent: true,
+			installed:       false,
+			expected:        ACTION_INSTALL,
+		},
+		{
+			name:            "ignore_installed",
+			desc:            "installed kapps that should be present should be ignored",
+			shouldBePresent: true,
+			installed:       true,
+			expected:        ACTION_IGNORE,
+		},
+		{
+			name:            "destroy",
+			desc:            "installed kapps that should be absent should be destroyed",
+			shouldBePresent: false,
+			installed:       true,
+			expected:        ACTION_DESTROY,
+		},
+		{
+			name:            "ignore_absent",
+			desc:            "missing kapps that should be absent should be ignored",
+			shouldBePresent: false,
+			installed:       false,
+			expected:        ACTION_IGNORE,
+		},
+	}
+
+	for _, test := range tests {
+		actual := actionFor(test.shouldBePresent, test.installed)
+		assert.Equal(t, test.expected, actual, "unexpected action for %s", test.name)
+	}
+}
+
+func TestKappDiff(t *testing.T) {
+	diff := ClusterDiff{
+		Manifests: []ManifestDiff{
+			{
+				Id: "manifest1",
+				Kapps: []KappDiff{
+					{Id: "kappA", Action: ACTION_INSTALL},
+					{Id: "kappB", Action: ACTION_IGNORE},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, &KappDiff{Id: "kappB", Action: ACTION_IGNORE},
+		diff.KappDiff("manifest1", "kappB"))
+	assert.Nil(t, diff.KappDiff("manifest1", "kappC"))
+	assert.Nil(t, diff.KappDiff("manifest2", "kappA"))
+}
+
+func TestAddDescriptors(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "clusterdiff-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	kappDir := filepath.Join(cacheDir, "manifest1", "kappA")
+	err = os.MkdirAll(kappDir, 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(kappDir, kapp.DESCRIPTOR_FILE),
+		[]byte("secrets:\n- name: DB_PASSWORD\n"), 0644)
+	assert.Nil(t, err)
+
+	diff := ClusterDiff{
+		Manifests: []ManifestDiff{
+			{
+				Id: "manifest1",
+				Kapps: []KappDiff{
+					{Id: "kappA", Action: ACTION_INSTALL},
+					{Id: "kappB", Action: ACTION_IGNORE},
+				},
+			},
+		},
+	}
+
+	err = diff.AddDescriptors(cacheDir)
+	assert.Nil(t, err)
+
+	assert.Equal(t, &kapp.Descriptor{Secrets: []kapp.EnvVar{{Name: "DB_PASSWORD"}}},
+		diff.KappDiff("manifest1", "kappA").Descriptor)
+	// kapps without descriptors aren't an error
+	assert.Nil(t, diff.KappDiff("manifest1", "kappB").Descriptor)
+}
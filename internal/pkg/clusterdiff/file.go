@@ -0,0 +1,229 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clusterdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Formats diffs can be serialised to
+const FORMAT_YAML = "yaml"
+const FORMAT_JSON = "json"
+
+// Returns the format to serialise a diff to based on a file's extension.
+// Defaults to YAML.
+func formatForPath(path string) string {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return FORMAT_JSON
+	}
+
+	return FORMAT_YAML
+}
+
+// Serialises a cluster diff to the given format
+func Marshal(diff *ClusterDiff, format string) ([]byte, error) {
+	if format == FORMAT_JSON {
+		diffBytes, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return nil, errors.Wrap(err, "Error marshalling cluster diff to JSON")
+		}
+
+		return diffBytes, nil
+	}
+
+	diffBytes, err := yaml.Marshal(diff)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error marshalling cluster diff to YAML")
+	}
+
+	return diffBytes, nil
+}
+
+// Deserialises a cluster diff in the given format. Unknown fields are rejected.
+func Unmarshal(data []byte, format string) (*ClusterDiff, error) {
+	diff := ClusterDiff{}
+
+	if format == FORMAT_JSON {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&diff)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error unmarshalling cluster diff JSON")
+		}
+	} else {
+		err := yaml.UnmarshalStrict(data, &diff)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error unmarshalling cluster diff YAML")
+		}
+	}
+
+	if diff.FormatVersion != FORMAT_VERSION {
+		return nil, errors.New(fmt.Sprintf("Unsupported cluster diff version %d. "+
+			"Expected version %d", diff.FormatVersion, FORMAT_VERSION))
+	}
+
+	return &diff, nil
+}
+
+// Writes a cluster diff to a file. It'll be serialised as JSON if the file
+// has a '.json' extension, otherwise as YAML.
+func Save(diff *ClusterDiff, path string) error {
+	diffBytes, err := Marshal(diff, formatForPath(path))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Debugf("Writing cluster diff to %s", path)
+
+	err = ioutil.WriteFile(path, diffBytes, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Error writing cluster diff to %s", path)
+	}
+
+	return nil
+}
+
+// Loads a cluster diff previously written by `Save`
+func Load(path string) (*ClusterDiff, error) {
+	log.Debugf("Loading cluster diff from %s", path)
+
+	diffBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading cluster diff %s", path)
+	}
+
+	diff, err := Unmarshal(diffBytes, formatForPath(path))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error loading cluster diff %s", path)
+	}
+
+	return diff, nil
+}
+
+// Validates that a diff was generated for the given stack config and its
+// manifests, and that it's no older than maxAge. A maxAge of 0 means diffs
+// never expire.
+func (d *ClusterDiff) Validate(stackConfig *kapp.StackConfig, maxAge time.Duration) error {
+	if maxAge > 0 {
+		age := time.Since(d.Generated)
+		if age > maxAge {
+			return errors.New(fmt.Sprintf("The cluster diff expired. It was "+
+				"generated at %s which is more than %s ago", d.Generated, maxAge))
+		}
+	}
+
+	stackIdentity := identifyStack(stackConfig)
+	if d.Stack != stackIdentity {
+		return errors.New(fmt.Sprintf("The cluster diff was generated for a "+
+			"different stack. Diff stack: %#v, target stack: %#v", d.Stack,
+			stackIdentity))
+	}
+
+	if len(d.Manifests) != len(stackConfig.Manifests) {
+		return errors.New(fmt.Sprintf("The cluster diff contains %d manifest(s) "+
+			"but the stack contains %d", len(d.Manifests), len(stackConfig.Manifests)))
+	}
+
+	for i, manifest := range stackConfig.Manifests {
+		manifestDiff := d.Manifests[i]
+		if manifestDiff.Id != manifest.Id {
+			return errors.New(fmt.Sprintf("Manifest %d in the cluster diff is "+
+				"'%s' but is '%s' in the stack", i+1, manifestDiff.Id, manifest.Id))
+		}
+
+		if len(manifestDiff.Kapps) != len(manifest.Kapps) {
+			return errors.New(fmt.Sprintf("The cluster diff contains %d kapp(s) "+
+				"for manifest '%s' but the manifest contains %d",
+				len(manifestDiff.Kapps), manifest.Id, len(manifest.Kapps)))
+		}
+
+		for _, kappObj := range manifest.Kapps {
+			kappDiff := d.KappDiff(manifest.Id, kappObj.Id)
+			if kappDiff == nil {
+				return errors.New(fmt.Sprintf("Kapp '%s' in manifest '%s' isn't "+
+					"in the cluster diff", kappObj.Id, manifest.Id))
+			}
+
+			if kappDiff.Version != kappObj.Version {
+				return errors.New(fmt.Sprintf("Kapp '%s' in manifest '%s' is at "+
+					"version '%s' in the cluster diff but '%s' in the manifest",
+					kappObj.Id, manifest.Id, kappDiff.Version, kappObj.Version))
+			}
+
+			sourceIds, err := getSourceIds(kappObj)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if !reflect.DeepEqual(kappDiff.Sources, sourceIds) {
+				return errors.New(fmt.Sprintf("The sources of kapp '%s' in "+
+					"manifest '%s' differ between the cluster diff and the "+
+					"manifest. Diff sources: %s, manifest sources: %s", kappObj.Id,
+					manifest.Id, kappDiff.Sources, sourceIds))
+			}
+
+			if kappDiff.Action != ACTION_INSTALL && kappDiff.Action != ACTION_DESTROY &&
+				kappDiff.Action != ACTION_IGNORE {
+				return errors.New(fmt.Sprintf("Invalid action '%s' for kapp '%s' "+
+					"in manifest '%s'", kappDiff.Action, kappObj.Id, manifest.Id))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validates that each kapp the diff says needs installing or destroying has
+// been cached along with all its sources
+func (d *ClusterDiff) ValidateCache(stackConfig *kapp.StackConfig, cacheDir string) error {
+	for _, manifest := range stackConfig.Manifests {
+		manifestCacheDir := cacher.GetManifestCachePath(cacheDir, manifest)
+
+		for _, kappObj := range manifest.Kapps {
+			kappDiff := d.KappDiff(manifest.Id, kappObj.Id)
+			if kappDiff == nil || kappDiff.Action == ACTION_IGNORE {
+				continue
+			}
+
+			kappRootPath := cacher.GetKappRootPath(manifestCacheDir, kappObj)
+
+			for _, acquirerImpl := range kappObj.Sources {
+				sourcePath := filepath.Join(kappRootPath, acquirerImpl.Name())
+				if _, err := os.Stat(sourcePath); err != nil {
+					return errors.Wrapf(err, "Source '%s' of kapp '%s' in "+
+						"manifest '%s' isn't in the cache at '%s'",
+						acquirerImpl.Name(), kappObj.Id, manifest.Id, sourcePath)
+				}
+			}
+		}
+	}
+
+	return nil
+}
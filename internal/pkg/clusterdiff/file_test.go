@@ -0,0 +1,198 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clusterdiff
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getTestStackConfig() *kapp.StackConfig {
+	return &kapp.StackConfig{
+		Name:        "large",
+		Provider:    "local",
+		Provisioner: "minikube",
+		Profile:     "local",
+		Cluster:     "large",
+		Manifests: []kapp.Manifest{
+			{
+				Id: "manifest1",
+				Kapps: []kapp.Kapp{
+					{
+						Id:              "kappA",
+						ShouldBePresent: true,
+						Sources: []acquirer.Acquirer{
+							acquirer.NewGitAcquirer(
+								"pathA",
+								"git@github.com:sugarkube/kapps-A.git",
+								"kappA-0.1.0",
+								"some/pathA"),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func getTestDiff() *ClusterDiff {
+	return &ClusterDiff{
+		FormatVersion: FORMAT_VERSION,
+		Generated:     time.Now().UTC().Truncate(time.Second),
+		Stack: StackIdentity{
+			Name:        "large",
+			Provider:    "local",
+			Provisioner: "minikube",
+			Profile:     "local",
+			Cluster:     "large",
+		},
+		Manifests: []ManifestDiff{
+			{
+				Id: "manifest1",
+				Kapps: []KappDiff{
+					{
+						Id:      "kappA",
+						Action:  ACTION_INSTALL,
+						Sources: []string{"sugarkube-kapps-A-kappA-0.1.0-pathA"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cluster-diff-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	for _, fileName := range []string{"diff.yaml", "diff.json"} {
+		path := filepath.Join(tempDir, fileName)
+		expected := getTestDiff()
+
+		err = Save(expected, path)
+		assert.Nil(t, err)
+
+		actual, err := Load(path)
+		assert.Nil(t, err)
+		assert.True(t, expected.Generated.Equal(actual.Generated),
+			"timestamps don't match for %s", fileName)
+
+		actual.Generated = expected.Generated
+		assert.Equal(t, expected, actual, "unexpected diff loaded from %s", fileName)
+	}
+}
+
+func TestUnmarshalWrongVersion(t *testing.T) {
+	diff, err := Unmarshal([]byte("version: 999\n"), FORMAT_YAML)
+	assert.NotNil(t, err)
+	assert.Nil(t, diff)
+}
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	diff, err := Unmarshal([]byte("version: 1\nnonsense: true\n"), FORMAT_YAML)
+	assert.NotNil(t, err)
+	assert.Nil(t, diff)
+
+	diff, err = Unmarshal([]byte(`{"version": 1, "nonsense": true}`), FORMAT_JSON)
+	assert.NotNil(t, err)
+	assert.Nil(t, diff)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		desc        string
+		modify      func(diff *ClusterDiff, stackConfig *kapp.StackConfig)
+		maxAge      time.Duration
+		expectError bool
+	}{
+		{
+			name:   "good",
+			desc:   "diffs generated for a stack should be valid for it",
+			modify: func(diff *ClusterDiff, stackConfig *kapp.StackConfig) {},
+			maxAge: time.Hour,
+		},
+		{
+			name: "good_no_expiry",
+			desc: "old diffs should be valid if there's no max age",
+			modify: func(diff *ClusterDiff, stackConfig *kapp.StackConfig) {
+				diff.Generated = diff.Generated.Add(-48 * time.Hour)
+			},
+		},
+		{
+			name: "error_expired",
+			desc: "diffs older than the max age should be rejected",
+			modify: func(diff *ClusterDiff, stackConfig *kapp.StackConfig) {
+				diff.Generated = diff.Generated.Add(-2 * time.Hour)
+			},
+			maxAge:      time.Hour,
+			expectError: true,
+		},
+		{
+			name: "error_different_cluster",
+			desc: "diffs for other clusters should be rejected",
+			modify: func(diff *ClusterDiff, stackConfig *kapp.StackConfig) {
+				stackConfig.Cluster = "standard"
+			},
+			expectError: true,
+		},
+		{
+			name: "error_different_manifest",
+			desc: "diffs for different manifests should be rejected",
+			modify: func(diff *ClusterDiff, stackConfig *kapp.StackConfig) {
+				stackConfig.Manifests[0].Id = "manifest2"
+			},
+			expectError: true,
+		},
+		{
+			name: "error_different_sources",
+			desc: "diffs with different kapp sources should be rejected",
+			modify: func(diff *ClusterDiff, stackConfig *kapp.StackConfig) {
+				diff.Manifests[0].Kapps[0].Sources = []string{"other-source"}
+			},
+			expectError: true,
+		},
+		{
+			name: "error_invalid_action",
+			desc: "diffs with unknown actions should be rejected",
+			modify: func(diff *ClusterDiff, stackConfig *kapp.StackConfig) {
+				diff.Manifests[0].Kapps[0].Action = "upgrade"
+			},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		diff := getTestDiff()
+		stackConfig := getTestStackConfig()
+		test.modify(diff, stackConfig)
+
+		err := diff.Validate(stackConfig, test.maxAge)
+		if test.expectError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+		}
+	}
+}
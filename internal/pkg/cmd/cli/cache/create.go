@@ -37,6 +37,8 @@ type createCmd struct {
 	stackFile string
 	manifests cmd.Files
 	cacheDir  string
+	noMirrors bool
+	fetches   int
 }
 
 func newCreateCmd(out io.Writer) *cobra.Command {
@@ -56,7 +58,11 @@ func newCreateCmd(out io.Writer) *cobra.Command {
 	f.StringVarP(&c.stackName, "stack-name", "n", "", "name of a stack to launch (required when passing --stack-config)")
 	f.StringVarP(&c.stackFile, "stack-config", "s", "", "path to file defining stacks by name")
 	f.StringVarP(&c.cacheDir, "dir", "d", "", "Directory to build the cache in. A temp directory will be generated if not supplied.")
-	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file to load (can specify multiple)")
+	f.BoolVar(&c.noMirrors, "no-git-mirrors", false, "clone git sources directly instead of "+
+		"sharing a mirror of each repo in the cache")
+	f.IntVar(&c.fetches, "git-fetches", DEFAULT_GIT_FETCHES, "maximum number of git fetches to "+
+		"run concurrently (0 for unlimited)")
+	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file or '<git-uri>.git//<path>#<branch>' to load (can specify multiple)")
 
 	return cmd
 }
@@ -104,10 +110,20 @@ func (c *createCmd) run(cmd *cobra.Command, args []string) error {
 		cacheDir = tempDir
 	}
 
+	verification, err := sourceVerification(stackConfig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = configureGit(cacheDir, c.noMirrors, c.fetches)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
 	log.Debugf("Kapps validated. Caching manifests into %s...", cacheDir)
 
 	for _, manifest := range stackConfig.Manifests {
-		err := cacher.CacheManifest(manifest, cacheDir, c.dryRun)
+		err := cacher.CacheManifest(manifest, cacheDir, verification, c.dryRun)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -18,12 +18,24 @@ package cache
 
 import (
 	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd/cli/cluster"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"gopkg.in/yaml.v2"
 	"io"
 )
 
 type diffCmd struct {
-	out io.Writer
+	out       io.Writer
+	stackName string
+	stackFile string
+	manifests cmd.Files
+	cacheDir  string
 }
 
 func newDiffCmd(out io.Writer) *cobra.Command {
@@ -40,16 +52,72 @@ vs the desired state. This command will print out any differences such as:
   * The cache containing kapps checked out at different versions to the those specified 
     in manifests
   * Any changed/modified files in any kapps (as reported by the acquirer)
+  * Kapps in manifests that are missing from the cache, or kapps in the cache
+    that aren't in any manifests
 
 The manifests can either defined in a stack config file or as command line
 arguments.
+
+Versions are compared against the state of the sources when they were last
+acquired, so e.g. new commits pushed to a git branch won't be reported. Exits
+with an error if there are any differences.
 `,
 		RunE: c.run,
 	}
 
+	f := cmd.Flags()
+	f.StringVarP(&c.stackName, "stack-name", "n", "", "name of a stack to diff (required when passing --stack-config)")
+	f.StringVarP(&c.stackFile, "stack-config", "s", "", "path to file defining stacks by name")
+	f.StringVarP(&c.cacheDir, "dir", "d", "", "Directory containing the cache to diff")
+	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file or '<git-uri>.git//<path>#<branch>' to load (can specify multiple)")
+
 	return cmd
 }
 
 func (c *diffCmd) run(cmd *cobra.Command, args []string) error {
-	return nil
+	if c.cacheDir == "" {
+		return errors.New("The cache directory to diff must be given with --dir")
+	}
+
+	stackConfig, err := cluster.ParseStackCliArgs(c.stackName, c.stackFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	cliManifests, err := kapp.ParseManifests(c.manifests)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// CLI args override configured args, so merge them in
+	cliStackConfig := &kapp.StackConfig{
+		Manifests: cliManifests,
+	}
+
+	mergo.Merge(stackConfig, cliStackConfig, mergo.WithOverride)
+
+	log.Debugf("Final stack config: %#v", stackConfig)
+
+	cacheDiff, err := cacher.DiffCache(stackConfig.Manifests, c.cacheDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if cacheDiff.IsEmpty() {
+		log.Infof("Cache '%s' matches the manifests", c.cacheDir)
+		return nil
+	}
+
+	diffBytes, err := yaml.Marshal(cacheDiff)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = fmt.Fprint(c.out, string(diffBytes))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.New(fmt.Sprintf("Cache '%s' is out-of-sync with the "+
+		"manifests", c.cacheDir))
 }
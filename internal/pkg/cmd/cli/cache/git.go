@@ -0,0 +1,48 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"path/filepath"
+)
+
+// Default maximum number of concurrent fetches from git remotes
+const DEFAULT_GIT_FETCHES = 4
+
+// Configures git acquirers to fetch each remote repo once into a mirror in
+// the cache, unless mirrors are disabled
+func configureGit(cacheDir string, noMirrors bool, maxFetches int) error {
+	mirrorDir := ""
+	if !noMirrors {
+		// git alternates must be absolute paths
+		absCacheDir, err := filepath.Abs(cacheDir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		mirrorDir = filepath.Join(absCacheDir, cacher.CACHE_DIR, cacher.MIRRORS_DIR)
+		log.Debugf("Using git mirrors in %s", mirrorDir)
+	}
+
+	acquirer.ConfigureGit(mirrorDir, maxFetches)
+
+	return nil
+}
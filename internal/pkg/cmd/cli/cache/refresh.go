@@ -18,12 +18,27 @@ package cache
 
 import (
 	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd/cli/cluster"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"io"
 )
 
 type refreshCmd struct {
-	out io.Writer
+	out       io.Writer
+	dryRun    bool
+	stackName string
+	stackFile string
+	manifests cmd.Files
+	cacheDir  string
+	edited    string
+	noMirrors bool
+	fetches   int
 }
 
 func newRefreshCmd(out io.Writer) *cobra.Command {
@@ -34,27 +49,87 @@ func newRefreshCmd(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "refresh [flags]",
 		Short: fmt.Sprintf("Refresh kapp caches"),
-		Long: `Refresh an existing kapps cache. This could perhaps be merged into a single
-'cache'' command with a flag '--refresh' or '--update' to run in an existing
-cache directory. I'm not sure we need 2 separate commands that are so
-similar.
+		Long: `Refresh an existing kapps cache in place so it matches a manifest(s).
 
 Refreshing means:
   * Read all the kapps from the manifests
-  * Do git sparse checkouts and build the cache
-  * Add flags for dealing with edited kapps (ignore, abort, etc.) and filtering
-    kapps vs just checking them all out.
+  * Fetch and check out the versions of sources given in the manifests
+  * Acquire any kapps that have been added to the manifests
+  * Prune any kapps or sources that have been removed from the manifests
+
+Kapps containing locally edited files are dealt with according to '--edited':
+  * abort - exit with an error without changing the cache (default)
+  * skip - leave edited kapps as they are
+  * overwrite - discard local changes
+  * stash - stash local changes so they can be recovered (e.g. 'git stash pop')
 `,
 		RunE: c.run,
 	}
 
+	f := cmd.Flags()
+	f.BoolVar(&c.dryRun, "dry-run", false, "show what would happen but don't change the cache")
+	f.StringVarP(&c.stackName, "stack-name", "n", "", "name of a stack to refresh (required when passing --stack-config)")
+	f.StringVarP(&c.stackFile, "stack-config", "s", "", "path to file defining stacks by name")
+	f.StringVarP(&c.cacheDir, "dir", "d", "", "Directory containing the cache to refresh")
+	f.StringVar(&c.edited, "edited", cacher.EDITED_ABORT, "what to do with locally edited kapps. "+
+		"One of abort, skip, overwrite or stash")
+	f.BoolVar(&c.noMirrors, "no-git-mirrors", false, "clone git sources directly instead of "+
+		"sharing a mirror of each repo in the cache")
+	f.IntVar(&c.fetches, "git-fetches", DEFAULT_GIT_FETCHES, "maximum number of git fetches to "+
+		"run concurrently (0 for unlimited)")
+	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file or '<git-uri>.git//<path>#<branch>' to load (can specify multiple)")
+
 	return cmd
 }
 
 func (c *refreshCmd) run(cmd *cobra.Command, args []string) error {
-	// this may end up as a flag on `cache create`, e.g. `cache create --refresh`,
-	// but for now we'll implement it here as a separate command before adding
-	// that flag, if at all.
+	if c.cacheDir == "" {
+		return errors.New("The cache directory to refresh must be given with --dir")
+	}
+
+	stackConfig, err := cluster.ParseStackCliArgs(c.stackName, c.stackFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	cliManifests, err := kapp.ParseManifests(c.manifests)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// CLI args override configured args, so merge them in
+	cliStackConfig := &kapp.StackConfig{
+		Manifests: cliManifests,
+	}
+
+	mergo.Merge(stackConfig, cliStackConfig, mergo.WithOverride)
+
+	log.Debugf("Final stack config: %#v", stackConfig)
+
+	for _, manifest := range stackConfig.Manifests {
+		err = kapp.ValidateManifest(&manifest)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	verification, err := sourceVerification(stackConfig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = configureGit(c.cacheDir, c.noMirrors, c.fetches)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = cacher.RefreshCache(stackConfig.Manifests, c.cacheDir, c.edited,
+		verification, c.dryRun)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Infof("Cache refreshed: %s", c.cacheDir)
 
 	return nil
 }
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+)
+
+// Keys in provider vars for verification settings
+const REQUIRE_SIGNED_TAGS_KEY = "require_signed_tags"
+const TRUSTED_GPG_KEYS_KEY = "trusted_gpg_keys"
+
+// Returns the settings for verifying sources. Settings in the stack config are
+// combined with provider vars so signed tags can be required per stack or per
+// profile/cluster (e.g. in a profile's values.yaml file).
+func sourceVerification(stackConfig *kapp.StackConfig) (*cacher.Verification, error) {
+	verification := &cacher.Verification{
+		RequireSignedTags: stackConfig.RequireSignedTags,
+		TrustedGpgKeys:    stackConfig.TrustedGpgKeys,
+	}
+
+	// stacks may just be a list of manifests
+	if stackConfig.Provider == "" {
+		return verification, nil
+	}
+
+	providerVars, err := provider.LoadVars(stackConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if requireSignedTags, ok := providerVars[REQUIRE_SIGNED_TAGS_KEY]; ok {
+		required, ok := requireSignedTags.(bool)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("'%s' must be a boolean, got: %#v",
+				REQUIRE_SIGNED_TAGS_KEY, requireSignedTags))
+		}
+		// vars can't relax a requirement in the stack config
+		verification.RequireSignedTags = verification.RequireSignedTags || required
+	}
+
+	if len(verification.TrustedGpgKeys) == 0 {
+		if trustedKeys, ok := providerVars[TRUSTED_GPG_KEYS_KEY]; ok {
+			keyList, ok := trustedKeys.([]interface{})
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("'%s' must be a list, got: %#v",
+					TRUSTED_GPG_KEYS_KEY, trustedKeys))
+			}
+
+			for _, key := range keyList {
+				verification.TrustedGpgKeys = append(verification.TrustedGpgKeys,
+					fmt.Sprintf("%v", key))
+			}
+		}
+	}
+
+	return verification, nil
+}
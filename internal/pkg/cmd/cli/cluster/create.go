@@ -84,7 +84,7 @@ Note: Not all providers require all arguments. See documentation for help.
 	f.StringVarP(&c.account, "account", "a", "", "string identifier for the account to launch in (for providers that support it)")
 	f.StringVarP(&c.region, "region", "r", "", "name of region (for providers that support it)")
 	f.VarP(&c.varsFilesDirs, "vars-file-or-dir", "f", "YAML vars file or directory to load (can specify multiple)")
-	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file to load (can specify multiple)")
+	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file or '<git-uri>.git//<path>#<branch>' to load (can specify multiple)")
 	f.Uint32Var(&c.onlineTimeout, "online-timeout", 600, "max number of seconds to wait for the cluster to come online")
 	f.Uint32Var(&c.readyTimeout, "ready-timeout", 600, "max number of seconds to wait for the cluster to become ready")
 	return cmd
@@ -181,3 +181,52 @@ func ParseStackCliArgs(stackName string, stackFile string) (*kapp.StackConfig, e
 
 	return stackConfig, nil
 }
+
+// CLI args identifying a stack. Any that are set override values configured
+// for the stack.
+type StackCliArgs struct {
+	StackName     string
+	StackFile     string
+	Provider      string
+	Provisioner   string
+	Profile       string
+	Cluster       string
+	Account       string
+	Region        string
+	VarsFilesDirs []string
+	Manifests     []string
+}
+
+// Loads any stack config given by CLI args and merges the remaining CLI args
+// over it. Commands that need to agree on which stack they target (e.g. when
+// validating cluster diffs) should use this so they build identical stack
+// configs from the same args.
+func LoadStackConfigFromCliArgs(args StackCliArgs) (*kapp.StackConfig, error) {
+	stackConfig, err := ParseStackCliArgs(args.StackName, args.StackFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cliManifests, err := kapp.ParseManifests(args.Manifests)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// CLI args override configured args, so merge them in
+	cliStackConfig := &kapp.StackConfig{
+		Provider:      args.Provider,
+		Provisioner:   args.Provisioner,
+		Profile:       args.Profile,
+		Cluster:       args.Cluster,
+		Account:       args.Account,
+		Region:        args.Region,
+		VarsFilesDirs: args.VarsFilesDirs,
+		Manifests:     cliManifests,
+	}
+
+	mergo.Merge(stackConfig, cliStackConfig, mergo.WithOverride)
+
+	log.Debugf("Final stack config: %#v", stackConfig)
+
+	return stackConfig, nil
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cluster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/clusterdiff"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadStackConfigFromCliArgs(t *testing.T) {
+	args := StackCliArgs{
+		Provider:    "aws",
+		Provisioner: "kops",
+		Profile:     "dev",
+		Cluster:     "dev1",
+		Account:     "123456",
+		Region:      "eu-west-1",
+	}
+
+	stackConfig, err := LoadStackConfigFromCliArgs(args)
+	assert.Nil(t, err)
+	assert.Equal(t, "123456", stackConfig.Account)
+	assert.Equal(t, "eu-west-1", stackConfig.Region)
+}
+
+// Diffs generated by 'cluster diff' must validate against the stack config
+// that 'kapps install' builds from the same CLI args
+func TestDiffValidatesForCliArgs(t *testing.T) {
+	args := StackCliArgs{
+		Provider:    "aws",
+		Provisioner: "kops",
+		Profile:     "dev",
+		Cluster:     "dev1",
+		Account:     "123456",
+		Region:      "eu-west-1",
+	}
+
+	diffStackConfig, err := LoadStackConfigFromCliArgs(args)
+	assert.Nil(t, err)
+
+	// there are no kapps so the source-of-truth isn't consulted
+	diff, err := clusterdiff.Create(diffStackConfig, nil)
+	assert.Nil(t, err)
+
+	tempDir, err := ioutil.TempDir("", "sugarkube-diff-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	diffPath := filepath.Join(tempDir, "diff.yaml")
+	assert.Nil(t, clusterdiff.Save(diff, diffPath))
+
+	loadedDiff, err := clusterdiff.Load(diffPath)
+	assert.Nil(t, err)
+
+	installStackConfig, err := LoadStackConfigFromCliArgs(args)
+	assert.Nil(t, err)
+	assert.Nil(t, loadedDiff.Validate(installStackConfig, time.Hour))
+
+	// diffs for another account or region must be rejected
+	otherArgs := args
+	otherArgs.Region = "us-east-1"
+	otherStackConfig, err := LoadStackConfigFromCliArgs(otherArgs)
+	assert.Nil(t, err)
+	assert.NotNil(t, loadedDiff.Validate(otherStackConfig, time.Hour))
+
+	otherArgs = args
+	otherArgs.Account = ""
+	otherStackConfig, err = LoadStackConfigFromCliArgs(otherArgs)
+	assert.Nil(t, err)
+	assert.NotNil(t, loadedDiff.Validate(otherStackConfig, time.Hour))
+}
@@ -18,13 +18,32 @@ package cluster
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/sugarkube/sugarkube/internal/pkg/clusterdiff"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/kappsot"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
 	"io"
 )
 
 type diffCmd struct {
-	out      io.Writer
-	extended bool
+	out           io.Writer
+	extended      bool
+	cacheDir      string
+	outPath       string
+	stackName     string
+	stackFile     string
+	provider      string
+	provisioner   string
+	varsFilesDirs cmd.Files
+	profile       string
+	account       string
+	cluster       string
+	region        string
+	manifests     cmd.Files
 }
 
 // Diff may not be the best term, since the output isn't only a diff but also
@@ -49,21 +68,118 @@ manifests to be present or absent and then calculates which kapps should be
 installed and destroyed.
 
 When run with '--extended' this command will also include the contents of each
-kapp's 'sugarkube.yaml' file (if it exists). This can be used to inform e.g.
-a CI/CD system about the secrets that a kapp needs during installation.
+kapp's 'sugarkube.yaml' file (if it exists) in the cache given by '--dir'. This 
+can be used to inform e.g. a CI/CD system about the secrets that a kapp needs 
+during installation.
+
+Diffs are printed as YAML, or can be written to a file with '--output'. They
+contain a timestamp and the stack they were generated for so they can be passed
+to 'kapps install --diff-path' (e.g. in a later stage of a CI/CD pipeline after
+the diff has been approved). Files with a '.json' extension will be written as
+JSON.
 `,
 		RunE: c.run,
 	}
 
 	f := cmd.Flags()
 	f.BoolVar(&c.extended, "extended", false, "include each kapp's 'sugarkube.yaml' file in output")
-
+	f.StringVarP(&c.cacheDir, "dir", "d", "", "Directory containing a cache to read kapps' 'sugarkube.yaml' files from (required with --extended)")
+	f.StringVarP(&c.outPath, "output", "o", "", "path to write the diff to instead of printing it")
+	f.StringVarP(&c.stackName, "stack-name", "n", "", "name of a stack to diff (required when passing --stack-config)")
+	f.StringVarP(&c.stackFile, "stack-config", "s", "", "path to file defining stacks by name")
+	f.StringVarP(&c.provider, "provider", "p", "", "name of provider, e.g. aws, local, etc.")
+	f.StringVarP(&c.provisioner, "provisioner", "v", "", "name of provisioner, e.g. kops, minikube, etc.")
+	f.StringVarP(&c.profile, "profile", "l", "", "launch profile, e.g. dev, test, prod, etc.")
+	f.StringVarP(&c.cluster, "cluster", "c", "", "name of cluster to diff, e.g. dev1, dev2, etc.")
+	f.StringVarP(&c.account, "account", "a", "", "string identifier for the account the cluster is in (for providers that support it)")
+	f.StringVarP(&c.region, "region", "r", "", "name of region (for providers that support it)")
+	f.VarP(&c.varsFilesDirs, "vars-file-or-dir", "f", "YAML vars file or directory to load (can specify multiple)")
+	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file or '<git-uri>.git//<path>#<branch>' to load (can specify multiple but will replace any configured in a stack)")
 	return cmd
 }
 
 func (c *diffCmd) run(cmd *cobra.Command, args []string) error {
-	// todo the diff should include a timestamp so that we can allow them to
-	// only be valid as inputs to `kapps install` for a certain amount of time.
+	if c.extended && c.cacheDir == "" {
+		return errors.New("A cache directory must be given with --dir " +
+			"when running with --extended")
+	}
+
+	stackConfig, err := LoadStackConfigFromCliArgs(StackCliArgs{
+		StackName:     c.stackName,
+		StackFile:     c.stackFile,
+		Provider:      c.provider,
+		Provisioner:   c.provisioner,
+		Profile:       c.profile,
+		Cluster:       c.cluster,
+		Account:       c.account,
+		Region:        c.region,
+		VarsFilesDirs: c.varsFilesDirs,
+		Manifests:     c.manifests,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	clusterDiff, err := CreateClusterDiff(stackConfig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if c.extended {
+		err = clusterDiff.AddDescriptors(c.cacheDir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if c.outPath != "" {
+		err = clusterdiff.Save(clusterDiff, c.outPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.Infof("Cluster diff written to: %s", c.outPath)
+		return nil
+	}
+
+	diffBytes, err := clusterdiff.Marshal(clusterDiff, clusterdiff.FORMAT_YAML)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = fmt.Fprint(c.out, string(diffBytes))
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
 	return nil
 }
+
+// Consults the Source-of-Truth configured for a stack to create a cluster diff
+// of which kapps need installing and destroying
+func CreateClusterDiff(stackConfig *kapp.StackConfig) (*clusterdiff.ClusterDiff, error) {
+	providerImpl, err := provider.NewProvider(stackConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	kappSotName := stackConfig.KappSot
+	if kappSotName == "" {
+		kappSotName = kappsot.HELM
+	}
+
+	kappSot, err := kappsot.NewKappSot(kappSotName, providerImpl)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	log.Infof("Diffing cluster '%s' using the '%s' source-of-truth",
+		stackConfig.Cluster, kappSotName)
+
+	clusterDiff, err := clusterdiff.Create(stackConfig, kappSot)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return clusterDiff, nil
+}
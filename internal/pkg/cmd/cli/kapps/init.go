@@ -18,31 +18,160 @@ package kapps
 
 import (
 	"fmt"
+	"github.com/imdario/mergo"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd/cli/cluster"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"github.com/sugarkube/sugarkube/internal/pkg/templater"
 	"io"
+	"os"
 )
 
-type cmdConfig struct {
-	out io.Writer
+type initCmd struct {
+	out           io.Writer
+	cacheDir      string
+	dryRun        bool
+	stackName     string
+	stackFile     string
+	provider      string
+	provisioner   string
+	varsFilesDirs cmd.Files
+	profile       string
+	account       string
+	cluster       string
+	region        string
+	manifests     cmd.Files
 }
 
 func newInitCmd(out io.Writer) *cobra.Command {
-	c := &cmdConfig{
+	c := &initCmd{
 		out: out,
 	}
 
 	cmd := &cobra.Command{
-		Use:   "init [flags]",
+		Use:   "init [cache-dir]",
 		Short: fmt.Sprintf("Initialise kapps"),
 		Long: `Initialises kapps by generating necessary files, e.g. terraform backends
 configured for the region the target cluster is in, generating Helm
-'values.yaml' files, etc.`,
-		RunE: c.run,
+'values.yaml' files, etc.
+
+Renders the templates listed under 'templates' in each cached kapp's 
+'sugarkube.yaml' file with Go's text/template. Templates can use the stack's 
+merged vars as '.vars', fields of the kapp as '.kapp' and of the stack config 
+as '.stack', e.g. '{{ .vars.kube_context }}', '{{ .kapp.Id }}' or 
+'{{ .stack.Cluster }}'. Rendered files are written next to their templates as 
+'_generated_<name>' (without any '.tpl' extension) unless a 'dest' is given.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("the path to the kapp cache dir is required")
+			}
+			c.cacheDir = args[0]
+			return c.run()
+		},
 	}
 
+	f := cmd.Flags()
+	f.BoolVar(&c.dryRun, "dry-run", false, "print rendered templates instead of writing them")
+	f.StringVarP(&c.stackName, "stack-name", "n", "", "name of a stack to initialise kapps for (required when passing --stack-config)")
+	f.StringVarP(&c.stackFile, "stack-config", "s", "", "path to file defining stacks by name")
+	f.StringVarP(&c.provider, "provider", "p", "", "name of provider, e.g. aws, local, etc.")
+	f.StringVarP(&c.provisioner, "provisioner", "v", "", "name of provisioner, e.g. kops, minikube, etc.")
+	f.StringVarP(&c.profile, "profile", "l", "", "launch profile, e.g. dev, test, prod, etc.")
+	f.StringVarP(&c.cluster, "cluster", "c", "", "name of cluster to initialise kapps for, e.g. dev1, dev2, etc.")
+	f.StringVarP(&c.account, "account", "a", "", "string identifier for the account the cluster is in (for providers that support it)")
+	f.StringVarP(&c.region, "region", "r", "", "name of region (for providers that support it)")
+	f.VarP(&c.varsFilesDirs, "vars-file-or-dir", "f", "YAML vars file or directory to load (can specify multiple)")
+	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file or '<git-uri>.git//<path>#<branch>' to load (can specify multiple but will replace any configured in a stack)")
 	return cmd
 }
 
-func (c *cmdConfig) run(cmd *cobra.Command, args []string) error {
+func (c *initCmd) run() error {
+	stackConfig, err := cluster.ParseStackCliArgs(c.stackName, c.stackFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	cliManifests, err := kapp.ParseManifests(c.manifests)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// CLI args override configured args, so merge them in
+	cliStackConfig := &kapp.StackConfig{
+		Provider:      c.provider,
+		Provisioner:   c.provisioner,
+		Profile:       c.profile,
+		Cluster:       c.cluster,
+		Account:       c.account,
+		Region:        c.region,
+		VarsFilesDirs: c.varsFilesDirs,
+		Manifests:     cliManifests,
+	}
+
+	mergo.Merge(stackConfig, cliStackConfig, mergo.WithOverride)
+
+	log.Debugf("Final stack config: %#v", stackConfig)
+
+	vars, err := provider.LoadVars(stackConfig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	paths, err := renderTemplates(stackConfig, c.cacheDir, vars, c.dryRun, c.out)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if c.dryRun {
+		log.Infof("Dry run. Would have rendered %d templates", len(paths))
+	} else {
+		log.Infof("Rendered %d templates", len(paths))
+	}
+
 	return nil
 }
+
+// Renders the templates of all kapps in a stack's manifests that are in the
+// cache and returns the paths of the rendered files
+func renderTemplates(stackConfig *kapp.StackConfig, cacheDir string,
+	vars provider.Values, dryRun bool, out io.Writer) ([]string, error) {
+
+	paths := make([]string, 0)
+
+	for _, manifest := range stackConfig.Manifests {
+		manifestCacheDir := cacher.GetManifestCachePath(cacheDir, manifest)
+
+		for _, manifestKapp := range manifest.Kapps {
+			kappObj := manifestKapp
+			kappObj.RootDir = cacher.GetKappRootPath(manifestCacheDir, kappObj)
+
+			if _, err := os.Stat(kappObj.RootDir); err != nil {
+				log.Warnf("Not rendering templates for kapp '%s' in manifest "+
+					"'%s' because it isn't in the cache", kappObj.Id, manifest.Id)
+				continue
+			}
+
+			descriptor, err := kapp.LoadDescriptor(kappObj.RootDir)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error loading descriptor of "+
+					"kapp '%s' in manifest '%s'", kappObj.Id, manifest.Id)
+			}
+			kappObj.Descriptor = descriptor
+
+			kappPaths, err := templater.RenderKapp(&kappObj, stackConfig, vars,
+				dryRun, out)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			paths = append(paths, kappPaths...)
+		}
+	}
+
+	return paths, nil
+}
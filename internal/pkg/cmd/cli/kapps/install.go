@@ -18,25 +18,32 @@ package kapps
 
 import (
 	"fmt"
-	"github.com/imdario/mergo"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/clusterdiff"
 	"github.com/sugarkube/sugarkube/internal/pkg/cmd"
 	"github.com/sugarkube/sugarkube/internal/pkg/cmd/cli/cluster"
-	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/installer"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"github.com/sugarkube/sugarkube/internal/pkg/plan"
 	"io"
+	"time"
 )
 
+// Default maximum number of kapps to process concurrently
+const DEFAULT_PARALLELISM = 4
+
 type installCmd struct {
 	out           io.Writer
 	diffPath      string
+	maxDiffAge    time.Duration
 	cacheDir      string
 	dryRun        bool
 	approved      bool
 	oneShot       bool
 	force         bool
+	ignoreCache   bool
 	stackName     string
 	stackFile     string
 	provider      string
@@ -47,6 +54,11 @@ type installCmd struct {
 	cluster       string
 	region        string
 	manifests     cmd.Files
+	parallelism   int
+	timeout       time.Duration
+	resume        bool
+	stream        bool
+	allowDestroy  bool
 	// todo - add options to :
 	// * filter the kapps to be processed (use strings like e.g. manifest:kapp-id to refer to kapps)
 	// * exclude manifests / kapps from being processed
@@ -79,8 +91,22 @@ func newInstallCmd(out io.Writer) *cobra.Command {
 		"'APPROVED=false' then 'APPROVED=true' to install/destroy kapps in a single invocation of sugarkube")
 	f.BoolVar(&c.force, "force", false, "don't require a cluster diff, just blindly install/destroy all the kapps "+
 		"defined in a manifest(s)/stack config, even if they're already present/absent in the target cluster")
+	f.BoolVar(&c.ignoreCache, "ignore-cache-diff", false, "install kapps even if the cache is out-of-sync "+
+		"with the manifests, e.g. if kapps have been modified locally")
 	f.StringVarP(&c.diffPath, "diff-path", "d", "", "Path to the cluster diff to apply. If not given, a "+
 		"diff will be generated")
+	f.DurationVar(&c.maxDiffAge, "max-diff-age", time.Hour, "refuse to apply cluster diffs loaded with --diff-path "+
+		"that were generated longer ago than this. Set to 0 to disable expiry")
+	f.IntVar(&c.parallelism, "parallelism", DEFAULT_PARALLELISM, "maximum number of kapps to install/destroy "+
+		"concurrently (0 for unlimited)")
+	f.DurationVar(&c.timeout, "timeout", 0, "stop installing/destroying kapps that run for longer than this "+
+		"unless they set a 'timeout' in their manifest. Set to 0 to disable")
+	f.BoolVar(&c.resume, "resume", false, "skip kapps that succeeded in the previous run against the cache. "+
+		"Fails if the stack, manifests or cache have changed since")
+	f.BoolVar(&c.stream, "stream", false, "stream the output of installers to the terminal prefixed with "+
+		"kapp IDs. Output is always written to log files under the cache")
+	f.BoolVar(&c.allowDestroy, "allow-destroy", false, "apply changes even if the terraform plans kapps "+
+		"exported when run unapproved would destroy resources")
 	f.StringVarP(&c.stackName, "stack-name", "n", "", "name of a stack to launch (required when passing --stack-config)")
 	f.StringVarP(&c.stackFile, "stack-config", "s", "", "path to file defining stacks by name")
 	f.StringVarP(&c.provider, "provider", "p", "", "name of provider, e.g. aws, local, etc.")
@@ -90,7 +116,7 @@ func newInstallCmd(out io.Writer) *cobra.Command {
 	f.StringVarP(&c.account, "account", "a", "", "string identifier for the account to launch in (for providers that support it)")
 	f.StringVarP(&c.region, "region", "r", "", "name of region (for providers that support it)")
 	f.VarP(&c.varsFilesDirs, "vars-file-or-dir", "f", "YAML vars file or directory to load (can specify multiple)")
-	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file to load (can specify multiple but will replace any configured in a stack)")
+	f.VarP(&c.manifests, "manifest", "m", "YAML manifest file or '<git-uri>.git//<path>#<branch>' to load (can specify multiple but will replace any configured in a stack)")
 	return cmd
 }
 
@@ -98,64 +124,75 @@ func (c *installCmd) run() error {
 
 	var err error
 
-	stackConfig, err := cluster.ParseStackCliArgs(c.stackName, c.stackFile)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	cliManifests, err := kapp.ParseManifests(c.manifests)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	// CLI args override configured args, so merge them in
-	cliStackConfig := &kapp.StackConfig{
+	stackConfig, err := cluster.LoadStackConfigFromCliArgs(cluster.StackCliArgs{
+		StackName:     c.stackName,
+		StackFile:     c.stackFile,
 		Provider:      c.provider,
 		Provisioner:   c.provisioner,
 		Profile:       c.profile,
 		Cluster:       c.cluster,
+		Account:       c.account,
+		Region:        c.region,
 		VarsFilesDirs: c.varsFilesDirs,
-		Manifests:     cliManifests,
+		Manifests:     c.manifests,
+	})
+	if err != nil {
+		return errors.WithStack(err)
 	}
 
-	mergo.Merge(stackConfig, cliStackConfig, mergo.WithOverride)
-
-	log.Debugf("Final stack config: %#v", stackConfig)
-
 	var actionPlan *plan.Plan
 
 	if !c.force {
-		panic("Not implemented. Pass --force")
+		var clusterDiff *clusterdiff.ClusterDiff
 
 		if c.diffPath != "" {
-			// todo load a cluster diff from a file
-
-			// todo - validate that the embedded stack config matches the target cluster.
+			clusterDiff, err = clusterdiff.Load(c.diffPath)
+			if err != nil {
+				return errors.WithStack(err)
+			}
 
 			// in future we may want to be able to work entirely from a cluster
-			// diff, in which case it'd really be a plan for us
-			if len(stackConfig.Manifests) > 0 {
-				// todo - validate that the cluster diff matches the manifests, e.g. that
-				// the versions of kapps in the manifests match the versions in the cluster
-				// diff
+			// diff, in which case it'd really be a plan for us. For now make sure
+			// it was generated for the target stack and its manifests.
+			err = clusterDiff.Validate(stackConfig, c.maxDiffAge)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid cluster diff '%s'", c.diffPath)
 			}
 		} else {
-			// todo - create a cluster diff based on stackConfig.Manifests
+			clusterDiff, err = cluster.CreateClusterDiff(stackConfig)
+			if err != nil {
+				return errors.WithStack(err)
+			}
 		}
 
-		// todo - diff the cache against the kapps in the cluster diff and abort if
-		// it's out-of-sync (unless flags are set to ignore cache changes), e.g.:
-		//cacheDiff, err := cacher.DiffKappCache(clusterDiff, c.cacheDir)
-		//if err != nil {
-		//	return errors.WithStack(err)
-		//}
-		//if len(diff) != 0 {
-		//	return errors.New("Cache out-of-sync with manifests: %s", diff)
-		//}
+		err = clusterDiff.ValidateCache(stackConfig, c.cacheDir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// abort if the cache is out-of-sync with the manifests unless told to
+		// ignore cache changes
+		cacheDiff, err := cacher.DiffCache(stackConfig.Manifests, c.cacheDir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if !cacheDiff.IsEmpty() {
+			if !c.ignoreCache {
+				return errors.New(fmt.Sprintf("Cache '%s' is out-of-sync with "+
+					"the manifests. Run 'cache diff' for details or pass "+
+					"--ignore-cache-diff to install anyway", c.cacheDir))
+			}
 
-		// todo - create an action plan from the validated cluster diff
-		//actionPlan, err := plan.FromDiff(clusterDiff)
+			log.Warnf("Ignoring differences between cache '%s' and the "+
+				"manifests: %#v", c.cacheDir, cacheDiff)
+		}
 
+		// create an action plan from the validated cluster diff
+		actionPlan, err = plan.FromDiff(clusterDiff, stackConfig, c.cacheDir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 	} else {
 		// force mode, so no need to perform validation. Just create a plan
 		actionPlan, err = plan.Create(stackConfig, c.cacheDir)
@@ -164,19 +201,39 @@ func (c *installCmd) run() error {
 		}
 	}
 
+	// stop gracefully on Ctrl-C/SIGTERM, and make sure installers don't
+	// outlive us if we're told to exit immediately
+	ctx, cancel := cmd.SignalContext(installer.KillRunningCommands)
+	defer cancel()
+
+	options := plan.RunOptions{
+		Approved:     c.approved,
+		DryRun:       c.dryRun,
+		Parallelism:  c.parallelism,
+		Timeout:      c.timeout,
+		Resume:       c.resume,
+		AllowDestroy: c.allowDestroy,
+	}
+
+	if c.stream {
+		options.Stream = c.out
+	}
+
 	if !c.oneShot {
 		// run the plan either preparing or applying changes
-		err := actionPlan.Run(c.approved, c.dryRun)
+		err := actionPlan.Run(ctx, options)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 	} else {
 		// one-shot mode, so prepare and apply the plan straight away
-		err = actionPlan.Run(false, c.dryRun)
+		options.Approved = false
+		err = actionPlan.Run(ctx, options)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		err = actionPlan.Run(true, c.dryRun)
+		options.Approved = true
+		err = actionPlan.Run(ctx, options)
 		if err != nil {
 			return errors.WithStack(err)
 		}
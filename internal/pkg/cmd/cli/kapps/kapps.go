@@ -33,6 +33,7 @@ func NewKappsCmds(out io.Writer) *cobra.Command {
 	cmd.AddCommand(
 		newInitCmd(out),
 		newInstallCmd(out),
+		newOutputsCmd(out),
 	)
 
 	return cmd
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kapps
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd/cli/cluster"
+	"github.com/sugarkube/sugarkube/internal/pkg/plan"
+	"gopkg.in/yaml.v2"
+	"io"
+	"sort"
+)
+
+type outputsCmd struct {
+	out         io.Writer
+	cacheDir    string
+	env         bool
+	stackName   string
+	stackFile   string
+	provider    string
+	provisioner string
+	profile     string
+	account     string
+	cluster     string
+	region      string
+}
+
+func newOutputsCmd(out io.Writer) *cobra.Command {
+	c := &outputsCmd{
+		out: out,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "outputs [cache-dir]",
+		Short: fmt.Sprintf("Show kapp outputs"),
+		Long: `Shows the outputs recorded for a stack's kapps when they were installed.
+
+Kapps write outputs as a JSON object to the path in '$OUTPUTS_JSON' (e.g. with 
+'terraform output -json'), or to files declared under 'outputs' in their 
+'sugarkube.yaml' file. Outputs are passed to kapps installed later in the 
+stack as env vars named 'OUTPUT_<MANIFEST ID>_<KAPP ID>_<NAME>'. Pass '--env' 
+to print them in that form.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("the path to the kapp cache dir is required")
+			}
+			c.cacheDir = args[0]
+			return c.run()
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVar(&c.env, "env", false, "print outputs as the env vars they're passed to kapps in")
+	f.StringVarP(&c.stackName, "stack-name", "n", "", "name of a stack to show outputs for (required when passing --stack-config)")
+	f.StringVarP(&c.stackFile, "stack-config", "s", "", "path to file defining stacks by name")
+	f.StringVarP(&c.provider, "provider", "p", "", "name of provider, e.g. aws, local, etc.")
+	f.StringVarP(&c.provisioner, "provisioner", "v", "", "name of provisioner, e.g. kops, minikube, etc.")
+	f.StringVarP(&c.profile, "profile", "l", "", "launch profile, e.g. dev, test, prod, etc.")
+	f.StringVarP(&c.cluster, "cluster", "c", "", "name of cluster to show outputs for, e.g. dev1, dev2, etc.")
+	f.StringVarP(&c.account, "account", "a", "", "string identifier for the account the cluster is in (for providers that support it)")
+	f.StringVarP(&c.region, "region", "r", "", "name of region (for providers that support it)")
+	return cmd
+}
+
+func (c *outputsCmd) run() error {
+	// build the stack config the same way as 'kapps install' so outputs are
+	// looked up under the same stack key they were recorded under
+	stackConfig, err := cluster.LoadStackConfigFromCliArgs(cluster.StackCliArgs{
+		StackName:   c.stackName,
+		StackFile:   c.stackFile,
+		Provider:    c.provider,
+		Provisioner: c.provisioner,
+		Profile:     c.profile,
+		Cluster:     c.cluster,
+		Account:     c.account,
+		Region:      c.region,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	outputStore, err := plan.LoadOutputs(c.cacheDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	stackOutputs := outputStore.StackOutputs(plan.StackKey(stackConfig))
+
+	if c.env {
+		ids := make(map[string]bool)
+		for id := range stackOutputs {
+			ids[id] = true
+		}
+		envVars := plan.OutputEnvVars(stackOutputs, ids)
+
+		names := make([]string, 0)
+		for name := range envVars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			_, err = fmt.Fprintf(c.out, "%s=%s\n", name, envVars[name])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		return nil
+	}
+
+	data, err := yaml.Marshal(stackOutputs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = fmt.Fprint(c.out, string(data))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
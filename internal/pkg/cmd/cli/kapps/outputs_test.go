@@ -0,0 +1,83 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kapps
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/cmd/cli/cluster"
+	"github.com/sugarkube/sugarkube/internal/pkg/plan"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Outputs recorded when installing kapps with the account and region given
+// as CLI args should be shown when passing the same args to 'kapps outputs'
+func TestOutputsWithCliAccountRegion(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "sugarkube-cache-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	// 'kapps install' records outputs under the key of the stack it builds
+	// from its CLI args
+	installStackConfig, err := cluster.LoadStackConfigFromCliArgs(cluster.StackCliArgs{
+		Provider: "aws",
+		Profile:  "dev",
+		Cluster:  "dev1",
+		Account:  "123456",
+		Region:   "eu-west-1",
+	})
+	assert.Nil(t, err)
+
+	store := plan.OutputStore{
+		Stacks: map[string]map[string]map[string]string{
+			plan.StackKey(installStackConfig): {
+				"manifest1:rds": {"hostname": "db.example.com"},
+			},
+		},
+	}
+	data, err := yaml.Marshal(&store)
+	assert.Nil(t, err)
+
+	outputsPath := filepath.Join(cacheDir, cacher.CACHE_DIR, plan.OUTPUTS_FILE)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(outputsPath), 0755))
+	assert.Nil(t, ioutil.WriteFile(outputsPath, data, 0600))
+
+	var out bytes.Buffer
+	c := &outputsCmd{
+		out:      &out,
+		cacheDir: cacheDir,
+		env:      true,
+		provider: "aws",
+		profile:  "dev",
+		cluster:  "dev1",
+		account:  "123456",
+		region:   "eu-west-1",
+	}
+	assert.Nil(t, c.run())
+	assert.Equal(t, "OUTPUT_MANIFEST1_RDS_HOSTNAME=db.example.com\n", out.String())
+
+	// outputs aren't shown for other regions
+	out.Reset()
+	c.region = "us-east-1"
+	assert.Nil(t, c.run())
+	assert.Equal(t, "", out.String())
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Exits the process. It's a variable so tests can stub it.
+var exit = os.Exit
+
+// Returns a context that's cancelled when the process receives SIGINT or
+// SIGTERM, so long-running commands can stop gracefully. A second signal
+// calls `onExit` (if not nil) to kill anything that wouldn't die with us, e.g.
+// child processes in their own process groups, then exits immediately.
+func SignalContext(onExit func()) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signalCh := make(chan os.Signal, 2)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signalCh:
+			log.Warnf("Received %s. Stopping gracefully (send it again to "+
+				"exit immediately)...", sig)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(signalCh)
+			return
+		}
+
+		sig := <-signalCh
+		signal.Stop(signalCh)
+		log.Errorf("Received %s again. Exiting immediately", sig)
+
+		if onExit != nil {
+			onExit()
+		}
+
+		exit(1)
+	}()
+
+	return ctx, cancel
+}
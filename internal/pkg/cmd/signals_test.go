@@ -0,0 +1,83 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A second interrupt should kill child processes in their own process groups
+// before exiting
+func TestSignalContextDoubleInterrupt(t *testing.T) {
+	exitCh := make(chan int, 1)
+	exit = func(code int) {
+		exitCh <- code
+	}
+	defer func() {
+		exit = os.Exit
+	}()
+
+	child := exec.Command("sleep", "60")
+	child.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := child.Start()
+	assert.Nil(t, err)
+
+	ctx, cancel := SignalContext(func() {
+		syscall.Kill(-child.Process.Pid, syscall.SIGKILL)
+	})
+	defer cancel()
+
+	err = syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	assert.Nil(t, err)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context wasn't cancelled by the first interrupt")
+	}
+
+	err = syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	assert.Nil(t, err)
+
+	select {
+	case code := <-exitCh:
+		assert.Equal(t, 1, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't exit after the second interrupt")
+	}
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- child.Wait()
+	}()
+
+	select {
+	case err = <-waitCh:
+		assert.NotNil(t, err)
+		status, ok := child.ProcessState.Sys().(syscall.WaitStatus)
+		assert.True(t, ok)
+		assert.Equal(t, syscall.SIGKILL, status.Signal())
+	case <-time.After(5 * time.Second):
+		child.Process.Kill()
+		t.Fatal("child process is still running")
+	}
+}
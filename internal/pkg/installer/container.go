@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Runtime used to run installer images if the stack doesn't configure one
+const DEFAULT_CONTAINER_RUNTIME = "docker"
+
+// Returns the image to run the kapp's installer in, or an empty string to run
+// it on the host
+func containerImage(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig) string {
+	image := kappObj.MergedInstallerConfig().Image
+	if image == "" {
+		image = stackConfig.InstallerImage
+	}
+
+	return image
+}
+
+// Returns the binary to run installer images with
+func containerRuntime(stackConfig *kapp.StackConfig) string {
+	if stackConfig.ContainerRuntime != "" {
+		return stackConfig.ContainerRuntime
+	}
+
+	return DEFAULT_CONTAINER_RUNTIME
+}
+
+// Returns the paths to mount into an installer container: the kapp's root dir
+// and any kubeconfig files that exist. They're mounted at the same paths so
+// paths in env vars and CLI args still resolve.
+func containerMounts(kappRootDir string, kubeConfig string) ([]string, error) {
+	absKappRoot, err := filepath.Abs(kappRootDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	mounts := []string{absKappRoot}
+
+	// paths may have been resolved through symlinks, e.g. to search paths
+	realKappRoot, err := filepath.EvalSymlinks(absKappRoot)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if realKappRoot != absKappRoot {
+		mounts = append(mounts, realKappRoot)
+	}
+
+	for _, path := range filepath.SplitList(kubeConfig) {
+		if _, err := os.Stat(path); err == nil {
+			mounts = append(mounts, path+":"+path+":ro")
+		}
+	}
+
+	return mounts, nil
+}
+
+// Returns the args for a container runtime to run a command in an image as a
+// user (`uid:gid`). Env vars are only passed by name so their values (e.g.
+// secrets) aren't visible in the process list. The runtime reads them from
+// its own env. An init process is run so signals reach the command and its
+// children, and running as the host user means files written to the mounted
+// cache aren't owned by root.
+func containerArgs(image string, workDir string, user string, mounts []string,
+	envVarNames []string, command []string) []string {
+
+	args := []string{"run", "--rm", "--init", "--user", user, "--workdir", workDir}
+
+	for _, mount := range mounts {
+		if !strings.Contains(mount, ":") {
+			mount = mount + ":" + mount
+		}
+		args = append(args, "--volume", mount)
+	}
+
+	names := append([]string{}, envVarNames...)
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "--env", name)
+	}
+
+	args = append(args, image)
+
+	return append(args, command...)
+}
+
+// Returns a command that runs `command` in the kapp's installer image with the
+// given env vars, plus any the kapp's descriptor requires from the user's env
+func containerisedCommand(image string, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	workDir string, envVars map[string]string, command []string) (*exec.Cmd, error) {
+
+	mounts, err := containerMounts(kappObj.RootDir, envVars[KUBECONFIG_ENV_VAR])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	envVarNames := make([]string, 0)
+	for name := range envVars {
+		envVarNames = append(envVarNames, name)
+	}
+
+	if kappObj.Descriptor != nil {
+		required := append([]kapp.EnvVar{}, kappObj.Descriptor.EnvVars...)
+		required = append(required, kappObj.Descriptor.Secrets...)
+
+		for _, envVar := range required {
+			if _, ok := envVars[envVar.Name]; !ok {
+				envVarNames = append(envVarNames, envVar.Name)
+			}
+		}
+	}
+
+	user := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	args := containerArgs(image, workDir, user, mounts, envVarNames, command)
+
+	cmd := exec.Command(containerRuntime(stackConfig), args...)
+	cmd.Env = commandEnv(envVars)
+
+	return cmd, nil
+}
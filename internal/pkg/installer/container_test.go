@@ -0,0 +1,112 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContainerArgs(t *testing.T) {
+	args := containerArgs("sugarkube/tools:1.0", "/cache/kapp/wordpress", "1000:1000",
+		[]string{"/cache/kapp", "/home/user/.kube/config:/home/user/.kube/config:ro"},
+		[]string{"KUBECONFIG", "APPROVED"}, []string{"make", "install"})
+
+	assert.Equal(t, []string{"run", "--rm", "--init", "--user", "1000:1000",
+		"--workdir", "/cache/kapp/wordpress",
+		"--volume", "/cache/kapp:/cache/kapp",
+		"--volume", "/home/user/.kube/config:/home/user/.kube/config:ro",
+		"--env", "APPROVED", "--env", "KUBECONFIG",
+		"sugarkube/tools:1.0", "make", "install"}, args)
+}
+
+// Runs a kapp's make target with a fake container runtime that records how
+// it was called
+func TestContainerisedMake(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "container-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	clusterDir := filepath.Join(tempDir, "vars/local/profiles/local/clusters/standard")
+	err = os.MkdirAll(clusterDir, 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(clusterDir, "values.yaml"),
+		[]byte("kube_context: standard\n"), 0644)
+	assert.Nil(t, err)
+
+	recordPath := filepath.Join(tempDir, "record")
+	runtimePath := filepath.Join(tempDir, "fake-runtime")
+	err = ioutil.WriteFile(runtimePath, []byte("#!/bin/sh\n"+
+		"echo \"$@\" > "+recordPath+"\n"+
+		"echo \"KUBE_CONTEXT=$KUBE_CONTEXT\" >> "+recordPath+"\n"), 0755)
+	assert.Nil(t, err)
+
+	stackConfig := &kapp.StackConfig{
+		FilePath:         filepath.Join(tempDir, "stacks.yaml"),
+		Provider:         "local",
+		Profile:          "local",
+		Cluster:          "standard",
+		VarsFilesDirs:    []string{"vars"},
+		InstallerImage:   "sugarkube/tools:1.0",
+		ContainerRuntime: runtimePath,
+	}
+
+	kappDir := filepath.Join(tempDir, "cache/manifest/wordpress")
+	err = os.MkdirAll(kappDir, 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(kappDir, MAKEFILE), []byte{}, 0644)
+	assert.Nil(t, err)
+
+	providerImpl, err := provider.NewProvider(stackConfig)
+	assert.Nil(t, err)
+
+	installerImpl, err := NewInstaller(MAKE, providerImpl)
+	assert.Nil(t, err)
+
+	// kapps can override the stack's image
+	kappObj := &kapp.Kapp{
+		Id:              "wordpress",
+		RootDir:         kappDir,
+		InstallerConfig: kapp.InstallerConfig{Image: "sugarkube/tools:1.1"},
+	}
+
+	var output bytes.Buffer
+	err = Install(context.Background(), installerImpl, kappObj, stackConfig,
+		false, false, &output)
+	assert.Nil(t, err)
+
+	record, err := ioutil.ReadFile(recordPath)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(record)), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, strings.HasPrefix(lines[0], fmt.Sprintf("run --rm --init "+
+		"--user %d:%d --workdir %s --volume %s:%s", os.Getuid(), os.Getgid(),
+		kappDir, kappDir, kappDir)))
+	assert.Contains(t, lines[0], "--env APPROVED --env CLUSTER")
+	assert.True(t, strings.HasSuffix(lines[0], "sugarkube/tools:1.1 make install"))
+	assert.Equal(t, "KUBE_CONTEXT=standard", lines[1])
+}
@@ -0,0 +1,67 @@
+// +build ignore
+
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Generates kapp_interfaces.go from the default kapp interfaces in
+// configs/kapp_interfaces.yaml. Run with `go generate`.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+const source = "../../../configs/kapp_interfaces.yaml"
+const dest = "kapp_interfaces.go"
+
+func main() {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "`") {
+		log.Fatalf("%s can't contain backticks", source)
+	}
+
+	header, err := ioutil.ReadFile("make.go")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	// reuse the licence header
+	buf.Write(header[:bytes.Index(header, []byte("*/"))+3])
+	fmt.Fprintf(&buf, "\n// Code generated by gen_kapp_interfaces.go from %s. DO NOT EDIT.\n\n", source)
+	buf.WriteString("package installer\n\n")
+	buf.WriteString("// The default kapp interfaces\n")
+	fmt.Fprintf(&buf, "const defaultParameteriserConfig = `%s`\n", data)
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(dest, formatted, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
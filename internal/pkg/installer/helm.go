@@ -0,0 +1,307 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Installs kapps containing a helm chart by running helm directly, so
+// chart-only kapps don't need a Makefile
+type HelmInstaller struct {
+	provider provider.Provider
+}
+
+// todo - make configurable
+const HELM_PATH = "helm"
+
+// Env vars set by the default kapp interfaces that the helm installer uses
+const NAMESPACE_ENV_VAR = "NAMESPACE"
+const RELEASE_ENV_VAR = "RELEASE"
+const KUBE_CONTEXT_ENV_VAR = "KUBE_CONTEXT"
+const KUBECONFIG_ENV_VAR = "KUBECONFIG"
+
+// Settings for a helm command
+type helmRelease struct {
+	release     string
+	namespace   string
+	kubeContext string
+	chartDir    string
+	// args passing values files, e.g. `-f values-dev.yaml`
+	valuesArgs []string
+	// values set on the command line
+	params []string
+}
+
+// Returns the args to install or upgrade a release. Unapproved runs only
+// show what would change, with the helm-diff plugin if it's installed.
+func (r helmRelease) installArgs(approved bool, diffPlugin bool) []string {
+	args := []string{"upgrade", "--install"}
+	if !approved && diffPlugin {
+		args = []string{"diff", "upgrade", "--allow-unreleased"}
+	}
+
+	args = append(args, r.release, r.chartDir)
+
+	if r.namespace != "" {
+		args = append(args, "--namespace", r.namespace)
+	}
+
+	args = append(args, r.kubeContextArgs()...)
+	args = append(args, r.valuesArgs...)
+
+	for _, param := range r.params {
+		args = append(args, "--set", param)
+	}
+
+	if !approved && !diffPlugin {
+		args = append(args, "--dry-run")
+	}
+
+	return args
+}
+
+// Returns the args to delete a release
+func (r helmRelease) destroyArgs(approved bool) []string {
+	args := []string{"delete", "--purge", r.release}
+	args = append(args, r.kubeContextArgs()...)
+
+	if !approved {
+		args = append(args, "--dry-run")
+	}
+
+	return args
+}
+
+func (r helmRelease) kubeContextArgs() []string {
+	if r.kubeContext == "" {
+		return []string{}
+	}
+
+	return []string{"--kube-context", r.kubeContext}
+}
+
+// Returns the directory of the kapp's chart. It's an error if there isn't
+// exactly one.
+func findChart(kappObj *kapp.Kapp) (string, error) {
+	dirs, err := searchDirs(kappObj)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	chartPaths := make([]string, 0)
+	for _, dir := range dirs {
+		paths, err := findFilesByPattern(dir, "(^|/)Chart.yaml$", true, true)
+		if err != nil {
+			return "", errors.Wrapf(err, "Error finding chart in '%s'", dir)
+		}
+
+		chartPaths = append(chartPaths, paths...)
+	}
+
+	chartDirs := make([]string, 0)
+	for _, chartPath := range chartPaths {
+		chartDirs = append(chartDirs, filepath.Dir(chartPath))
+	}
+
+	// ignore subcharts vendored inside other charts
+	chartDirs = topLevelDirs(chartDirs)
+
+	if len(chartDirs) == 0 {
+		return "", errors.New(fmt.Sprintf("No helm chart found for kapp '%s' "+
+			"in '%s'", kappObj.Id, strings.Join(dirs, "', '")))
+	}
+
+	if len(chartDirs) > 1 {
+		return "", errors.New(fmt.Sprintf("Multiple helm charts found for "+
+			"kapp '%s': %s. Set 'search_paths' in the kapp's '%s' settings to "+
+			"choose one", kappObj.Id, strings.Join(chartDirs, ", "),
+			kapp.INSTALLER_KEY))
+	}
+
+	return chartDirs[0], nil
+}
+
+// Filters out directories that are inside another of the directories
+func topLevelDirs(dirs []string) []string {
+	topLevel := make([]string, 0)
+
+	for _, dir := range dirs {
+		nested := false
+		for _, other := range dirs {
+			if other != dir && strings.HasPrefix(dir, other+string(filepath.Separator)) {
+				nested = true
+				break
+			}
+		}
+
+		if !nested {
+			topLevel = append(topLevel, dir)
+		}
+	}
+
+	return topLevel
+}
+
+// Returns the release to install a kapp as, using the env vars the default
+// kapp interfaces generate
+func (i HelmInstaller) release(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool) (*helmRelease, map[string]string, error) {
+
+	chartDir, err := findChart(kappObj)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	envVars, parameterisers, err := parameteriseKapp(kappObj, stackConfig,
+		i.provider, approved)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	release := helmRelease{
+		release:     envVars[RELEASE_ENV_VAR],
+		namespace:   envVars[NAMESPACE_ENV_VAR],
+		kubeContext: envVars[KUBE_CONTEXT_ENV_VAR],
+		chartDir:    chartDir,
+		valuesArgs:  []string{},
+		params:      installerParams(kappObj),
+	}
+
+	if release.release == "" {
+		release.release = kappObj.Id
+	}
+
+	for _, parameteriser := range parameterisers {
+		if parameteriser.Name != IMPLEMENTS_HELM {
+			continue
+		}
+
+		argValues, err := parameteriser.GetCliArgValues(validPatternMatches(stackConfig))
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		for _, arg := range parameteriser.config.Params.CliArgs {
+			release.valuesArgs = append(release.valuesArgs, argValues[arg.Name]...)
+		}
+	}
+
+	return &release, envVars, nil
+}
+
+// Returns whether the helm-diff plugin is installed
+func hasDiffPlugin() bool {
+	return exec.Command(HELM_PATH, "diff", "version").Run() == nil
+}
+
+// Runs helm with the given args
+func (i HelmInstaller) run(ctx context.Context, args []string, kappObj *kapp.Kapp,
+	envVars map[string]string, dryRun bool, output io.Writer) error {
+
+	err := checkRequiredEnvVars(kappObj, envVars)
+	if err != nil {
+		if !dryRun {
+			return errors.WithStack(err)
+		}
+		log.Warnf("Dry run. Running helm would fail: %s", err)
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+
+	helmCmd := exec.Command(HELM_PATH, args...)
+	helmCmd.Dir = kappObj.RootDir
+	helmCmd.Env = commandEnv(envVars)
+	helmCmd.Stdout = io.MultiWriter(&stdoutBuf, output)
+	helmCmd.Stderr = io.MultiWriter(&stderrBuf, output)
+
+	if dryRun {
+		log.Infof("Dry run. Would run helm for kapp '%s' with args: %s",
+			kappObj.Id, strings.Join(args, " "))
+		return nil
+	}
+
+	log.Debugf("Running helm for kapp '%s' with command: %#v", kappObj.Id, helmCmd)
+
+	err = runCommand(ctx, helmCmd)
+	if err != nil {
+		return errors.Wrapf(err, "Error running helm for kapp '%s' with "+
+			"args: %s. -- Stdout -- %s -- Stderr -- %s", kappObj.Id,
+			strings.Join(args, " "), stdoutBuf.String(), stderrBuf.String())
+	}
+
+	return nil
+}
+
+// Install or upgrade a kapp's chart
+func (i HelmInstaller) install(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
+
+	release, envVars, err := i.release(kappObj, stackConfig, approved)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	diffPlugin := false
+	if !approved && !dryRun {
+		diffPlugin = hasDiffPlugin()
+	}
+
+	err = i.run(ctx, release.installArgs(approved, diffPlugin), kappObj,
+		envVars, dryRun, output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if approved && !dryRun {
+		log.Infof("Kapp '%s' successfully installed as release '%s'",
+			kappObj.Id, release.release)
+	}
+
+	return nil
+}
+
+// Delete a kapp's release
+func (i HelmInstaller) destroy(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
+
+	release, envVars, err := i.release(kappObj, stackConfig, approved)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = i.run(ctx, release.destroyArgs(approved), kappObj, envVars, dryRun, output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if approved && !dryRun {
+		log.Infof("Kapp '%s' successfully destroyed", kappObj.Id)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHelmInstallArgs(t *testing.T) {
+	release := helmRelease{
+		release:     "wordpress",
+		namespace:   "sites",
+		kubeContext: "dev1",
+		chartDir:    "/cache/wordpress/wordpress",
+		valuesArgs:  []string{"-f", "values-dev.yaml"},
+		params:      []string{"replicas=2"},
+	}
+
+	tests := []struct {
+		name         string
+		desc         string
+		approved     bool
+		diffPlugin   bool
+		expectValues []string
+	}{
+		{
+			name:     "approved",
+			desc:     "check approved runs install or upgrade the release",
+			approved: true,
+			expectValues: []string{"upgrade", "--install", "wordpress",
+				"/cache/wordpress/wordpress", "--namespace", "sites",
+				"--kube-context", "dev1", "-f", "values-dev.yaml", "--set", "replicas=2"},
+		},
+		{
+			name: "unapproved",
+			desc: "check unapproved runs are dry runs",
+			expectValues: []string{"upgrade", "--install", "wordpress",
+				"/cache/wordpress/wordpress", "--namespace", "sites",
+				"--kube-context", "dev1", "-f", "values-dev.yaml", "--set", "replicas=2",
+				"--dry-run"},
+		},
+		{
+			name:       "unapproved_diff",
+			desc:       "check unapproved runs use helm-diff if it's installed",
+			diffPlugin: true,
+			expectValues: []string{"diff", "upgrade", "--allow-unreleased", "wordpress",
+				"/cache/wordpress/wordpress", "--namespace", "sites",
+				"--kube-context", "dev1", "-f", "values-dev.yaml", "--set", "replicas=2"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectValues, release.installArgs(test.approved, test.diffPlugin),
+			"unexpected args for %s", test.name)
+	}
+
+	assert.Equal(t, []string{"delete", "--purge", "wordpress", "--kube-context",
+		"dev1", "--dry-run"}, release.destroyArgs(false))
+}
+
+func TestFindChart(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "helm-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	kappDir, err := filepath.EvalSymlinks(tempDir)
+	assert.Nil(t, err)
+
+	kappObj := &kapp.Kapp{Id: "wordpress", RootDir: kappDir}
+
+	_, err = findChart(kappObj)
+	assert.NotNil(t, err)
+
+	// subcharts aren't candidates
+	for _, path := range []string{"wordpress/Chart.yaml", "wordpress/charts/mariadb/Chart.yaml"} {
+		err = os.MkdirAll(filepath.Join(kappDir, filepath.Dir(path)), 0755)
+		assert.Nil(t, err)
+		err = ioutil.WriteFile(filepath.Join(kappDir, path), []byte{}, 0644)
+		assert.Nil(t, err)
+	}
+
+	chartDir, err := findChart(kappObj)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(kappDir, "wordpress"), chartDir)
+
+	err = os.MkdirAll(filepath.Join(kappDir, "nginx"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(kappDir, "nginx/Chart.yaml"), []byte{}, 0644)
+	assert.Nil(t, err)
+
+	_, err = findChart(kappObj)
+	assert.NotNil(t, err)
+
+	// search paths can disambiguate
+	kappObj.InstallerConfig.SearchPaths = []string{"nginx"}
+	chartDir, err = findChart(kappObj)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(kappDir, "nginx"), chartDir)
+}
@@ -17,20 +17,148 @@
 package installer
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
 	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// Installers should stop gracefully when their context is cancelled, and
+// write the output of any commands they run to `output`
 type Installer interface {
-	install(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig, approved bool, dryRun bool) error
-	destroy(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig, approved bool, dryRun bool) error
+	install(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+		approved bool, dryRun bool, output io.Writer) error
+	destroy(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+		approved bool, dryRun bool, output io.Writer) error
 }
 
 // implemented installers
 const MAKE = "make"
+const HELM = "helm"
+const KUBECTL = "kubectl"
+const TERRAFORM = "terraform"
+
+// Env var giving kapps the path to export terraform plans to as JSON (e.g.
+// with 'terraform show -json') when they're run unapproved
+const TF_PLAN_JSON_ENV_VAR = "TF_PLAN_JSON"
+
+// Name of the file kapps should export terraform plan JSON to, in the cache
+// dir in their root dir
+const TERRAFORM_PLAN_FILE = "terraform-plan.json"
+
+// Returns the path kapps should export terraform plan JSON to
+func TerraformPlanPath(kappRootDir string) string {
+	return filepath.Join(kappRootDir, cacher.CACHE_DIR, TERRAFORM_PLAN_FILE)
+}
+
+// Returns the env vars to run a kapp's installer with along with the
+// parameterisers for the interfaces the kapp implements
+func parameteriseKapp(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	installerProvider provider.Provider, approved bool) (map[string]string, []Parameteriser, error) {
+
+	absKappRoot, err := filepath.Abs(kappObj.RootDir)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	// create the env vars
+	envVars := map[string]string{
+		"KAPP_ROOT": absKappRoot,
+		"APPROVED":  fmt.Sprintf("%v", approved),
+		"CLUSTER":   stackConfig.Cluster,
+		"PROFILE":   stackConfig.Profile,
+		"PROVIDER":  stackConfig.Provider,
+		// where kapps should write their outputs to
+		OUTPUTS_JSON_ENV_VAR: OutputsPath(absKappRoot),
+	}
+
+	providerImpl, err := provider.NewProvider(stackConfig)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	parameteriserConfig, err := loadParameteriserConfig(stackConfig)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	parameterisers, err := identifyKappInterfaces(kappObj, parameteriserConfig)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	// Adds things like `KUBE_CONTEXT`, `NAMESPACE`, `RELEASE`, etc.
+	for _, parameteriser := range parameterisers {
+		// where kapps using terraform should export their plans to
+		if parameteriser.Name == IMPLEMENTS_TERRAFORM {
+			envVars[TF_PLAN_JSON_ENV_VAR] = TerraformPlanPath(absKappRoot)
+		}
+
+		pEnvVars, err := parameteriser.GetEnvVars(provider.GetVars(providerImpl))
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		for k, v := range pEnvVars {
+			envVars[k] = v
+		}
+	}
+
+	// Provider-specific env vars, e.g. the AwsProvider adds REGION
+	for k, v := range provider.GetInstallerVars(installerProvider) {
+		upperKey := strings.ToUpper(k)
+		envVars[upperKey] = fmt.Sprintf("%#v", v)
+	}
+
+	return envVars, parameterisers, nil
+}
+
+// Returns the values that capturing groups in CLI arg patterns may match,
+// e.g. so only `values-<profile>.yaml` files for the stack's profile are used
+func validPatternMatches(stackConfig *kapp.StackConfig) []string {
+	return []string{
+		stackConfig.Cluster,
+		stackConfig.Profile,
+		stackConfig.Provider,
+	}
+}
+
+// Returns the extra params for a kapp's installer from its manifest or
+// descriptor as sorted `key=value` strings
+func installerParams(kappObj *kapp.Kapp) []string {
+	params := kappObj.MergedInstallerConfig().Params
+
+	names := make([]string, 0)
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	strParams := make([]string, 0)
+	for _, name := range names {
+		strParams = append(strParams, strings.Join([]string{name, params[name]}, "="))
+	}
+
+	return strParams
+}
+
+// Returns the user's env vars with the given ones added
+func commandEnv(envVars map[string]string) []string {
+	strEnvVars := os.Environ()
+	for k, v := range envVars {
+		strEnvVars = append(strEnvVars, strings.Join([]string{k, v}, "="))
+	}
+
+	return strEnvVars
+}
 
 // Factory that creates installers
 func NewInstaller(name string, providerImpl provider.Provider) (Installer, error) {
@@ -40,19 +168,37 @@ func NewInstaller(name string, providerImpl provider.Provider) (Installer, error
 		}, nil
 	}
 
+	if name == HELM {
+		return HelmInstaller{
+			provider: providerImpl,
+		}, nil
+	}
+
+	if name == KUBECTL {
+		return KubectlInstaller{
+			provider: providerImpl,
+		}, nil
+	}
+
+	if name == TERRAFORM {
+		return TerraformInstaller{
+			provider: providerImpl,
+		}, nil
+	}
+
 	return nil, errors.New(fmt.Sprintf("Installer '%s' doesn't exist", name))
 }
 
 // Installs a kapp by delegating to an Installer implementation
-func Install(i Installer, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
-	approved bool, dryRun bool) error {
+func Install(ctx context.Context, i Installer, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
 	log.Infof("Installing kapp '%s'...", kappObj.Id)
-	return i.install(kappObj, stackConfig, approved, dryRun)
+	return i.install(ctx, kappObj, stackConfig, approved, dryRun, output)
 }
 
 // Destroys a kapp by delegating to an Installer implementation
-func Destroy(i Installer, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
-	approved bool, dryRun bool) error {
+func Destroy(ctx context.Context, i Installer, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
 	log.Infof("Destroying kapp '%s'...", kappObj.Id)
-	return i.destroy(kappObj, stackConfig, approved, dryRun)
+	return i.destroy(ctx, kappObj, stackConfig, approved, dryRun, output)
 }
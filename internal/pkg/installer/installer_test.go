@@ -0,0 +1,91 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParameteriseKapp(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "installer-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	clusterDir := filepath.Join(tempDir, "vars/local/profiles/local/clusters/standard")
+	err = os.MkdirAll(clusterDir, 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(clusterDir, "values.yaml"),
+		[]byte("kube_context: standard\n"), 0644)
+	assert.Nil(t, err)
+
+	stackConfig := &kapp.StackConfig{
+		FilePath:      filepath.Join(tempDir, "stacks.yaml"),
+		Provider:      "local",
+		Profile:       "local",
+		Cluster:       "standard",
+		VarsFilesDirs: []string{"vars"},
+	}
+
+	providerImpl, err := provider.NewProvider(stackConfig)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name            string
+		desc            string
+		dirs            []string
+		expectTfPlanVar bool
+	}{
+		{
+			name: "chart",
+			desc: "kapps not using terraform shouldn't be told where to export plans",
+			dirs: []string{"chart"},
+		},
+		{
+			name:            "terraform",
+			desc:            "kapps implementing the terraform interface should be told where to export plans",
+			dirs:            []string{"terraform"},
+			expectTfPlanVar: true,
+		},
+	}
+
+	for _, test := range tests {
+		kappDir := filepath.Join(tempDir, "cache", test.name)
+		for _, dir := range test.dirs {
+			err = os.MkdirAll(filepath.Join(kappDir, dir), 0755)
+			assert.Nil(t, err)
+		}
+
+		kappObj := &kapp.Kapp{Id: test.name, RootDir: kappDir}
+		envVars, _, err := parameteriseKapp(kappObj, stackConfig, providerImpl, false)
+		assert.Nil(t, err, "unexpected error for test %s", test.name)
+
+		assert.Equal(t, OutputsPath(kappDir), envVars[OUTPUTS_JSON_ENV_VAR])
+		assert.Equal(t, "standard", envVars["KUBE_CONTEXT"])
+
+		tfPlanPath, ok := envVars[TF_PLAN_JSON_ENV_VAR]
+		assert.Equal(t, test.expectTfPlanVar, ok, "test %s: %s", test.name, test.desc)
+		if test.expectTfPlanVar {
+			assert.Equal(t, TerraformPlanPath(kappDir), tfPlanPath)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Code generated by gen_kapp_interfaces.go from ../../../configs/kapp_interfaces.yaml. DO NOT EDIT.
+
+package installer
+
+// The default kapp interfaces
+const defaultParameteriserConfig = `# different things a kapp might contain. A kapp may 'implement' multiple
+# interfaces (e.g. contain both a helm chart and terraform configs)
+kapp_interfaces:
+  k8s:      # no heuristics, so all kapps implement it
+    params:
+      env:
+      - name: KUBE_CONTEXT
+        value:
+          type: env         # use the env var if it's set...
+          key: KUBE_CONTEXT
+          fallback:         # ...or the provider var if it isn't
+            type: vars_lookup
+            key: kube_context
+      - name: KUBECONFIG
+        value:
+          type: env
+          key: KUBECONFIG
+          fallback:
+            type: literal
+            value: ~/.kube/config
+
+  helm:
+    heuristics:     # inspections we can carry out on a kapp to see what it contains
+    - file:
+        pattern: Chart.yaml   # regex to search for under the kapp root dir
+    params:
+      env:
+      - name: NAMESPACE
+        value:
+          type: obj_field
+          path: kapp
+          key: Id
+      - name: RELEASE
+        value:
+          type: obj_field
+          path: kapp
+          key: Id
+      - name: HOSTED_ZONE   # only set if the var exists
+        value:
+          type: vars_lookup
+          key: hosted_zone
+      cliArgs:
+      - name: helm-opts
+        components:
+        - key: -f
+          value:
+            pattern: values-(\w*).yaml
+
+  terraform:
+    heuristics:
+    - file:
+        pattern: terraform
+    params:
+      cliArgs:
+      - name: tf-opts
+        components:         # by default collapse multiple values into a
+        - key: -var-file    # single CLI arg
+          value:
+            pattern: vars/(\w+).tfvars
+`
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Installs kapps made of plain Kubernetes resources or kustomizations by
+// applying the resources listed in their descriptor with kubectl
+type KubectlInstaller struct {
+	provider provider.Provider
+}
+
+// todo - make configurable
+const KUBECTL_PATH = "kubectl"
+
+// Files that make a directory a kustomization
+var kustomizationFiles = []string{"kustomization.yaml", "kustomization.yml",
+	"Kustomization"}
+
+// Exit code of `kubectl diff` when there are differences
+const KUBECTL_DIFF_FOUND = 1
+
+// Returns the args to select a resource path, i.e. `-k` for kustomization
+// directories and `-f` for anything else
+func resourceArgs(kappRootDir string, resource string) ([]string, error) {
+	path := filepath.Join(kappRootDir, resource)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Resource '%s' doesn't exist", resource)
+	}
+
+	if info.IsDir() {
+		for _, kustomizationFile := range kustomizationFiles {
+			if _, err := os.Stat(filepath.Join(path, kustomizationFile)); err == nil {
+				return []string{"-k", path}, nil
+			}
+		}
+	}
+
+	return []string{"-f", path}, nil
+}
+
+// Returns the args to apply a resource. Unapproved runs diff it against the
+// cluster instead, which does a server-side dry run.
+func applyArgs(resourceArgs []string, kubeContext string, approved bool) []string {
+	command := "apply"
+	if !approved {
+		command = "diff"
+	}
+
+	return append(append([]string{command}, contextArgs(kubeContext)...),
+		resourceArgs...)
+}
+
+// Returns the args to delete a resource. Unapproved runs list the resources
+// that would be deleted instead.
+func deleteArgs(resourceArgs []string, kubeContext string, approved bool) []string {
+	command := "delete"
+	if !approved {
+		command = "get"
+	}
+
+	args := append([]string{command}, contextArgs(kubeContext)...)
+	args = append(args, "--ignore-not-found")
+	return append(args, resourceArgs...)
+}
+
+func contextArgs(kubeContext string) []string {
+	if kubeContext == "" {
+		return []string{}
+	}
+
+	return []string{"--context", kubeContext}
+}
+
+// Returns the resources the kapp declares, or an error if it doesn't declare any
+func declaredResources(kappObj *kapp.Kapp) ([]string, error) {
+	if kappObj.Descriptor == nil || len(kappObj.Descriptor.Resources) == 0 {
+		return nil, errors.New(fmt.Sprintf("Kapp '%s' doesn't declare any "+
+			"resources for kubectl to apply in its '%s' file", kappObj.Id,
+			kapp.DESCRIPTOR_FILE))
+	}
+
+	return kappObj.Descriptor.Resources, nil
+}
+
+// Runs kubectl once per resource, building the args for each with `argsFunc`
+func (i KubectlInstaller) run(ctx context.Context, resources []string,
+	argsFunc func(resourceArgs []string, kubeContext string) []string,
+	kappObj *kapp.Kapp, stackConfig *kapp.StackConfig, approved bool,
+	dryRun bool, output io.Writer) error {
+
+	envVars, _, err := parameteriseKapp(kappObj, stackConfig, i.provider, approved)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = checkRequiredEnvVars(kappObj, envVars)
+	if err != nil {
+		if !dryRun {
+			return errors.WithStack(err)
+		}
+		log.Warnf("Dry run. Running kubectl would fail: %s", err)
+	}
+
+	for _, resource := range resources {
+		resArgs, err := resourceArgs(kappObj.RootDir, resource)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid resource for kapp '%s'", kappObj.Id)
+		}
+
+		args := argsFunc(resArgs, envVars[KUBE_CONTEXT_ENV_VAR])
+
+		if dryRun {
+			log.Infof("Dry run. Would run kubectl for kapp '%s' with args: %s",
+				kappObj.Id, strings.Join(args, " "))
+			continue
+		}
+
+		var stdoutBuf, stderrBuf bytes.Buffer
+
+		kubectlCmd := exec.Command(KUBECTL_PATH, args...)
+		kubectlCmd.Dir = kappObj.RootDir
+		kubectlCmd.Env = commandEnv(envVars)
+		kubectlCmd.Stdout = io.MultiWriter(&stdoutBuf, output)
+		kubectlCmd.Stderr = io.MultiWriter(&stderrBuf, output)
+
+		log.Debugf("Running kubectl for kapp '%s' with command: %#v",
+			kappObj.Id, kubectlCmd)
+
+		err = runCommand(ctx, kubectlCmd)
+		if err != nil {
+			// differences aren't an error when diffing
+			if args[0] == "diff" && exitStatus(err) == KUBECTL_DIFF_FOUND {
+				continue
+			}
+
+			return errors.Wrapf(err, "Error running kubectl for kapp '%s' "+
+				"with args: %s. -- Stdout -- %s -- Stderr -- %s", kappObj.Id,
+				strings.Join(args, " "), stdoutBuf.String(), stderrBuf.String())
+		}
+	}
+
+	return nil
+}
+
+// Apply a kapp's resources in the order they're declared
+func (i KubectlInstaller) install(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
+
+	resources, err := declaredResources(kappObj)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = i.run(ctx, resources, func(resourceArgs []string, kubeContext string) []string {
+		return applyArgs(resourceArgs, kubeContext, approved)
+	}, kappObj, stackConfig, approved, dryRun, output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if approved && !dryRun {
+		log.Infof("Kapp '%s' successfully installed", kappObj.Id)
+	}
+
+	return nil
+}
+
+// Delete a kapp's resources in the reverse order they're declared
+func (i KubectlInstaller) destroy(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
+
+	resources, err := declaredResources(kappObj)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	reversed := make([]string, 0)
+	for j := len(resources) - 1; j >= 0; j-- {
+		reversed = append(reversed, resources[j])
+	}
+
+	err = i.run(ctx, reversed, func(resourceArgs []string, kubeContext string) []string {
+		return deleteArgs(resourceArgs, kubeContext, approved)
+	}, kappObj, stackConfig, approved, dryRun, output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if approved && !dryRun {
+		log.Infof("Kapp '%s' successfully destroyed", kappObj.Id)
+	}
+
+	return nil
+}
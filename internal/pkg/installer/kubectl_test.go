@@ -0,0 +1,106 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKubectlArgs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "kubectl-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	for _, path := range []string{"deployment.yaml", "overlays/dev/kustomization.yaml",
+		"crds/crd.yaml"} {
+		err = os.MkdirAll(filepath.Join(tempDir, filepath.Dir(path)), 0755)
+		assert.Nil(t, err)
+		err = ioutil.WriteFile(filepath.Join(tempDir, path), []byte{}, 0644)
+		assert.Nil(t, err)
+	}
+
+	tests := []struct {
+		name          string
+		desc          string
+		resource      string
+		approved      bool
+		install       bool
+		expectValues  []string
+		expectedError bool
+	}{
+		{
+			name:     "apply_file",
+			desc:     "check files are applied",
+			resource: "deployment.yaml",
+			approved: true,
+			install:  true,
+			expectValues: []string{"apply", "--context", "dev1", "-f",
+				filepath.Join(tempDir, "deployment.yaml")},
+		},
+		{
+			name:     "diff_dir",
+			desc:     "check unapproved runs diff directories of resources",
+			resource: "crds",
+			install:  true,
+			expectValues: []string{"diff", "--context", "dev1", "-f",
+				filepath.Join(tempDir, "crds")},
+		},
+		{
+			name:     "delete_kustomization",
+			desc:     "check kustomizations are deleted with -k",
+			resource: "overlays/dev",
+			approved: true,
+			expectValues: []string{"delete", "--context", "dev1", "--ignore-not-found",
+				"-k", filepath.Join(tempDir, "overlays/dev")},
+		},
+		{
+			name:     "get_kustomization",
+			desc:     "check unapproved destroys list what would be deleted",
+			resource: "overlays/dev",
+			expectValues: []string{"get", "--context", "dev1", "--ignore-not-found",
+				"-k", filepath.Join(tempDir, "overlays/dev")},
+		},
+		{
+			name:          "missing",
+			desc:          "check declared resources must exist",
+			resource:      "service.yaml",
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		resArgs, err := resourceArgs(tempDir, test.resource)
+		if test.expectedError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+			continue
+		}
+		assert.Nil(t, err, "unexpected error for %s", test.name)
+
+		var args []string
+		if test.install {
+			args = applyArgs(resArgs, "dev1", test.approved)
+		} else {
+			args = deleteArgs(resArgs, "dev1", test.approved)
+		}
+
+		assert.Equal(t, test.expectValues, args, "unexpected args for %s", test.name)
+	}
+}
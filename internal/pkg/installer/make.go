@@ -18,14 +18,17 @@ package installer
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -35,144 +38,237 @@ type MakeInstaller struct {
 	stackConfigVars provider.Values
 }
 
+const MAKEFILE = "Makefile"
+
 const TARGET_INSTALL = "install"
 const TARGET_DESTROY = "destroy"
 
 // Run the given make target
-func (i MakeInstaller) run(makeTarget string, kappObj *kapp.Kapp,
-	stackConfig *kapp.StackConfig, approved bool, dryRun bool) error {
-
-	// search for the Makefile
-	makefilePaths, err := findFilesByPattern(kappObj.RootDir, "Makefile",
-		true, false)
-	if err != nil {
-		return errors.Wrapf(err, "Error finding Makefile in '%s'",
-			kappObj.RootDir)
-	}
-
-	if len(makefilePaths) == 0 {
-		return errors.New(fmt.Sprintf("No makefile found for kapp '%s' "+
-			"in '%s'", kappObj.Id, kappObj.RootDir))
-	}
-	if len(makefilePaths) > 1 {
-		// todo - select the right makefile from the installerConfig if it exists,
-		// then remove this panic
-		panic(fmt.Sprintf("Multiple Makefiles found. Disambiguation "+
-			"not implemented yet: %s", strings.Join(makefilePaths, ", ")))
-	}
+func (i MakeInstaller) run(ctx context.Context, makeTarget string, kappObj *kapp.Kapp,
+	stackConfig *kapp.StackConfig, approved bool, dryRun bool, output io.Writer) error {
 
-	makefilePath, err := filepath.Abs(makefilePaths[0])
+	makefilePath, err := findMakefile(kappObj)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	absKappRoot, err := filepath.Abs(kappObj.RootDir)
+	envVars, parameterisers, err := parameteriseKapp(kappObj, stackConfig,
+		i.provider, approved)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	// create the env vars
-	envVars := map[string]string{
-		"KAPP_ROOT": absKappRoot,
-		"APPROVED":  fmt.Sprintf("%v", approved),
-		"CLUSTER":   stackConfig.Cluster,
-		"PROFILE":   stackConfig.Profile,
-		"PROVIDER":  stackConfig.Provider,
+	// outputs of other kapps are namespaced so they can't clash with ours
+	for k, v := range kappObj.Inputs {
+		envVars[k] = v
 	}
 
-	providerImpl, err := provider.NewProvider(stackConfig)
+	err = checkRequiredEnvVars(kappObj, envVars)
 	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	parameterisers, err := identifyKappInterfaces(kappObj)
-	if err != nil {
-		return errors.WithStack(err)
+		if !dryRun {
+			return errors.WithStack(err)
+		}
+		log.Warnf("Dry run. Installing would fail: %s", err)
 	}
 
-	// Adds things like `KUBE_CONTEXT`, `NAMESPACE`, `RELEASE`, etc.
+	// get additional CLI args
+	cliArgs := []string{makeTarget}
 	for _, parameteriser := range parameterisers {
-		pEnvVars, err := parameteriser.GetEnvVars(provider.GetVars(providerImpl))
+		args, err := parameteriser.GetCliArgs(validPatternMatches(stackConfig))
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		for k, v := range pEnvVars {
-			envVars[k] = v
+		cliArgs = append(cliArgs, args...)
+	}
+
+	// extra params from the manifest or descriptor override the others
+	cliArgs = append(cliArgs, installerParams(kappObj)...)
+
+	// build the command
+	var stdoutBuf, stderrBuf bytes.Buffer
+
+	// make command, optionally run in a container so kapps can pin the
+	// versions of the tools they use
+	var makeCmd *exec.Cmd
+	makefileDir := filepath.Dir(makefilePath)
+
+	image := containerImage(kappObj, stackConfig)
+	if image != "" {
+		makeCmd, err = containerisedCommand(image, kappObj, stackConfig,
+			makefileDir, envVars, append([]string{"make"}, cliArgs...))
+		if err != nil {
+			return errors.Wrapf(err, "Error building command to run kapp "+
+				"'%s' in image '%s'", kappObj.Id, image)
 		}
+	} else {
+		makeCmd = exec.Command("make", cliArgs...)
+		// add our env vars to the user's existing env vars
+		makeCmd.Env = commandEnv(envVars)
 	}
 
-	// Provider-specific env vars, e.g. the AwsProvider adds REGION
-	for k, v := range provider.GetInstallerVars(i.provider) {
-		upperKey := strings.ToUpper(k)
-		envVars[upperKey] = fmt.Sprintf("%#v", v)
+	makeCmd.Dir = makefileDir
+	makeCmd.Stdout = io.MultiWriter(&stdoutBuf, output)
+	makeCmd.Stderr = io.MultiWriter(&stderrBuf, output)
+
+	if dryRun {
+		log.Infof("Dry run. Would run make target '%s' for kapp '%s' in "+
+			"directory '%s' with command: %#v", makeTarget, kappObj.Id,
+			makeCmd.Dir, makeCmd)
+	} else {
+		// run it
+		log.Debugf("Running make target '%s' for kapp '%s' in directory '%s' "+
+			"with command: %#v", makeTarget, kappObj.Id, makeCmd.Dir, makeCmd)
+		log.Infof("Running make target '%s' for kapp '%s'...", makeTarget,
+			kappObj.Id)
+
+		err := runCommand(ctx, makeCmd)
+		if err != nil {
+			return errors.Wrapf(err, "Error running make target '%s' for kapp "+
+				"'%s' with command: %#v. -- Stdout -- %s -- Stderr -- %s, Err: %s",
+				makeTarget, kappObj.Id, makeCmd, stdoutBuf.String(),
+				stderrBuf.String(), err)
+		}
 	}
 
-	// add our env vars to the user's existing env vars
-	strEnvVars := os.Environ()
-	for k, v := range envVars {
-		strEnvVars = append(strEnvVars, strings.Join([]string{k, v}, "="))
+	return nil
+}
+
+// Returns the path to the Makefile to run for a kapp. Kapps containing several
+// Makefiles (e.g. because they pull in shared makefiles) must say which to use,
+// or set search paths that only contain one.
+func findMakefile(kappObj *kapp.Kapp) (string, error) {
+	config := kappObj.MergedInstallerConfig()
+
+	if config.Makefile != "" {
+		makefilePath := filepath.Join(kappObj.RootDir, config.Makefile)
+
+		info, err := os.Stat(makefilePath)
+		if err == nil && info.IsDir() {
+			makefilePath = filepath.Join(makefilePath, MAKEFILE)
+			_, err = os.Stat(makefilePath)
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "Makefile '%s' configured for kapp "+
+				"'%s' doesn't exist", config.Makefile, kappObj.Id)
+		}
+
+		absMakefilePath, err := filepath.Abs(makefilePath)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		return absMakefilePath, nil
 	}
 
-	// get additional CLI args
-	validPatternMatches := []string{
-		stackConfig.Cluster,
-		stackConfig.Profile,
-		stackConfig.Provider,
+	dirs, err := searchDirs(kappObj)
+	if err != nil {
+		return "", errors.WithStack(err)
 	}
 
-	cliArgs := []string{makeTarget}
-	for _, parameteriser := range parameterisers {
-		arg, err := parameteriser.GetCliArgs(validPatternMatches)
+	// dedupe paths since search paths may overlap
+	found := make(map[string]bool)
+	makefilePaths := make([]string, 0)
+
+	for _, dir := range dirs {
+		paths, err := findFilesByPattern(dir, "(^|/)"+MAKEFILE+"$", true, false)
 		if err != nil {
-			return errors.WithStack(err)
+			return "", errors.Wrapf(err, "Error finding Makefile in '%s'", dir)
 		}
 
-		if arg != "" {
-			cliArgs = append(cliArgs, arg)
+		for _, path := range paths {
+			if !found[path] {
+				found[path] = true
+				makefilePaths = append(makefilePaths, path)
+			}
 		}
 	}
 
-	// build the command
-	var stdoutBuf, stderrBuf bytes.Buffer
+	if len(makefilePaths) == 0 {
+		return "", errors.New(fmt.Sprintf("No makefile found for kapp '%s' "+
+			"in '%s'", kappObj.Id, strings.Join(dirs, "', '")))
+	}
 
-	// make command
-	makeCmd := exec.Command("make", cliArgs...)
-	makeCmd.Dir = filepath.Dir(makefilePath)
-	makeCmd.Env = strEnvVars
-	makeCmd.Stdout = &stdoutBuf
-	makeCmd.Stderr = &stderrBuf
+	if len(makefilePaths) > 1 {
+		sort.Strings(makefilePaths)
+		return "", errors.New(fmt.Sprintf("Multiple Makefiles found for kapp "+
+			"'%s': %s. Set 'makefile' or 'search_paths' in the kapp's '%s' "+
+			"settings in its manifest or in its '%s' file to choose one",
+			kappObj.Id, strings.Join(makefilePaths, ", "), kapp.INSTALLER_KEY,
+			kapp.DESCRIPTOR_FILE))
+	}
 
-	if dryRun {
-		log.Infof("Dry run. Would install kapp '%s' in directory '%s' "+
-			"with command: %#v", kappObj.Id, makeCmd.Dir, makeCmd)
-	} else {
-		// run it
-		log.Debugf("Install kapp '%s' in directory '%s' "+
-			"with command: %#v", kappObj.Id, makeCmd.Dir, makeCmd)
-		log.Infof("Installing kapp '%s'...", kappObj.Id)
+	return makefilePaths[0], nil
+}
 
-		err := makeCmd.Run()
+// Install a kapp
+func (i MakeInstaller) install(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
+	// kapps can override the target in their descriptor
+	makeTarget := kappObj.Descriptor.Target(kapp.INSTALL_TARGET_KEY, TARGET_INSTALL)
+	err := i.run(ctx, makeTarget, kappObj, stackConfig, approved, dryRun, output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// kapps can declare a target that writes their outputs once they're
+	// installed
+	outputTarget := kappObj.Descriptor.Target(kapp.OUTPUT_TARGET_KEY, "")
+	if approved && outputTarget != "" {
+		err = i.run(ctx, outputTarget, kappObj, stackConfig, approved, dryRun, output)
 		if err != nil {
-			return errors.Wrapf(err, "Error installing kapp '%s' with "+
-				"command: %#v. -- Stdout -- %s -- Stderr -- %s, Err: %s", kappObj.Id,
-				makeCmd, stdoutBuf.String(), stderrBuf.String(), err)
-		} else {
-			log.Infof("Kapp '%s' successfully %sed", kappObj.Id, makeTarget)
+			return errors.WithStack(err)
 		}
 	}
 
+	if approved && !dryRun {
+		log.Infof("Kapp '%s' successfully installed", kappObj.Id)
+	}
+
 	return nil
 }
 
-// Install a kapp
-func (i MakeInstaller) install(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
-	approved bool, dryRun bool) error {
-	return i.run(TARGET_INSTALL, kappObj, stackConfig, approved, dryRun)
+// Destroy a kapp
+func (i MakeInstaller) destroy(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
+	makeTarget := kappObj.Descriptor.Target(kapp.DESTROY_TARGET_KEY, TARGET_DESTROY)
+	err := i.run(ctx, makeTarget, kappObj, stackConfig, approved, dryRun, output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if approved && !dryRun {
+		log.Infof("Kapp '%s' successfully destroyed", kappObj.Id)
+	}
+
+	return nil
 }
 
-// Destroy a kapp
-func (i MakeInstaller) destroy(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
-	approved bool, dryRun bool) error {
-	return i.run(TARGET_DESTROY, kappObj, stackConfig, approved, dryRun)
+// Returns an error listing any env vars or secrets a kapp's descriptor
+// requires that are neither set in the environment nor by sugarkube
+func checkRequiredEnvVars(kappObj *kapp.Kapp, envVars map[string]string) error {
+	if kappObj.Descriptor == nil {
+		return nil
+	}
+
+	required := append([]kapp.EnvVar{}, kappObj.Descriptor.EnvVars...)
+	required = append(required, kappObj.Descriptor.Secrets...)
+
+	missing := make([]string, 0)
+	for _, envVar := range required {
+		if _, ok := envVars[envVar.Name]; ok {
+			continue
+		}
+
+		if _, ok := os.LookupEnv(envVar.Name); !ok {
+			missing = append(missing, envVar.Name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.New(fmt.Sprintf("Kapp '%s' requires env vars that "+
+			"aren't set: %s", kappObj.Id, strings.Join(missing, ", ")))
+	}
+
+	return nil
 }
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindMakefile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "make-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	kappDir, err := filepath.EvalSymlinks(tempDir)
+	assert.Nil(t, err)
+
+	// sources are checked out into the cache dir and symlinked into the kapp
+	for _, source := range []string{"wordpress", "common-makefiles"} {
+		sourceDir := filepath.Join(kappDir, ".sugarkube", source)
+		err = os.MkdirAll(sourceDir, 0755)
+		assert.Nil(t, err)
+		err = ioutil.WriteFile(filepath.Join(sourceDir, MAKEFILE), []byte{}, 0644)
+		assert.Nil(t, err)
+		err = os.Symlink(filepath.Join(".sugarkube", source), filepath.Join(kappDir, source))
+		assert.Nil(t, err)
+	}
+
+	// shared makefiles are included, not run
+	err = ioutil.WriteFile(filepath.Join(kappDir, ".sugarkube/common-makefiles/Makefile.helm"),
+		[]byte{}, 0644)
+	assert.Nil(t, err)
+
+	wordpressMakefile := filepath.Join(kappDir, ".sugarkube/wordpress", MAKEFILE)
+
+	tests := []struct {
+		name          string
+		desc          string
+		config        kapp.InstallerConfig
+		descriptor    *kapp.Descriptor
+		expectValues  string
+		expectedError bool
+	}{
+		{
+			name:          "ambiguous",
+			desc:          "check an error is returned instead of guessing",
+			expectedError: true,
+		},
+		{
+			name:         "makefile_path",
+			desc:         "check the Makefile can be given as a path",
+			config:       kapp.InstallerConfig{Makefile: "wordpress/Makefile"},
+			expectValues: filepath.Join(kappDir, "wordpress", MAKEFILE),
+		},
+		{
+			name:         "makefile_source",
+			desc:         "check the Makefile can be given as the source containing it",
+			config:       kapp.InstallerConfig{Makefile: "wordpress"},
+			expectValues: filepath.Join(kappDir, "wordpress", MAKEFILE),
+		},
+		{
+			name:          "makefile_missing",
+			desc:          "check configured Makefiles must exist",
+			config:        kapp.InstallerConfig{Makefile: "site1"},
+			expectedError: true,
+		},
+		{
+			name:         "search_paths",
+			desc:         "check only search paths are searched",
+			config:       kapp.InstallerConfig{SearchPaths: []string{"wordpress"}},
+			expectValues: wordpressMakefile,
+		},
+		{
+			name: "descriptor",
+			desc: "check kapps can choose their Makefile in their descriptor",
+			descriptor: &kapp.Descriptor{Installer: kapp.InstallerConfig{
+				SearchPaths: []string{"wordpress"}}},
+			expectValues: wordpressMakefile,
+		},
+	}
+
+	for _, test := range tests {
+		kappObj := &kapp.Kapp{
+			Id:              "wordpress",
+			RootDir:         kappDir,
+			InstallerConfig: test.config,
+			Descriptor:      test.descriptor,
+		}
+
+		result, err := findMakefile(kappObj)
+		if test.expectedError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+			assert.Equal(t, test.expectValues, result, "unexpected result for %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Env var giving kapps the path to write their outputs to as a JSON object
+// (e.g. with 'terraform output -json') when they're installed
+const OUTPUTS_JSON_ENV_VAR = "OUTPUTS_JSON"
+
+// Name of the file kapps should write their outputs to, in the cache dir in
+// their root dir
+const OUTPUTS_FILE = "outputs.json"
+
+// Prefix of env vars other kapps' outputs are passed to installers in
+const OUTPUT_ENV_VAR_PREFIX = "OUTPUT_"
+
+var invalidEnvVarChars = regexp.MustCompile("[^A-Z0-9_]")
+
+// Returns the path kapps should write their outputs to
+func OutputsPath(kappRootDir string) string {
+	return filepath.Join(kappRootDir, cacher.CACHE_DIR, OUTPUTS_FILE)
+}
+
+// Returns the name of the env var a kapp's output is passed to other kapps
+// in, i.e. `OUTPUT_<manifest ID>_<kapp ID>_<output name>` upper-cased with
+// any characters that aren't valid in env var names replaced by underscores
+func OutputEnvVarName(manifestId string, kappId string, name string) string {
+	envVarName := strings.ToUpper(strings.Join([]string{manifestId, kappId, name}, "_"))
+	return OUTPUT_ENV_VAR_PREFIX + invalidEnvVarChars.ReplaceAllString(envVarName, "_")
+}
+
+// Reads the outputs an installed kapp wrote. Kapps can write a JSON object to
+// OutputsPath, and declare outputs in their descriptor that are read from
+// text files. Declared outputs take precedence.
+func KappOutputs(kappObj *kapp.Kapp) (map[string]string, error) {
+	outputs := make(map[string]string)
+
+	data, err := ioutil.ReadFile(OutputsPath(kappObj.RootDir))
+	if err == nil {
+		outputs, err = parseJsonOutputs(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error parsing outputs of kapp '%s'",
+				kappObj.Id)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	if kappObj.Descriptor == nil {
+		return outputs, nil
+	}
+
+	for _, output := range kappObj.Descriptor.Outputs {
+		path := filepath.Join(kappObj.RootDir, output.Path)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Kapp '%s' didn't write output '%s' "+
+				"to '%s'", kappObj.Id, output.Name, path)
+		}
+
+		outputs[output.Name] = strings.TrimSpace(string(data))
+	}
+
+	return outputs, nil
+}
+
+// Parses a JSON object of outputs. Values that aren't strings are kept as
+// JSON. Objects in the format terraform outputs them in (i.e. with 'value',
+// 'type' and 'sensitive' keys) are replaced by their values, and sensitive
+// ones are skipped so secrets aren't recorded in the cache.
+func parseJsonOutputs(data []byte) (map[string]string, error) {
+	parsed := make(map[string]interface{})
+	err := json.Unmarshal(data, &parsed)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	outputs := make(map[string]string)
+
+	for name, value := range parsed {
+		if terraformOutput, ok := value.(map[string]interface{}); ok {
+			if _, ok := terraformOutput["value"]; ok && (len(terraformOutput) == 1 ||
+				terraformOutput["type"] != nil || terraformOutput["sensitive"] != nil) {
+				if terraformOutput["sensitive"] == true {
+					log.Warnf("Not recording sensitive output '%s'", name)
+					continue
+				}
+				value = terraformOutput["value"]
+			}
+		}
+
+		if str, ok := value.(string); ok {
+			outputs[name] = str
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error encoding output '%s'", name)
+		}
+
+		outputs[name] = string(encoded)
+	}
+
+	return outputs, nil
+}
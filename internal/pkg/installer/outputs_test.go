@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseJsonOutputs(t *testing.T) {
+	tests := []struct {
+		name          string
+		desc          string
+		input         string
+		expectValues  map[string]string
+		expectedError bool
+	}{
+		{
+			name:         "plain",
+			desc:         "check strings are kept and other values are encoded as JSON",
+			input:        `{"db_host": "db.example.com", "port": 5432, "zones": ["a", "b"]}`,
+			expectValues: map[string]string{"db_host": "db.example.com", "port": "5432", "zones": `["a","b"]`},
+		},
+		{
+			name: "terraform",
+			desc: "check values are extracted from terraform's output format",
+			input: `{"lb_dns": {"sensitive": false, "type": "string", "value": "lb.example.com"},
+"subnets": {"sensitive": false, "type": ["list", "string"], "value": ["s1"]}}`,
+			expectValues: map[string]string{"lb_dns": "lb.example.com", "subnets": `["s1"]`},
+		},
+		{
+			name: "sensitive",
+			desc: "check sensitive terraform outputs are skipped",
+			input: `{"lb_dns": {"sensitive": false, "type": "string", "value": "lb.example.com"},
+"password": {"sensitive": true, "type": "string", "value": "secret"}}`,
+			expectValues: map[string]string{"lb_dns": "lb.example.com"},
+		},
+		{
+			name:         "objects",
+			desc:         "check other objects are encoded as JSON",
+			input:        `{"db": {"host": "db.example.com", "value": "x"}}`,
+			expectValues: map[string]string{"db": `{"host":"db.example.com","value":"x"}`},
+		},
+		{
+			name:          "not_an_object",
+			desc:          "check outputs must be a JSON object",
+			input:         `["db.example.com"]`,
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := parseJsonOutputs([]byte(test.input))
+		if test.expectedError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+			assert.Equal(t, test.expectValues, result, "unexpected result for %s", test.name)
+		}
+	}
+}
+
+func TestKappOutputs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "outputs-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	kappObj := &kapp.Kapp{Id: "rds", RootDir: tempDir}
+
+	// kapps don't have to write outputs
+	outputs, err := KappOutputs(kappObj)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{}, outputs)
+
+	err = os.MkdirAll(filepath.Join(tempDir, cacher.CACHE_DIR), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(OutputsPath(tempDir),
+		[]byte(`{"db_host": "json.example.com", "db_port": "5432"}`), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(tempDir, "db-host.txt"),
+		[]byte("text.example.com\n"), 0644)
+	assert.Nil(t, err)
+
+	// declared outputs take precedence
+	kappObj.Descriptor = &kapp.Descriptor{Outputs: []kapp.Output{
+		{Name: "db_host", Path: "db-host.txt"},
+	}}
+
+	outputs, err = KappOutputs(kappObj)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"db_host": "text.example.com",
+		"db_port": "5432"}, outputs)
+
+	// declared outputs must be written
+	kappObj.Descriptor.Outputs = append(kappObj.Descriptor.Outputs,
+		kapp.Output{Name: "db_user", Path: "db-user.txt"})
+	_, err = KappOutputs(kappObj)
+	assert.NotNil(t, err)
+}
+
+func TestOutputEnvVarName(t *testing.T) {
+	assert.Equal(t, "OUTPUT_SHARED_INFRA_RDS_DB_HOST",
+		OutputEnvVarName("shared-infra", "rds", "db_host"))
+	assert.Equal(t, "OUTPUT_WEB_LB_DNS_NAME",
+		OutputEnvVarName("web", "lb", "dns.name"))
+}
@@ -17,217 +17,447 @@
 package installer
 
 import (
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 )
 
 // This is a generic way of inspecting kapps to see what they contain and what
-// env vars/CLI parameters should be passed to their installers
-
-// todo - move into a default config file, but allow them to be overridden/
-// addtional interfaces defined.
-//var parameteriserConfig = `
-//kapp_interfaces:	# different things a kapp might contain. A kapp may 'implement'
-//					# multiple interfaces (e.g. contain both a helm chart and terraform configs
-//  helm_chart:
-//    heuristics: 			# inspections we can carry out on a kapp to see what it contains
-//    - file:
-//        pattern: Chart.yaml		# regex to search for under the kapp root dir
-//    params:
-//      env:
-//      - name: KUBE_CONTEXT
-//        value:
-//          type: vars_lookup
-//          path: provider
-//          key: kube_context
-//      - name: NAMESPACE		# default value. Allow overriding it in the installer config.
-//        value: 				# think of how to configure that here...
-//          type: obj_field
-//          path: kapp
-//          key: Id
-//      - name: RELEASE
-//        value:
-//          type: obj_field
-//          path: kapp
-//          key: Id
-//      cliArgs:
-//      - name: helm-opts
-//        components:
-//        - key: -f
-//          value
-//            pattern: values-(\w+).yaml
-//
-//  k8s_resource:             # a naked k8s resource. No heuristics. Expect to find
-//    params:					# it listed in 'sugarkube.yaml'
-//      env:
-//      - name: KUBE_CONTEXT
-//        value:
-//          type: vars_lookup
-//          path: provider
-//          key: kube_context
-//
-//  terraform:
-//    heuristics:
-//    - file:
-//        pattern: terraform.*
-//        type: dir
-//    params:
-//      cliArgs:
-//      - name: tf-opts
-//        components:			# by default collapse multiple values into a
-//        - key: -var-file		# single CLI arg
-//          value:
-//            pattern: vars/(\w+).tfvars
-//`
+// env vars/CLI parameters should be passed to their installers. The interfaces
+// kapps can implement are defined in YAML. The defaults are in
+// `configs/kapp_interfaces.yaml` and compiled into `defaultParameteriserConfig`
+// by `go generate`. Projects can add their own or replace the defaults by
+// setting `kapp_interfaces` in a stack config to the path to a file of
+// interface definitions.
+//go:generate go run gen_kapp_interfaces.go
 
 const IMPLEMENTS_HELM = "helm"
 const IMPLEMENTS_TERRAFORM = "terraform"
 const IMPLEMENTS_K8S = "k8s"
 
+// Types of values for env vars
+const VALUE_VARS_LOOKUP = "vars_lookup" // a (dotted) path and key in the provider vars
+const VALUE_OBJ_FIELD = "obj_field"     // a field of an object, e.g. the kapp
+const VALUE_ENV = "env"                 // an env var of the sugarkube process
+const VALUE_LITERAL = "literal"         // a literal value. A leading `~/` is expanded.
+
+// Objects that can be used in `obj_field` values
+const OBJ_KAPP = "kapp"
+
+type parameteriserConfig struct {
+	KappInterfaces map[string]kappInterface `yaml:"kapp_interfaces"`
+}
+
+type kappInterface struct {
+	// a kapp implements the interface if any heuristic matches, or always if
+	// there are none
+	Heuristics []heuristic `yaml:"heuristics"`
+	Params     struct {
+		Env     []envParam `yaml:"env"`
+		CliArgs []cliArg   `yaml:"cliArgs"`
+	} `yaml:"params"`
+}
+
+type heuristic struct {
+	File *struct {
+		// regex to search for in paths under the kapp root dir
+		Pattern string `yaml:"pattern"`
+		// 'file' or 'dir' to only match one or the other
+		Type string `yaml:"type"`
+	} `yaml:"file"`
+}
+
+type envParam struct {
+	Name  string     `yaml:"name"`
+	Value paramValue `yaml:"value"`
+}
+
+type paramValue struct {
+	Type  string `yaml:"type"`
+	Path  string `yaml:"path"`
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"` // for literals
+	// if true, it's an error if no value is found. Otherwise the env var
+	// isn't set.
+	Required bool `yaml:"required"`
+	// a value to use if this one isn't found
+	Fallback *paramValue `yaml:"fallback"`
+}
+
+type cliArg struct {
+	Name       string `yaml:"name"`
+	Components []struct {
+		Key   string `yaml:"key"`
+		Value struct {
+			// regex for paths under the kapp root dir. The capturing group
+			// must match e.g. the cluster or profile name.
+			Pattern string `yaml:"pattern"`
+		} `yaml:"value"`
+	} `yaml:"components"`
+}
+
+// Parses kapp interface definitions
+func parseParameteriserConfig(data []byte) (*parameteriserConfig, error) {
+	config := parameteriserConfig{}
+	err := yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing kapp interfaces")
+	}
+
+	return &config, nil
+}
+
+// Returns the default kapp interfaces, with any defined in the file configured
+// in the stack config added to them or replacing them
+func loadParameteriserConfig(stackConfig *kapp.StackConfig) (*parameteriserConfig, error) {
+	config, err := parseParameteriserConfig([]byte(defaultParameteriserConfig))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if stackConfig.KappInterfaces == "" {
+		return config, nil
+	}
+
+	path := stackConfig.KappInterfaces
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(stackConfig.Dir(), path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading kapp interfaces from '%s'", path)
+	}
+
+	overrides, err := parseParameteriserConfig(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error loading kapp interfaces from '%s'", path)
+	}
+
+	for name, kappInterface := range overrides.KappInterfaces {
+		log.Debugf("Loaded kapp interface '%s' from '%s'", name, path)
+		config.KappInterfaces[name] = kappInterface
+	}
+
+	return config, nil
+}
+
 type Parameteriser struct {
 	Name    string
+	config  kappInterface
 	kappObj *kapp.Kapp
 }
 
-const KUBE_CONTEXT_KEY = "kube_context"
-
 // Return a map of env vars that should be passed to the kapp by the installer
 func (i *Parameteriser) GetEnvVars(vars provider.Values) (map[string]string, error) {
 	envVars := make(map[string]string)
 
-	if i.Name == IMPLEMENTS_HELM {
-		envVars["NAMESPACE"] = i.kappObj.Id
-		envVars["RELEASE"] = i.kappObj.Id
+	for _, param := range i.config.Params.Env {
+		value, found, err := param.Value.resolve(vars, i.kappObj)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error getting env var '%s' for "+
+				"interface '%s'", param.Name, i.Name)
+		}
 
-		// todo - this is a hack. Need to find a place for things like this and
-		// a generic way of adding them as env vars. Perhaps have a YAML block
-		// called 'installers' or something?
-		envVars["HOSTED_ZONE"] = vars["hosted_zone"].(string)
+		if found {
+			envVars[param.Name] = value
+		} else {
+			log.Debugf("No value for env var '%s' for interface '%s' of "+
+				"kapp '%s'", param.Name, i.Name, i.kappObj.Id)
+		}
 	}
 
-	if i.Name == IMPLEMENTS_HELM || i.Name == IMPLEMENTS_K8S {
-		if kubeContext, ok := os.LookupEnv("KUBE_CONTEXT"); ok {
-			// todo - we probably don't need this... remove if not
-			envVars["KUBE_CONTEXT"] = kubeContext
-		} else {
-			envVars["KUBE_CONTEXT"] = vars[KUBE_CONTEXT_KEY].(string)
+	return envVars, nil
+}
+
+// Returns a value and whether it was found
+func (v *paramValue) resolve(vars provider.Values, kappObj *kapp.Kapp) (string, bool, error) {
+	value := ""
+	found := false
+
+	switch v.Type {
+	case VALUE_VARS_LOOKUP:
+		path := make([]string, 0)
+		if v.Path != "" {
+			path = strings.Split(v.Path, ".")
 		}
 
-		// todo - we probably don't need this... remove if not
-		// only set env var if it's not already set
-		if kubeConfig, ok := os.LookupEnv("KUBECONFIG"); ok {
-			envVars["KUBECONFIG"] = kubeConfig
-		} else {
-			usr, _ := user.Current()
-			homeDir := usr.HomeDir
-			defaultKubeConfig := filepath.Join(homeDir, ".kube/config")
-			envVars["KUBECONFIG"] = defaultKubeConfig
+		var result interface{}
+		result, found = lookupVar(vars, append(path, v.Key))
+		if found {
+			value = fmt.Sprintf("%v", result)
+		}
+	case VALUE_OBJ_FIELD:
+		if v.Path != OBJ_KAPP {
+			return "", false, errors.New(fmt.Sprintf("Unknown object '%s'. "+
+				"Only '%s' is supported", v.Path, OBJ_KAPP))
+		}
+
+		field := reflect.ValueOf(kappObj).Elem().FieldByName(v.Key)
+		if !field.IsValid() || !field.CanInterface() {
+			return "", false, errors.New(fmt.Sprintf("Kapps don't have a "+
+				"field called '%s'", v.Key))
 		}
+
+		value = fmt.Sprintf("%v", field.Interface())
+		found = true
+	case VALUE_ENV:
+		value, found = os.LookupEnv(v.Key)
+	case VALUE_LITERAL:
+		value = v.Value
+		found = true
+
+		if strings.HasPrefix(value, "~/") {
+			usr, err := user.Current()
+			if err != nil {
+				return "", false, errors.WithStack(err)
+			}
+			value = filepath.Join(usr.HomeDir, value[2:])
+		}
+	default:
+		return "", false, errors.New(fmt.Sprintf("Unknown value type '%s'", v.Type))
 	}
 
-	return envVars, nil
+	if !found && v.Fallback != nil {
+		return v.Fallback.resolve(vars, kappObj)
+	}
+
+	if !found && v.Required {
+		return "", false, errors.New(fmt.Sprintf("No value found for required "+
+			"%s '%s'", v.Type, strings.Trim(v.Path+"."+v.Key, ".")))
+	}
+
+	return value, found, nil
 }
 
-// Returns a list of args that the installer should pass to the kapp. This will
-// need refactoring once parsing the Parameteriser config is implemented.
-func (i *Parameteriser) GetCliArgs(validPatternMatches []string) (string, error) {
-	pattern := ""
-	argName := ""
-	argKey := ""
+// Returns the value at a path in nested maps of vars and whether it exists
+func lookupVar(vars provider.Values, path []string) (interface{}, bool) {
+	var current interface{} = vars
 
-	if i.Name == IMPLEMENTS_HELM {
-		pattern = "values-(?P<Var>\\w*).yaml"
-		argName = "helm-opts"
-		argKey = "-f"
+	for _, key := range path {
+		switch values := current.(type) {
+		case map[string]interface{}:
+			value, ok := values[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case map[interface{}]interface{}:
+			value, ok := values[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		default:
+			return nil, false
+		}
 	}
 
-	if i.Name == IMPLEMENTS_TERRAFORM {
-		pattern = "terraform.*"
-		argName = "tf-opts"
-		argKey = "-var-file"
+	return current, true
+}
+
+// Returns a list of args that the installer should pass to the kapp. Each
+// argument collapses the paths matching its components into a single value,
+// e.g. `helm-opts=-f values-dev.yaml -f values-dev1.yaml`.
+func (i *Parameteriser) GetCliArgs(validPatternMatches []string) ([]string, error) {
+	cliArgs := make([]string, 0)
+
+	argValues, err := i.GetCliArgValues(validPatternMatches)
+	if err != nil {
+		return nil, errors.WithStack(err)
 	}
 
-	if pattern == "" {
-		return "", nil
+	for _, arg := range i.config.Params.CliArgs {
+		if values, ok := argValues[arg.Name]; ok {
+			joinedValues := strings.Join(values, " ")
+			cliArgs = append(cliArgs, strings.Join([]string{arg.Name, joinedValues}, "="))
+		}
 	}
 
-	matches, err := findFilesByPattern(i.kappObj.RootDir, pattern,
-		true, true)
+	return cliArgs, nil
+}
+
+// Returns the values of each CLI arg that matched any paths keyed by the arg's
+// name, e.g. `helm-opts: [-f, values-dev.yaml, -f, values-dev1.yaml]`.
+// Installers that run commands directly can pass these on as separate args.
+func (i *Parameteriser) GetCliArgValues(validPatternMatches []string) (map[string][]string, error) {
+	cliArgValues := make(map[string][]string)
+
+	dirs, err := searchDirs(i.kappObj)
 	if err != nil {
-		return "", errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	// use a map for deduping
-	argValues := make(map[string]string, 0)
+	for _, arg := range i.config.Params.CliArgs {
+		// use a map for deduping
+		argValues := make(map[string][]string, 0)
+
+		for _, component := range arg.Components {
+			pattern := component.Value.Pattern
+
+			matches := make([]string, 0)
+			for _, dir := range dirs {
+				dirMatches, err := findFilesByPattern(dir, pattern, true, true)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+				matches = append(matches, dirMatches...)
+			}
 
-	// make sure the matching group in each match is in the valid pattern matches list
-	for _, match := range matches {
-		matchingGroups := getRegExpCapturingGroups(pattern, match)
+			// make sure the matching group in each match is in the valid pattern matches list
+			for _, match := range matches {
+				matchingGroups := getRegExpCapturingGroups(pattern, match)
 
-		// don't punish yourself by saying the words "functional programming"...
-		for _, v := range matchingGroups {
-			for _, valid := range validPatternMatches {
-				if v == valid {
-					// todo - this separator string may need to be configurable too
-					argValues[match] = strings.Join([]string{argKey, match}, " ")
+				// don't punish yourself by saying the words "functional programming"...
+				for _, v := range matchingGroups {
+					for _, valid := range validPatternMatches {
+						if v == valid {
+							argValues[match] = []string{component.Key, match}
+						}
+					}
 				}
 			}
 		}
+
+		if len(argValues) > 0 {
+			// sort by the joined values so the order is deterministic
+			joined := make([]string, 0)
+			joinedValues := make(map[string][]string)
+			for _, v := range argValues {
+				// todo - this separator string may need to be configurable too
+				key := strings.Join(v, " ")
+				joined = append(joined, key)
+				joinedValues[key] = v
+			}
+			sort.Strings(joined)
+
+			values := make([]string, 0)
+			for _, key := range joined {
+				values = append(values, joinedValues[key]...)
+			}
+
+			cliArgValues[arg.Name] = values
+		}
 	}
 
-	cliArg := ""
+	return cliArgValues, nil
+}
 
-	if len(argValues) > 0 {
-		strArgs := make([]string, 0)
+// Returns whether a kapp implements an interface according to its heuristics
+func (k *kappInterface) implementedBy(kappObj *kapp.Kapp) (bool, error) {
+	if len(k.Heuristics) == 0 {
+		return true, nil
+	}
+
+	for _, heuristic := range k.Heuristics {
+		if heuristic.File == nil {
+			continue
+		}
 
-		for _, v := range argValues {
-			strArgs = append(strArgs, v)
+		paths, err := findFilesByPattern(kappObj.RootDir, heuristic.File.Pattern,
+			true, true)
+		if err != nil {
+			return false, errors.WithStack(err)
 		}
 
-		joinedValues := strings.Join(strArgs, " ")
-		cliArg = strings.Join([]string{argName, joinedValues}, "=")
+		for _, path := range paths {
+			if heuristic.File.Type == "" {
+				return true, nil
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				return false, errors.WithStack(err)
+			}
+
+			if info.IsDir() == (heuristic.File.Type == "dir") {
+				return true, nil
+			}
+		}
 	}
-	return cliArg, nil
+
+	return false, nil
+}
+
+// Returns whether a kapp implements an interface, e.g. 'terraform'. The kapp's
+// root dir must be set.
+func ImplementsInterface(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	name string) (bool, error) {
+	config, err := loadParameteriserConfig(stackConfig)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	parameterisers, err := identifyKappInterfaces(kappObj, config)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	for _, parameteriser := range parameterisers {
+		if parameteriser.Name == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
 // Examines a kapp to find out what it contains, and therefore what env vars/
 // CLI args need passing to it by an Installer.
-func identifyKappInterfaces(kappObj *kapp.Kapp) ([]Parameteriser, error) {
-	// todo - parse the above config and test the kapp using it.
-	// todo - also look in the kapp's sugarkube.yaml file if it exists
+func identifyKappInterfaces(kappObj *kapp.Kapp, config *parameteriserConfig) ([]Parameteriser, error) {
+	// interfaces declared in the kapp's descriptor are implemented regardless
+	// of heuristics
+	declared := make(map[string]bool)
+	if kappObj.Descriptor != nil {
+		for _, name := range kappObj.Descriptor.Interfaces {
+			if _, ok := config.KappInterfaces[name]; !ok {
+				return nil, errors.New(fmt.Sprintf("Kapp '%s' declares unknown "+
+					"interface '%s'", kappObj.Id, name))
+			}
+			declared[name] = true
+		}
+	}
+
+	// sort interfaces so env vars they set are overridden deterministically
+	names := make([]string, 0)
+	for name := range config.KappInterfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
 	parameterisers := make([]Parameteriser, 0)
 
-	// todo - remove IMPLEMENTS_K8S from this. It's a temporary kludge until we
-	// can get it from the kapp's sugarkube.yaml file
-	parameterisers = append(parameterisers, Parameteriser{
-		Name: IMPLEMENTS_K8S, kappObj: kappObj})
+	for _, name := range names {
+		kappInterface := config.KappInterfaces[name]
 
-	// todo - remove this kludge to find out whether the kapp contains a helm chart.
-	chartPaths, err := findFilesByPattern(kappObj.RootDir, "Chart.yaml",
-		true, true)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	if len(chartPaths) > 0 {
-		parameterisers = append(parameterisers, Parameteriser{
-			Name: IMPLEMENTS_HELM, kappObj: kappObj})
-	}
+		implemented := declared[name]
+		if !implemented {
+			var err error
+			implemented, err = kappInterface.implementedBy(kappObj)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error checking whether kapp '%s' "+
+					"implements interface '%s'", kappObj.Id, name)
+			}
+		}
 
-	// todo - remove this kludge to find out whether the kapp contains terraform configs
-	terraformPaths, err := findFilesByPattern(kappObj.RootDir, "terraform",
-		true, true)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	if len(terraformPaths) > 0 {
-		parameterisers = append(parameterisers, Parameteriser{
-			Name: IMPLEMENTS_TERRAFORM, kappObj: kappObj})
+		if implemented {
+			log.Debugf("Kapp '%s' implements interface '%s'", kappObj.Id, name)
+			parameterisers = append(parameterisers, Parameteriser{
+				Name:    name,
+				config:  kappInterface,
+				kappObj: kappObj,
+			})
+		}
 	}
 
 	return parameterisers, nil
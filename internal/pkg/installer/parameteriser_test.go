@@ -0,0 +1,232 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The compiled in defaults must be regenerated with `go generate` when the
+// YAML file changes
+func TestDefaultParameteriserConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("../../../configs/kapp_interfaces.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), defaultParameteriserConfig,
+		"kapp_interfaces.go is out of date. Run 'go generate'")
+
+	_, err = parseParameteriserConfig(data)
+	assert.Nil(t, err)
+}
+
+func TestResolveParamValue(t *testing.T) {
+	vars := provider.Values{
+		"kube_context": "minikube",
+		"provisioner": map[interface{}]interface{}{
+			"binary": "kops",
+		},
+	}
+
+	kappObj := &kapp.Kapp{Id: "example"}
+
+	os.Setenv("SUGARKUBE_TEST_VAR", "from-env")
+	defer os.Unsetenv("SUGARKUBE_TEST_VAR")
+
+	tests := []struct {
+		name          string
+		desc          string
+		input         paramValue
+		expectValue   string
+		expectFound   bool
+		expectedError bool
+	}{
+		{
+			name:        "vars_lookup",
+			desc:        "check looking up top-level vars",
+			input:       paramValue{Type: VALUE_VARS_LOOKUP, Key: "kube_context"},
+			expectValue: "minikube",
+			expectFound: true,
+		},
+		{
+			name:        "vars_lookup_path",
+			desc:        "check looking up nested vars",
+			input:       paramValue{Type: VALUE_VARS_LOOKUP, Path: "provisioner", Key: "binary"},
+			expectValue: "kops",
+			expectFound: true,
+		},
+		{
+			name:        "vars_lookup_missing",
+			desc:        "check missing vars aren't found",
+			input:       paramValue{Type: VALUE_VARS_LOOKUP, Key: "hosted_zone"},
+			expectFound: false,
+		},
+		{
+			name:          "vars_lookup_required",
+			desc:          "check missing required vars are errors",
+			input:         paramValue{Type: VALUE_VARS_LOOKUP, Key: "hosted_zone", Required: true},
+			expectedError: true,
+		},
+		{
+			name:        "obj_field",
+			desc:        "check looking up kapp fields",
+			input:       paramValue{Type: VALUE_OBJ_FIELD, Path: OBJ_KAPP, Key: "Id"},
+			expectValue: "example",
+			expectFound: true,
+		},
+		{
+			name:          "obj_field_unknown",
+			desc:          "check unknown fields are errors",
+			input:         paramValue{Type: VALUE_OBJ_FIELD, Path: OBJ_KAPP, Key: "Nonexistent"},
+			expectedError: true,
+		},
+		{
+			name:        "env",
+			desc:        "check looking up env vars",
+			input:       paramValue{Type: VALUE_ENV, Key: "SUGARKUBE_TEST_VAR"},
+			expectValue: "from-env",
+			expectFound: true,
+		},
+		{
+			name: "fallback",
+			desc: "check falling back to other values",
+			input: paramValue{Type: VALUE_ENV, Key: "SUGARKUBE_MISSING_VAR",
+				Fallback: &paramValue{Type: VALUE_LITERAL, Value: "default"}},
+			expectValue: "default",
+			expectFound: true,
+		},
+		{
+			name:          "unknown_type",
+			desc:          "check unknown value types are errors",
+			input:         paramValue{Type: "nonsense"},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		value, found, err := test.input.resolve(vars, kappObj)
+		if test.expectedError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+			assert.Equal(t, test.expectFound, found, "unexpected found for %s", test.name)
+			assert.Equal(t, test.expectValue, value, "unexpected value for %s", test.name)
+		}
+	}
+}
+
+func TestIdentifyKappInterfaces(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "parameteriser-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	kappDir := filepath.Join(tempDir, "kapp")
+	for _, path := range []string{"chart/Chart.yaml", "chart/values-dev.yaml",
+		"chart/values-prod.yaml", "kustomization.yaml"} {
+		err = os.MkdirAll(filepath.Join(kappDir, filepath.Dir(path)), 0755)
+		assert.Nil(t, err)
+		err = ioutil.WriteFile(filepath.Join(kappDir, path), []byte{}, 0644)
+		assert.Nil(t, err)
+	}
+
+	// projects can add interfaces
+	interfacesPath := filepath.Join(tempDir, "interfaces.yaml")
+	err = ioutil.WriteFile(interfacesPath, []byte(`
+kapp_interfaces:
+  kustomize:
+    heuristics:
+    - file:
+        pattern: kustomization.yaml
+    params:
+      env:
+      - name: OVERLAY
+        value:
+          type: vars_lookup
+          key: overlay
+          required: true
+`), 0644)
+	assert.Nil(t, err)
+
+	stackConfig := &kapp.StackConfig{
+		FilePath:       filepath.Join(tempDir, "stacks.yaml"),
+		KappInterfaces: "interfaces.yaml",
+	}
+
+	config, err := loadParameteriserConfig(stackConfig)
+	assert.Nil(t, err)
+
+	kappObj := &kapp.Kapp{Id: "example", RootDir: kappDir}
+	parameterisers, err := identifyKappInterfaces(kappObj, config)
+	assert.Nil(t, err)
+
+	names := make([]string, 0)
+	for _, parameteriser := range parameterisers {
+		names = append(names, parameteriser.Name)
+	}
+	assert.Equal(t, []string{IMPLEMENTS_HELM, IMPLEMENTS_K8S, "kustomize"}, names)
+
+	// a missing hosted zone doesn't stop helm env vars being generated
+	helm := parameterisers[0]
+	envVars, err := helm.GetEnvVars(provider.Values{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"NAMESPACE": "example", "RELEASE": "example"}, envVars)
+
+	cliArgs, err := helm.GetCliArgs([]string{"dev"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"helm-opts=-f " + filepath.Join(kappDir, "chart/values-dev.yaml")},
+		cliArgs)
+
+	kustomize := parameterisers[2]
+	_, err = kustomize.GetEnvVars(provider.Values{})
+	assert.NotNil(t, err)
+
+	envVars, err = kustomize.GetEnvVars(provider.Values{"overlay": "dev"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"OVERLAY": "dev"}, envVars)
+}
+
+func TestIdentifyDeclaredKappInterfaces(t *testing.T) {
+	config, err := parseParameteriserConfig([]byte(defaultParameteriserConfig))
+	assert.Nil(t, err)
+
+	tempDir, err := ioutil.TempDir("", "parameteriser-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// kapps can declare interfaces heuristics wouldn't find
+	kappObj := &kapp.Kapp{
+		Id:         "example",
+		RootDir:    tempDir,
+		Descriptor: &kapp.Descriptor{Interfaces: []string{IMPLEMENTS_TERRAFORM}},
+	}
+	parameterisers, err := identifyKappInterfaces(kappObj, config)
+	assert.Nil(t, err)
+
+	names := make([]string, 0)
+	for _, parameteriser := range parameterisers {
+		names = append(names, parameteriser.Name)
+	}
+	assert.Equal(t, []string{IMPLEMENTS_K8S, IMPLEMENTS_TERRAFORM}, names)
+
+	kappObj.Descriptor.Interfaces = []string{"unknown"}
+	_, err = identifyKappInterfaces(kappObj, config)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,550 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Installs kapps containing terraform configs by running terraform directly
+// with a generated backend
+type TerraformInstaller struct {
+	provider provider.Provider
+}
+
+// todo - make configurable
+const TERRAFORM_PATH = "terraform"
+
+// Key in provider vars configuring the terraform backend with a `type` (e.g.
+// s3) and a map of `config` settings for it
+const TERRAFORM_BACKEND_KEY = "terraform_backend"
+
+// Backends
+const BACKEND_LOCAL = "local"
+const BACKEND_S3 = "s3"
+const BACKEND_GCS = "gcs"
+const BACKEND_AZURERM = "azurerm"
+
+// Name of the file the backend is written to in the kapp's terraform dir
+const TERRAFORM_BACKEND_FILE = acquirer.GENERATED_FILE_PREFIX + "backend.tf"
+
+// Names of the files plans to install and destroy kapps are saved to in the
+// cache dir in the kapp's root dir. They're kept apart so a plan is never
+// applied for the wrong action.
+const TERRAFORM_INSTALL_PLAN_FILE = "terraform-install.tfplan"
+const TERRAFORM_DESTROY_PLAN_FILE = "terraform-destroy.tfplan"
+
+// Name of the file terraform state is kept in
+const TERRAFORM_LOCAL_STATE_FILE = "terraform.tfstate"
+
+// Directory under the user's home dir that local backends keep state in by
+// default. It's outside the cache so state isn't lost when caches are deleted.
+const TERRAFORM_LOCAL_STATE_DIR = ".sugarkube/terraform-state"
+
+// Where a kapp's terraform state is kept
+type terraformBackend struct {
+	Type   string                 `yaml:"type"`
+	Config map[string]interface{} `yaml:"config"`
+}
+
+// Returns the backend configured in provider vars, or a local backend if
+// there isn't one. Each kapp gets its own state by default.
+func loadTerraformBackend(stackVars provider.Values, kappObj *kapp.Kapp,
+	stackConfig *kapp.StackConfig) (*terraformBackend, error) {
+
+	backend := terraformBackend{}
+
+	if rawBackend, ok := stackVars[TERRAFORM_BACKEND_KEY]; ok {
+		backendBytes, err := yaml.Marshal(rawBackend)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		err = yaml.UnmarshalStrict(backendBytes, &backend)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid '%s' in vars", TERRAFORM_BACKEND_KEY)
+		}
+	}
+
+	if backend.Type == "" {
+		backend.Type = BACKEND_LOCAL
+	}
+
+	if backend.Config == nil {
+		backend.Config = make(map[string]interface{})
+	}
+
+	// state is namespaced by the stack and manifest so kapps with the same ID
+	// in different accounts, regions or manifests don't share state
+	stateDir := path.Join(stackConfig.Provider, stackConfig.Account,
+		stackConfig.Region, stackConfig.Profile, stackConfig.Cluster,
+		kappObj.ManifestId, kappObj.Id)
+	statePrefix := path.Join("sugarkube", stateDir)
+
+	localStatePath := ""
+	if _, ok := backend.Config["path"]; backend.Type == BACKEND_LOCAL && !ok {
+		home, err := homeDir()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error finding where to keep local "+
+				"terraform state for kapp '%s'", kappObj.Id)
+		}
+
+		localStatePath = filepath.Join(home, TERRAFORM_LOCAL_STATE_DIR,
+			filepath.FromSlash(stateDir), TERRAFORM_LOCAL_STATE_FILE)
+		if _, ok := stackVars[TERRAFORM_BACKEND_KEY]; !ok {
+			log.Warnf("No '%s' var configured. Keeping terraform state for "+
+				"kapp '%s' locally in '%s'", TERRAFORM_BACKEND_KEY, kappObj.Id,
+				localStatePath)
+		}
+	}
+
+	defaults := map[string]map[string]string{
+		BACKEND_LOCAL:   {"path": localStatePath},
+		BACKEND_S3:      {"key": path.Join(statePrefix, TERRAFORM_LOCAL_STATE_FILE)},
+		BACKEND_AZURERM: {"key": path.Join(statePrefix, TERRAFORM_LOCAL_STATE_FILE)},
+		BACKEND_GCS:     {"prefix": statePrefix},
+	}
+
+	for k, v := range defaults[backend.Type] {
+		if _, ok := backend.Config[k]; !ok {
+			backend.Config[k] = v
+		}
+	}
+
+	return &backend, nil
+}
+
+// Renders the backend as a terraform block
+func (b *terraformBackend) render() (string, error) {
+	keys := make([]string, 0)
+	for k := range b.Config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by sugarkube. Changes will be overwritten.\n")
+	buf.WriteString("terraform {\n")
+	buf.WriteString(fmt.Sprintf("  backend %s {\n", strconv.Quote(b.Type)))
+
+	for _, k := range keys {
+		var value string
+
+		switch v := b.Config[k].(type) {
+		case string:
+			value = strconv.Quote(v)
+		case bool, int, int64, float64:
+			value = fmt.Sprintf("%v", v)
+		default:
+			return "", errors.New(fmt.Sprintf("Unsupported value for "+
+				"terraform backend setting '%s': %#v", k, v))
+		}
+
+		buf.WriteString(fmt.Sprintf("    %s = %s\n", k, value))
+	}
+
+	buf.WriteString("  }\n}\n")
+
+	return buf.String(), nil
+}
+
+// Returns the directory containing the kapp's terraform configs. It's an error
+// if there isn't exactly one.
+func findTerraformDir(kappObj *kapp.Kapp) (string, error) {
+	dirs, err := searchDirs(kappObj)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	found := make(map[string]bool)
+	tfDirs := make([]string, 0)
+
+	for _, dir := range dirs {
+		paths, err := findFilesByPattern(dir, `\.tf$`, true, true)
+		if err != nil {
+			return "", errors.Wrapf(err, "Error finding terraform configs in '%s'", dir)
+		}
+
+		for _, tfPath := range paths {
+			tfDir := filepath.Dir(tfPath)
+			if !found[tfDir] {
+				found[tfDir] = true
+				tfDirs = append(tfDirs, tfDir)
+			}
+		}
+	}
+
+	// ignore modules in subdirectories, e.g. those downloaded by `terraform init`
+	tfDirs = topLevelDirs(tfDirs)
+
+	if len(tfDirs) == 0 {
+		return "", errors.New(fmt.Sprintf("No terraform configs found for "+
+			"kapp '%s' in '%s'", kappObj.Id, strings.Join(dirs, "', '")))
+	}
+
+	if len(tfDirs) > 1 {
+		sort.Strings(tfDirs)
+		return "", errors.New(fmt.Sprintf("Terraform configs found in "+
+			"multiple directories for kapp '%s': %s. Set 'search_paths' in the "+
+			"kapp's '%s' settings to choose one", kappObj.Id,
+			strings.Join(tfDirs, ", "), kapp.INSTALLER_KEY))
+	}
+
+	return tfDirs[0], nil
+}
+
+// Returns the args passing vars to terraform: var files matching the
+// stack found by the terraform kapp interface, then installer params
+func terraformVarArgs(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	parameterisers []Parameteriser) ([]string, error) {
+
+	args := make([]string, 0)
+
+	for _, parameteriser := range parameterisers {
+		if parameteriser.Name != IMPLEMENTS_TERRAFORM {
+			continue
+		}
+
+		argValues, err := parameteriser.GetCliArgValues(validPatternMatches(stackConfig))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		for _, arg := range parameteriser.config.Params.CliArgs {
+			args = append(args, argValues[arg.Name]...)
+		}
+	}
+
+	for _, param := range installerParams(kappObj) {
+		args = append(args, "-var", param)
+	}
+
+	return args, nil
+}
+
+// A kapp's terraform dir and the env to run terraform in it with
+type terraformRun struct {
+	kappObj *kapp.Kapp
+	dir     string
+	envVars map[string]string
+	varArgs []string
+	dryRun  bool
+	output  io.Writer
+}
+
+// Runs terraform with the given args, writing stdout to `stdout` as well as
+// the run's output if it's not nil
+func (r *terraformRun) terraform(ctx context.Context, stdout io.Writer, args ...string) error {
+	if r.dryRun {
+		log.Infof("Dry run. Would run terraform for kapp '%s' in '%s' with "+
+			"args: %s", r.kappObj.Id, r.dir, strings.Join(args, " "))
+		return nil
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+
+	stdoutWriters := []io.Writer{&stdoutBuf, r.output}
+	if stdout != nil {
+		stdoutWriters = []io.Writer{stdout}
+	}
+
+	tfCmd := exec.Command(TERRAFORM_PATH, args...)
+	tfCmd.Dir = r.dir
+	tfCmd.Env = commandEnv(r.envVars)
+	tfCmd.Stdout = io.MultiWriter(stdoutWriters...)
+	tfCmd.Stderr = io.MultiWriter(&stderrBuf, r.output)
+
+	log.Debugf("Running terraform for kapp '%s' with command: %#v", r.kappObj.Id, tfCmd)
+
+	err := runCommand(ctx, tfCmd)
+	if err != nil {
+		return errors.Wrapf(err, "Error running terraform for kapp '%s' with "+
+			"args: %s. -- Stdout -- %s -- Stderr -- %s", r.kappObj.Id,
+			strings.Join(args, " "), stdoutBuf.String(), stderrBuf.String())
+	}
+
+	return nil
+}
+
+// Finds the kapp's terraform dir, writes its backend and initialises it
+func (i TerraformInstaller) init(ctx context.Context, kappObj *kapp.Kapp,
+	stackConfig *kapp.StackConfig, approved bool, dryRun bool,
+	output io.Writer) (*terraformRun, error) {
+
+	tfDir, err := findTerraformDir(kappObj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	envVars, parameterisers, err := parameteriseKapp(kappObj, stackConfig,
+		i.provider, approved)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	envVars["TF_IN_AUTOMATION"] = "true"
+
+	err = checkRequiredEnvVars(kappObj, envVars)
+	if err != nil {
+		if !dryRun {
+			return nil, errors.WithStack(err)
+		}
+		log.Warnf("Dry run. Running terraform would fail: %s", err)
+	}
+
+	varArgs, err := terraformVarArgs(kappObj, stackConfig, parameterisers)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	stackVars, err := provider.LoadVars(stackConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	backend, err := loadTerraformBackend(stackVars, kappObj, stackConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	backendConfig, err := backend.render()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	backendPath := filepath.Join(tfDir, TERRAFORM_BACKEND_FILE)
+
+	if dryRun {
+		log.Infof("Dry run. Would write terraform backend to '%s':\n%s",
+			backendPath, backendConfig)
+	} else {
+		log.Debugf("Writing terraform backend for kapp '%s' to '%s'",
+			kappObj.Id, backendPath)
+		err = ioutil.WriteFile(backendPath, []byte(backendConfig), 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error writing terraform backend")
+		}
+
+		if statePath, ok := backend.Config["path"].(string); ok && backend.Type == BACKEND_LOCAL {
+			err = os.MkdirAll(filepath.Dir(statePath), 0755)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error creating the terraform "+
+					"state dir for kapp '%s'", kappObj.Id)
+			}
+		}
+	}
+
+	run := &terraformRun{
+		kappObj: kappObj,
+		dir:     tfDir,
+		envVars: envVars,
+		varArgs: varArgs,
+		dryRun:  dryRun,
+		output:  output,
+	}
+
+	err = run.terraform(ctx, nil, "init", "-input=false")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return run, nil
+}
+
+// Saves a plan and exports it as JSON so changes it'd make can be reported.
+// Any plan saved for the other action is removed so it can't be applied.
+func (r *terraformRun) plan(ctx context.Context, destroy bool) error {
+	planPath := savedPlanPath(r.kappObj.RootDir, destroy)
+
+	if !r.dryRun {
+		err := os.Remove(savedPlanPath(r.kappObj.RootDir, !destroy))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	args := []string{"plan", "-input=false", "-out=" + planPath}
+	if destroy {
+		args = append(args, "-destroy")
+	}
+	args = append(args, r.varArgs...)
+
+	err := r.terraform(ctx, nil, args...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if r.dryRun {
+		return nil
+	}
+
+	jsonPlan, err := os.Create(TerraformPlanPath(r.kappObj.RootDir))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer jsonPlan.Close()
+
+	err = r.terraform(ctx, jsonPlan, "show", "-json", planPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Applies the plan saved to install or destroy the kapp. Plans can only be
+// applied once, so they're removed whether or not applying them succeeds.
+func (r *terraformRun) apply(ctx context.Context, destroy bool) error {
+	action, otherAction := "install", "destroy"
+	if destroy {
+		action, otherAction = otherAction, action
+	}
+
+	planPath := savedPlanPath(r.kappObj.RootDir, destroy)
+	if !r.dryRun {
+		if _, err := os.Stat(planPath); err != nil {
+			if _, otherErr := os.Stat(savedPlanPath(r.kappObj.RootDir, !destroy)); otherErr == nil {
+				return errors.New(fmt.Sprintf("The saved terraform plan for "+
+					"kapp '%s' is to %s it, not %s it. Plan it again before "+
+					"applying", r.kappObj.Id, otherAction, action))
+			}
+
+			return errors.Wrapf(err, "No saved terraform plan to %s kapp "+
+				"'%s' found. Kapps must be planned before being applied",
+				action, r.kappObj.Id)
+		}
+	}
+
+	err := r.terraform(ctx, nil, "apply", "-input=false", planPath)
+
+	if !r.dryRun {
+		removeErr := os.Remove(planPath)
+		if err == nil {
+			err = removeErr
+		}
+	}
+
+	return errors.WithStack(err)
+}
+
+// Returns the path plans to install or destroy a kapp are saved to between
+// unapproved and approved runs
+func savedPlanPath(kappRootDir string, destroy bool) string {
+	absKappRoot, err := filepath.Abs(kappRootDir)
+	if err != nil {
+		absKappRoot = kappRootDir
+	}
+
+	planFile := TERRAFORM_INSTALL_PLAN_FILE
+	if destroy {
+		planFile = TERRAFORM_DESTROY_PLAN_FILE
+	}
+
+	return filepath.Join(absKappRoot, cacher.CACHE_DIR, planFile)
+}
+
+// Plans changes when unapproved, and applies the saved plan when approved
+func (i TerraformInstaller) install(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
+
+	run, err := i.init(ctx, kappObj, stackConfig, approved, dryRun, output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !approved {
+		err = run.plan(ctx, false)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		return nil
+	}
+
+	err = run.apply(ctx, false)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !dryRun {
+		// record outputs so they can be passed to other kapps. They may
+		// include sensitive values so only the user can read them.
+		outputs, err := os.OpenFile(OutputsPath(kappObj.RootDir),
+			os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer outputs.Close()
+
+		err = run.terraform(ctx, outputs, "output", "-json")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.Infof("Kapp '%s' successfully installed", kappObj.Id)
+	}
+
+	return nil
+}
+
+// Plans destroying the kapp's resources when unapproved, and applies the
+// saved destroy plan when approved
+func (i TerraformInstaller) destroy(ctx context.Context, kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	approved bool, dryRun bool, output io.Writer) error {
+
+	run, err := i.init(ctx, kappObj, stackConfig, approved, dryRun, output)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !approved {
+		err = run.plan(ctx, true)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		return nil
+	}
+
+	err = run.apply(ctx, true)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !dryRun {
+		log.Infof("Kapp '%s' successfully destroyed", kappObj.Id)
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+// +build integration
+
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a stack using the local provider with a local terraform backend
+func terraformTestStack(t *testing.T, tempDir string) *kapp.StackConfig {
+	clusterDir := filepath.Join(tempDir, "vars/local/profiles/local/clusters/standard")
+	err := os.MkdirAll(clusterDir, 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(clusterDir, "values.yaml"),
+		[]byte("terraform_backend:\n  type: local\n"), 0644)
+	assert.Nil(t, err)
+
+	return &kapp.StackConfig{
+		FilePath:      filepath.Join(tempDir, "stacks.yaml"),
+		Provider:      "local",
+		Profile:       "local",
+		Cluster:       "standard",
+		VarsFilesDirs: []string{"vars"},
+	}
+}
+
+// Plans, applies and destroys a kapp with a null resource and a local backend
+func TestTerraformInstaller(t *testing.T) {
+	if _, err := exec.LookPath(TERRAFORM_PATH); err != nil {
+		t.Skip("terraform isn't installed")
+	}
+
+	tempDir, err := ioutil.TempDir("", "terraform-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	stackConfig := terraformTestStack(t, tempDir)
+
+	// state is kept in the home dir by default
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", filepath.Join(tempDir, "home"))
+
+	kappDir := filepath.Join(tempDir, "cache/manifest/null")
+	err = os.MkdirAll(filepath.Join(kappDir, cacher.CACHE_DIR), 0755)
+	assert.Nil(t, err)
+	err = os.MkdirAll(filepath.Join(kappDir, "terraform"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(kappDir, "terraform/main.tf"),
+		[]byte(`resource "null_resource" "test" {}`+"\n"+
+			`output "id" { value = null_resource.test.id }`+"\n"), 0644)
+	assert.Nil(t, err)
+
+	kappObj := &kapp.Kapp{Id: "null", ManifestId: "manifest", RootDir: kappDir}
+	providerImpl, err := provider.NewProvider(stackConfig)
+	assert.Nil(t, err)
+
+	installerImpl, err := NewInstaller(TERRAFORM, providerImpl)
+	assert.Nil(t, err)
+
+	var output bytes.Buffer
+	ctx := context.Background()
+
+	err = Install(ctx, installerImpl, kappObj, stackConfig, false, false, &output)
+	assert.Nil(t, err, output.String())
+	assert.FileExists(t, filepath.Join(kappDir, "terraform", TERRAFORM_BACKEND_FILE))
+	assert.FileExists(t, savedPlanPath(kappDir, false))
+	assert.FileExists(t, TerraformPlanPath(kappDir))
+
+	err = Install(ctx, installerImpl, kappObj, stackConfig, true, false, &output)
+	assert.Nil(t, err, output.String())
+	assert.FileExists(t, filepath.Join(tempDir, "home", TERRAFORM_LOCAL_STATE_DIR,
+		"local/local/standard/manifest/null", TERRAFORM_LOCAL_STATE_FILE))
+
+	// outputs are exported so they can be passed to other kapps
+	outputs, err := KappOutputs(kappObj)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, outputs["id"])
+
+	// installing again without planning isn't allowed
+	_, err = os.Stat(savedPlanPath(kappDir, false))
+	assert.True(t, os.IsNotExist(err), "applied plans should be deleted")
+	err = Install(ctx, installerImpl, kappObj, stackConfig, true, false, &output)
+	assert.NotNil(t, err)
+
+	// destroying applies a saved destroy plan, which can't be used to install
+	err = Destroy(ctx, installerImpl, kappObj, stackConfig, true, false, &output)
+	assert.NotNil(t, err, "destroying without planning shouldn't be allowed")
+
+	err = Destroy(ctx, installerImpl, kappObj, stackConfig, false, false, &output)
+	assert.Nil(t, err, output.String())
+	assert.FileExists(t, savedPlanPath(kappDir, true))
+
+	err = Install(ctx, installerImpl, kappObj, stackConfig, true, false, &output)
+	assert.NotNil(t, err, "destroy plans shouldn't be applied when installing")
+
+	err = Destroy(ctx, installerImpl, kappObj, stackConfig, true, false, &output)
+	assert.Nil(t, err, output.String())
+	_, err = os.Stat(savedPlanPath(kappDir, true))
+	assert.True(t, os.IsNotExist(err), "applied plans should be deleted")
+
+	// planning an install discards any saved destroy plan
+	err = Destroy(ctx, installerImpl, kappObj, stackConfig, false, false, &output)
+	assert.Nil(t, err, output.String())
+	err = Install(ctx, installerImpl, kappObj, stackConfig, false, false, &output)
+	assert.Nil(t, err, output.String())
+	_, err = os.Stat(savedPlanPath(kappDir, true))
+	assert.True(t, os.IsNotExist(err), "stale destroy plans should be deleted")
+}
+
+// Files terraform generates in kapps cached from git mustn't make the cache
+// look modified between planning and applying
+func TestTerraformInstallerGitSource(t *testing.T) {
+	if _, err := exec.LookPath(TERRAFORM_PATH); err != nil {
+		t.Skip("terraform isn't installed")
+	}
+
+	tempDir, err := ioutil.TempDir("", "terraform-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	stackConfig := terraformTestStack(t, tempDir)
+
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", filepath.Join(tempDir, "home"))
+
+	repoDir := filepath.Join(tempDir, "repo")
+	err = os.MkdirAll(filepath.Join(repoDir, "null/terraform"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(repoDir, "null/terraform/main.tf"),
+		[]byte(`resource "null_resource" "test" {}`+"\n"), 0644)
+	assert.Nil(t, err)
+
+	for _, args := range [][]string{
+		{"init"},
+		{"checkout", "-b", "master"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com",
+			"commit", "-m", "initial"},
+	} {
+		gitCmd := exec.Command("git", args...)
+		gitCmd.Dir = repoDir
+		out, err := gitCmd.CombinedOutput()
+		assert.Nil(t, err, string(out))
+	}
+
+	manifest := kapp.Manifest{
+		Id: "manifest",
+		Kapps: []kapp.Kapp{
+			{
+				Id:              "null",
+				ShouldBePresent: true,
+				Sources: []acquirer.Acquirer{
+					acquirer.NewGitAcquirer("null", "file://"+repoDir, "master", "null"),
+				},
+			},
+		},
+	}
+
+	cacheDir := filepath.Join(tempDir, "cache")
+	err = cacher.CacheManifest(manifest, cacheDir, nil, false)
+	assert.Nil(t, err)
+
+	kappObj := manifest.Kapps[0]
+	kappObj.RootDir = cacher.GetKappRootPath(
+		cacher.GetManifestCachePath(cacheDir, manifest), kappObj)
+
+	providerImpl, err := provider.NewProvider(stackConfig)
+	assert.Nil(t, err)
+
+	installerImpl, err := NewInstaller(TERRAFORM, providerImpl)
+	assert.Nil(t, err)
+
+	var output bytes.Buffer
+	ctx := context.Background()
+
+	for _, approved := range []bool{false, true} {
+		err = Install(ctx, installerImpl, &kappObj, stackConfig, approved, false, &output)
+		assert.Nil(t, err, output.String())
+
+		diff, err := cacher.DiffCache([]kapp.Manifest{manifest}, cacheDir)
+		assert.Nil(t, err)
+		assert.True(t, diff.IsEmpty(), "cache modified when approved=%v: %#v",
+			approved, diff)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package installer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTerraformBackend(t *testing.T) {
+	kappObj := &kapp.Kapp{Id: "rds", ManifestId: "data", RootDir: "/cache/data/rds"}
+	stackConfig := &kapp.StackConfig{Provider: "aws", Account: "123456",
+		Region: "eu-west-1", Profile: "dev", Cluster: "dev1"}
+
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", "/home/dev")
+
+	tests := []struct {
+		name          string
+		desc          string
+		vars          provider.Values
+		expectValues  *terraformBackend
+		expectedError bool
+	}{
+		{
+			name: "default",
+			desc: "check state is kept locally outside the cache by default",
+			vars: provider.Values{},
+			expectValues: &terraformBackend{
+				Type: BACKEND_LOCAL,
+				Config: map[string]interface{}{
+					"path": "/home/dev/.sugarkube/terraform-state/aws/123456/eu-west-1/dev/dev1/data/rds/terraform.tfstate",
+				},
+			},
+		},
+		{
+			name: "local_path",
+			desc: "check local state paths can be configured",
+			vars: provider.Values{
+				TERRAFORM_BACKEND_KEY: map[interface{}]interface{}{
+					"type": "local",
+					"config": map[interface{}]interface{}{
+						"path": "/state/rds.tfstate",
+					},
+				},
+			},
+			expectValues: &terraformBackend{
+				Type: BACKEND_LOCAL,
+				Config: map[string]interface{}{
+					"path": "/state/rds.tfstate",
+				},
+			},
+		},
+		{
+			name: "s3",
+			desc: "check each kapp gets its own state key",
+			vars: provider.Values{
+				TERRAFORM_BACKEND_KEY: map[interface{}]interface{}{
+					"type": "s3",
+					"config": map[interface{}]interface{}{
+						"bucket":  "state",
+						"encrypt": true,
+					},
+				},
+			},
+			expectValues: &terraformBackend{
+				Type: BACKEND_S3,
+				Config: map[string]interface{}{
+					"bucket":  "state",
+					"encrypt": true,
+					"key":     "sugarkube/aws/123456/eu-west-1/dev/dev1/data/rds/terraform.tfstate",
+				},
+			},
+		},
+		{
+			name: "gcs_prefix",
+			desc: "check explicit state settings aren't overridden",
+			vars: provider.Values{
+				TERRAFORM_BACKEND_KEY: map[interface{}]interface{}{
+					"type": "gcs",
+					"config": map[interface{}]interface{}{
+						"bucket": "state",
+						"prefix": "rds",
+					},
+				},
+			},
+			expectValues: &terraformBackend{
+				Type: BACKEND_GCS,
+				Config: map[string]interface{}{
+					"bucket": "state",
+					"prefix": "rds",
+				},
+			},
+		},
+		{
+			name: "bad_backend",
+			desc: "check unknown backend settings are errors",
+			vars: provider.Values{
+				TERRAFORM_BACKEND_KEY: map[interface{}]interface{}{
+					"kind": "s3",
+				},
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := loadTerraformBackend(test.vars, kappObj, stackConfig)
+		if test.expectedError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+			assert.Equal(t, test.expectValues, result, "unexpected result for %s", test.name)
+		}
+	}
+}
+
+func TestRenderTerraformBackend(t *testing.T) {
+	backend := terraformBackend{
+		Type: BACKEND_S3,
+		Config: map[string]interface{}{
+			"bucket":  "state",
+			"encrypt": true,
+			"key":     "sugarkube/rds/terraform.tfstate",
+		},
+	}
+
+	expected := `# Generated by sugarkube. Changes will be overwritten.
+terraform {
+  backend "s3" {
+    bucket = "state"
+    encrypt = true
+    key = "sugarkube/rds/terraform.tfstate"
+  }
+}
+`
+
+	result, err := backend.render()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, result)
+
+	backend.Config["tags"] = []string{"a"}
+	_, err = backend.render()
+	assert.NotNil(t, err)
+}
+
+func TestFindTerraformDir(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "terraform-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	kappDir, err := filepath.EvalSymlinks(tempDir)
+	assert.Nil(t, err)
+
+	// modules downloaded by terraform aren't candidates
+	for _, path := range []string{"rds/terraform/main.tf",
+		"rds/terraform/.terraform/modules/vpc/main.tf"} {
+		err = os.MkdirAll(filepath.Join(kappDir, filepath.Dir(path)), 0755)
+		assert.Nil(t, err)
+		err = ioutil.WriteFile(filepath.Join(kappDir, path), []byte{}, 0644)
+		assert.Nil(t, err)
+	}
+
+	kappObj := &kapp.Kapp{Id: "rds", RootDir: kappDir}
+
+	tfDir, err := findTerraformDir(kappObj)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(kappDir, "rds/terraform"), tfDir)
+
+	err = os.MkdirAll(filepath.Join(kappDir, "shared"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(kappDir, "shared/main.tf"), []byte{}, 0644)
+	assert.Nil(t, err)
+
+	_, err = findTerraformDir(kappObj)
+	assert.NotNil(t, err)
+}
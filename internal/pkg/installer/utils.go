@@ -17,14 +17,153 @@
 package installer
 
 import (
+	"context"
 	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// How long to wait for commands to exit after asking them to stop before
+// killing them
+const STOP_GRACE_PERIOD = 30 * time.Second
+
+// Process group IDs of commands started by runCommand that haven't exited yet
+var runningCommands = struct {
+	sync.Mutex
+	pgids map[int]bool
+}{pgids: make(map[int]bool)}
+
+// Kills the process groups of all commands that are still running. Commands
+// run in their own process groups so they aren't killed when sugarkube is, so
+// this should be called before exiting without waiting for them to stop.
+func KillRunningCommands() {
+	runningCommands.Lock()
+	defer runningCommands.Unlock()
+
+	for pgid := range runningCommands.pgids {
+		log.Warnf("Killing process group %d", pgid)
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+// Runs a command until it exits or the context is done. If the context is
+// done the command is sent SIGTERM so it can clean up (e.g. release terraform
+// state locks), and killed if it hasn't exited after STOP_GRACE_PERIOD. The
+// command is run in its own process group and signals are sent to the whole
+// group, so e.g. terraform processes started by make are stopped too.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	err := cmd.Start()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// the process group ID is the PID since it leads the group
+	pgid := cmd.Process.Pid
+	runningCommands.Lock()
+	runningCommands.pgids[pgid] = true
+	runningCommands.Unlock()
+
+	defer func() {
+		runningCommands.Lock()
+		delete(runningCommands.pgids, pgid)
+		runningCommands.Unlock()
+	}()
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-waitCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Warnf("Stopping command %s: %s", cmd.Path, ctx.Err())
+
+	// a negative PID signals the process group
+	err = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	if err != nil {
+		log.Warnf("Error sending SIGTERM to command %s: %s", cmd.Path, err)
+	}
+
+	select {
+	case <-waitCh:
+	case <-time.After(STOP_GRACE_PERIOD):
+		log.Warnf("Killing command %s after waiting %s for it to exit",
+			cmd.Path, STOP_GRACE_PERIOD)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-waitCh
+	}
+
+	return errors.Wrapf(ctx.Err(), "Command %s was stopped", cmd.Path)
+}
+
+// Returns the exit status of a command that exited with an error, or -1 if it
+// didn't run or was killed by a signal
+func exitStatus(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+
+	return -1
+}
+
+// Returns the current user's home dir
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return usr.HomeDir, nil
+}
+
+// Returns the directories to search for a kapp's files, i.e. its configured
+// search paths or its root dir. Search paths are usually symlinked sources so
+// are resolved so they can be walked.
+func searchDirs(kappObj *kapp.Kapp) ([]string, error) {
+	searchPaths := kappObj.MergedInstallerConfig().SearchPaths
+	if len(searchPaths) == 0 {
+		return []string{kappObj.RootDir}, nil
+	}
+
+	dirs := make([]string, 0)
+	for _, searchPath := range searchPaths {
+		dir, err := filepath.EvalSymlinks(filepath.Join(kappObj.RootDir, searchPath))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid search path '%s' for kapp '%s'",
+				searchPath, kappObj.Id)
+		}
+
+		dirs = append(dirs, dir)
+	}
+
+	return dirs, nil
+}
+
 // Search for files in a directory matching a regex, optionally recursively.
 // If preferSymlinks is true, return paths will be replaced by symlinks where
 // possible.
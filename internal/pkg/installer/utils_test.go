@@ -17,9 +17,16 @@
 package installer
 
 import (
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 const testDir = "../../testdata"
@@ -106,3 +113,101 @@ func TestFindFilesByPattern(t *testing.T) {
 		assert.Equal(t, test.expectValues, result, "unexpected files returned for %s", test.name)
 	}
 }
+
+func TestRunCommand(t *testing.T) {
+	err := runCommand(context.Background(), exec.Command("true"))
+	assert.Nil(t, err)
+
+	err = runCommand(context.Background(), exec.Command("false"))
+	assert.NotNil(t, err)
+
+	// commands are stopped when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = runCommand(ctx, exec.Command("sleep", "10"))
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "command wasn't stopped")
+
+	// child processes are stopped too
+	tempDir, err := ioutil.TempDir("", "run-command-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	marker := filepath.Join(tempDir, "stopped")
+	child := fmt.Sprintf(`trap "touch %s; exit 0" TERM; while true; do sleep 0.1; done`, marker)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err = runCommand(ctx, exec.Command("sh", "-c", fmt.Sprintf("sh -c '%s' & wait", child)))
+	assert.NotNil(t, err)
+
+	stopped := false
+	for i := 0; i < 20 && !stopped; i++ {
+		_, err = os.Stat(marker)
+		stopped = err == nil
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, stopped, "child process wasn't sent SIGTERM")
+}
+
+func TestKillRunningCommands(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "run-command-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// the child ignores SIGTERM and records its PID
+	pidFile := filepath.Join(tempDir, "pid")
+	child := fmt.Sprintf(`trap "" TERM; echo $$ > %s; while true; do sleep 0.1; done`, pidFile)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runCommand(context.Background(),
+			exec.Command("sh", "-c", fmt.Sprintf("sh -c '%s' & wait", child)))
+	}()
+
+	var childPid string
+	for i := 0; i < 50 && childPid == ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+		data, _ := ioutil.ReadFile(pidFile)
+		childPid = strings.TrimSpace(string(data))
+	}
+	assert.NotEmpty(t, childPid, "child process didn't start")
+
+	KillRunningCommands()
+
+	select {
+	case err = <-errCh:
+		assert.NotNil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("command wasn't killed")
+	}
+
+	// the child is gone once it's no longer listed or is a zombie waiting to
+	// be reaped
+	gone := false
+	for i := 0; i < 20 && !gone; i++ {
+		out, _ := exec.Command("ps", "-o", "stat=", "-p", childPid).Output()
+		state := strings.TrimSpace(string(out))
+		gone = state == "" || strings.HasPrefix(state, "Z")
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, gone, "child process wasn't killed")
+
+	runningCommands.Lock()
+	assert.Empty(t, runningCommands.pgids)
+	runningCommands.Unlock()
+}
+
+func TestExitStatus(t *testing.T) {
+	err := exec.Command("sh", "-c", "exit 1").Run()
+	assert.Equal(t, 1, exitStatus(err))
+
+	err = exec.Command("sh", "-c", "exit 3").Run()
+	assert.Equal(t, 3, exitStatus(err))
+
+	err = exec.Command("/nonexistent").Run()
+	assert.Equal(t, -1, exitStatus(err))
+}
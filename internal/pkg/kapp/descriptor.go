@@ -0,0 +1,189 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kapp
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the file kapps can describe themselves in
+const DESCRIPTOR_FILE = "sugarkube.yaml"
+
+// Keys in a descriptor's targets
+const INSTALL_TARGET_KEY = "install"
+const DESTROY_TARGET_KEY = "destroy"
+
+// Key of an optional target run after a kapp's been installed to write its
+// outputs
+const OUTPUT_TARGET_KEY = "output"
+
+// Metadata a kapp declares about itself in a `sugarkube.yaml` file, either in
+// the kapp's root dir or at the top level of one of its sources. This lets
+// e.g. CI/CD systems know in advance which secrets a kapp needs.
+type Descriptor struct {
+	// interfaces the kapp implements in addition to any identified by
+	// inspecting it (e.g. 'helm', 'terraform')
+	Interfaces []string `yaml:"interfaces,omitempty" json:"interfaces,omitempty"`
+	// env vars that must be set when the kapp is installed/destroyed
+	EnvVars []EnvVar `yaml:"env_vars,omitempty" json:"env_vars,omitempty"`
+	// secrets that must be made available as env vars when the kapp is
+	// installed/destroyed
+	Secrets []EnvVar `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+	// which installer to use and how, as in manifests
+	Installer InstallerConfig `yaml:"installer,omitempty" json:"installer,omitempty"`
+	// YAML files or directories, or kustomization directories, relative to
+	// the kapp root dir for the kubectl installer to apply in order
+	Resources []string `yaml:"resources,omitempty" json:"resources,omitempty"`
+	// make targets to run instead of the defaults, keyed by 'install' or
+	// 'destroy', and an optional 'output' target to run after installing
+	Targets map[string]string `yaml:"targets,omitempty" json:"targets,omitempty"`
+	// files to render with 'kapps init', e.g. values.yaml files that depend on
+	// the target stack
+	Templates []Template `yaml:"templates,omitempty" json:"templates,omitempty"`
+	// values the kapp outputs once it's installed
+	Outputs []Output `yaml:"outputs,omitempty" json:"outputs,omitempty"`
+	// kapps that must be installed before this one, as in manifests
+	DependsOn []string `yaml:"depends_on,omitempty" json:"depends_on,omitempty"`
+}
+
+type EnvVar struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+}
+
+// A template to render. Paths are relative to the kapp's root dir. If no dest
+// is given, files are rendered next to the template as '_generated_<name>'
+// with any '.tpl' extension removed.
+type Template struct {
+	Source string `yaml:"source" json:"source"`
+	Dest   string `yaml:"dest,omitempty" json:"dest,omitempty"`
+}
+
+type Output struct {
+	Name string `yaml:"name" json:"name"`
+	// path of the file the kapp writes the output to, relative to its root dir
+	Path        string `yaml:"path" json:"path"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+}
+
+// Returns the path to a kapp's descriptor, or an empty string if it doesn't
+// have one. It's an error for a kapp to have several.
+func FindDescriptor(kappRootDir string) (string, error) {
+	candidates := []string{filepath.Join(kappRootDir, DESCRIPTOR_FILE)}
+
+	// sources are symlinked into the kapp root dir
+	sourcePaths, err := filepath.Glob(filepath.Join(kappRootDir, "*", DESCRIPTOR_FILE))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	candidates = append(candidates, sourcePaths...)
+
+	found := make([]string, 0)
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			found = append(found, candidate)
+		}
+	}
+
+	if len(found) > 1 {
+		return "", errors.New(fmt.Sprintf("Kapp in '%s' has multiple '%s' "+
+			"files: %s", kappRootDir, DESCRIPTOR_FILE, strings.Join(found, ", ")))
+	}
+
+	if len(found) == 0 {
+		return "", nil
+	}
+
+	return found[0], nil
+}
+
+// Loads the descriptor of a kapp in a directory. Returns nil if the kapp
+// doesn't have one.
+func LoadDescriptor(kappRootDir string) (*Descriptor, error) {
+	path, err := FindDescriptor(kappRootDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading kapp descriptor '%s'", path)
+	}
+
+	descriptor, err := parseDescriptor(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid kapp descriptor '%s'", path)
+	}
+
+	return descriptor, nil
+}
+
+// Parses and validates a kapp descriptor
+func parseDescriptor(data []byte) (*Descriptor, error) {
+	descriptor := Descriptor{}
+	err := yaml.UnmarshalStrict(data, &descriptor)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for action := range descriptor.Targets {
+		if action != INSTALL_TARGET_KEY && action != DESTROY_TARGET_KEY &&
+			action != OUTPUT_TARGET_KEY {
+			return nil, errors.New(fmt.Sprintf("Unknown action '%s' in "+
+				"targets. Only '%s', '%s' and '%s' can be set", action,
+				INSTALL_TARGET_KEY, DESTROY_TARGET_KEY, OUTPUT_TARGET_KEY))
+		}
+	}
+
+	for _, template := range descriptor.Templates {
+		if template.Source == "" {
+			return nil, errors.New(fmt.Sprintf("Templates must have a "+
+				"source, got: %#v", template))
+		}
+	}
+
+	for _, output := range descriptor.Outputs {
+		if output.Name == "" || output.Path == "" {
+			return nil, errors.New(fmt.Sprintf("Outputs must have a name "+
+				"and path, got: %#v", output))
+		}
+	}
+
+	return &descriptor, nil
+}
+
+// Returns the make target to run to install or destroy the kapp, or
+// `defaultTarget` if the descriptor doesn't override it
+func (d *Descriptor) Target(action string, defaultTarget string) string {
+	if d != nil {
+		if target, ok := d.Targets[action]; ok && target != "" {
+			return target
+		}
+	}
+
+	return defaultTarget
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kapp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDescriptor(t *testing.T) {
+	tests := []struct {
+		name          string
+		desc          string
+		input         string
+		expectValues  *Descriptor
+		expectedError bool
+	}{
+		{
+			name: "good_parse",
+			desc: "check parsing acceptable input works",
+			input: `
+interfaces:
+- helm
+env_vars:
+- name: DOMAIN
+secrets:
+- name: DB_PASSWORD
+  description: password for the admin user
+installer:
+  makefile: kapp/Makefile
+  params:
+    REPLICAS: "2"
+resources:
+- crds
+- overlays/dev
+targets:
+  install: deploy
+  output: output
+templates:
+- source: values.yaml.tpl
+- source: terraform/vars.tfvars.tpl
+  dest: terraform/_generated_vars.tfvars
+outputs:
+- name: db_host
+  path: outputs/db-host.txt
+depends_on:
+- core:nginx-ingress
+`,
+			expectValues: &Descriptor{
+				Interfaces: []string{"helm"},
+				EnvVars:    []EnvVar{{Name: "DOMAIN"}},
+				Secrets: []EnvVar{{Name: "DB_PASSWORD",
+					Description: "password for the admin user"}},
+				Installer: InstallerConfig{
+					Makefile: "kapp/Makefile",
+					Params:   map[string]string{"REPLICAS": "2"},
+				},
+				Resources: []string{"crds", "overlays/dev"},
+				Targets: map[string]string{INSTALL_TARGET_KEY: "deploy",
+					OUTPUT_TARGET_KEY: "output"},
+				Templates: []Template{{Source: "values.yaml.tpl"},
+					{Source: "terraform/vars.tfvars.tpl", Dest: "terraform/_generated_vars.tfvars"}},
+				Outputs:   []Output{{Name: "db_host", Path: "outputs/db-host.txt"}},
+				DependsOn: []string{"core:nginx-ingress"},
+			},
+		},
+		{
+			name:          "unknown_field",
+			desc:          "check typos are reported instead of ignored",
+			input:         "secret:\n- name: DB_PASSWORD\n",
+			expectedError: true,
+		},
+		{
+			name:          "unknown_target",
+			desc:          "check only install and destroy targets can be overridden",
+			input:         "targets:\n  upgrade: deploy\n",
+			expectedError: true,
+		},
+		{
+			name:          "template_without_source",
+			desc:          "check templates must say what to render",
+			input:         "templates:\n- dest: values.yaml\n",
+			expectedError: true,
+		},
+		{
+			name:          "output_without_path",
+			desc:          "check outputs must say where they're written",
+			input:         "outputs:\n- name: db_host\n",
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := parseDescriptor([]byte(test.input))
+		if test.expectedError {
+			assert.NotNil(t, err, "unexpected success for %s", test.name)
+			assert.Nil(t, result)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+			assert.Equal(t, test.expectValues, result, "unexpected result for %s", test.name)
+		}
+	}
+}
+
+func TestLoadDescriptor(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "descriptor-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// kapps don't need a descriptor
+	descriptor, err := LoadDescriptor(tempDir)
+	assert.Nil(t, err)
+	assert.Nil(t, descriptor)
+
+	// descriptors can be in one of the kapp's sources
+	sourceDir := filepath.Join(tempDir, "source")
+	err = os.MkdirAll(sourceDir, 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(sourceDir, DESCRIPTOR_FILE),
+		[]byte("installer: helm\n"), 0644)
+	assert.Nil(t, err)
+
+	descriptor, err = LoadDescriptor(tempDir)
+	assert.Nil(t, err)
+	assert.Equal(t, &Descriptor{Installer: InstallerConfig{Name: "helm"}}, descriptor)
+	assert.Equal(t, "deploy", descriptor.Target(INSTALL_TARGET_KEY, "deploy"))
+
+	// but there can only be one
+	err = ioutil.WriteFile(filepath.Join(tempDir, DESCRIPTOR_FILE), []byte{}, 0644)
+	assert.Nil(t, err)
+
+	_, err = LoadDescriptor(tempDir)
+	assert.NotNil(t, err)
+}
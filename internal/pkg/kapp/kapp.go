@@ -17,44 +17,112 @@
 package kapp
 
 import (
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
 	"github.com/sugarkube/sugarkube/internal/pkg/convert"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"gopkg.in/yaml.v2"
 	"sort"
+	"time"
 )
 
-type installerConfig struct {
-	kapp         string
-	searchValues []string
-	params       map[string]string
+// Settings for installers that can be given in a manifest or in a kapp's
+// descriptor. Settings in manifests take precedence.
+type InstallerConfig struct {
+	// name of the installer to use. Defaults to the stack's installer.
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// path to the Makefile to run relative to the kapp's root dir, or to a
+	// directory containing it (e.g. a source name). Must be set if the kapp
+	// contains several Makefiles.
+	Makefile string `yaml:"makefile,omitempty" json:"makefile,omitempty"`
+	// paths relative to the kapp's root dir to search for Makefiles and
+	// values files instead of the whole kapp
+	SearchPaths []string `yaml:"search_paths,omitempty" json:"search_paths,omitempty"`
+	// extra variables to pass to the installer, e.g. to make or as helm values
+	Params map[string]string `yaml:"params,omitempty" json:"params,omitempty"`
+	// container image to run make in, so kapps are installed with pinned
+	// versions of tools. Defaults to the stack's installer image.
+	Image string `yaml:"image,omitempty" json:"image,omitempty"`
+}
+
+// Installer settings can also just be the name of the installer, e.g.
+// `installer: helm`
+func (c *InstallerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	err := unmarshal(&name)
+	if err == nil {
+		*c = InstallerConfig{Name: name}
+		return nil
+	}
+
+	// unmarshal into a type without this method to avoid recursing
+	type rawInstallerConfig InstallerConfig
+	raw := rawInstallerConfig{}
+	err = unmarshal(&raw)
+	if err != nil {
+		return err
+	}
+
+	*c = InstallerConfig(raw)
+	return nil
 }
 
 type Kapp struct {
 	Id string
+	// ID of the manifest the kapp is in. Set when the kapp is processed.
+	ManifestId string
 	// if true, this kapp should be present after completing, otherwise it
 	// should be absent. This is here instead of e.g. putting all kapps into
 	// an enclosing struct with 'present' and 'absent' properties so we can
 	// preserve ordering. This approach lets users strictly define the ordering
 	// of installation and deletion operations.
 	ShouldBePresent bool
-	installerConfig installerConfig
+	// optional version of the kapp. If set, sources-of-truth will only treat
+	// the kapp as installed if it's installed at this version.
+	Version string
+	// kapps that must be installed before this one (and destroyed after it),
+	// as `<manifest ID>:<kapp ID>`, or just a kapp ID for kapps in the same
+	// manifest
+	DependsOn []string
+	// how long the kapp's installer may run for before it's stopped. Zero
+	// means use the default for the run.
+	Timeout         time.Duration
+	InstallerConfig InstallerConfig
 	Sources         []acquirer.Acquirer
-	RootDir         string // root directory in a cache dir
+	RootDir         string      // root directory in a cache dir
+	Descriptor      *Descriptor // loaded from the kapp's sugarkube.yaml if it has one
+	// outputs of other kapps in the stack to pass to the kapp's installer,
+	// keyed by env var name
+	Inputs map[string]string
 }
 
 const PRESENT_KEY = "present"
 const ABSENT_KEY = "absent"
 const SOURCES_KEY = "sources"
+const VERSION_KEY = "version"
+const DEPENDS_ON_KEY = "depends_on"
+const TIMEOUT_KEY = "timeout"
+const INSTALLER_KEY = "installer"
+
+// Parses kapps and adds them to an array. Relative paths to local sources are
+// resolved against `baseDir`.
+func parseKapps(kapps *[]Kapp, kappDefinitions map[interface{}]interface{},
+	shouldBePresent bool, baseDir string) error {
 
-// Parses kapps and adds them to an array
-func parseKapps(kapps *[]Kapp, kappDefinitions map[interface{}]interface{}, shouldBePresent bool) error {
+	// sort the kapp IDs for determinism since map iteration order is random
+	kappIds := make([]string, 0)
+	for k := range kappDefinitions {
+		kappIds = append(kappIds, k.(string))
+	}
+	sort.Strings(kappIds)
 
 	// parse each kapp definition
-	for k, v := range kappDefinitions {
+	for _, kappId := range kappIds {
+		v := kappDefinitions[kappId]
+
 		kapp := Kapp{
-			Id:              k.(string),
+			Id:              kappId,
 			ShouldBePresent: shouldBePresent,
 		}
 
@@ -74,6 +142,44 @@ func parseKapps(kapps *[]Kapp, kappDefinitions map[interface{}]interface{}, shou
 
 		log.Debugf("Marshalled sources YAML: %s", sourcesBytes)
 
+		if version, ok := valuesMap[VERSION_KEY]; ok {
+			kapp.Version = fmt.Sprintf("%v", version)
+		}
+
+		if dependsOn, ok := valuesMap[DEPENDS_ON_KEY]; ok {
+			dependencies, ok := dependsOn.([]interface{})
+			if !ok {
+				return errors.New(fmt.Sprintf("'%s' for kapp '%s' must be a "+
+					"list, got: %#v", DEPENDS_ON_KEY, kappId, dependsOn))
+			}
+
+			for _, dependency := range dependencies {
+				kapp.DependsOn = append(kapp.DependsOn, fmt.Sprintf("%v", dependency))
+			}
+		}
+
+		if timeout, ok := valuesMap[TIMEOUT_KEY]; ok {
+			kapp.Timeout, err = time.ParseDuration(fmt.Sprintf("%v", timeout))
+			if err != nil {
+				return errors.Wrapf(err, "Invalid '%s' for kapp '%s'",
+					TIMEOUT_KEY, kappId)
+			}
+		}
+
+		if installerSettings, ok := valuesMap[INSTALLER_KEY]; ok {
+			installerBytes, err := yaml.Marshal(installerSettings)
+			if err != nil {
+				return errors.Wrapf(err, "Error marshalling installer settings "+
+					"for kapp '%s'", kappId)
+			}
+
+			err = yaml.UnmarshalStrict(installerBytes, &kapp.InstallerConfig)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid '%s' for kapp '%s'",
+					INSTALLER_KEY, kappId)
+			}
+		}
+
 		sourcesMaps := []map[interface{}]interface{}{}
 		err = yaml.UnmarshalStrict(sourcesBytes, &sourcesMaps)
 		if err != nil {
@@ -90,6 +196,10 @@ func parseKapps(kapps *[]Kapp, kappDefinitions map[interface{}]interface{}, shou
 				return errors.WithStack(err)
 			}
 
+			if _, ok := sourceStringMap[acquirer.BASE_DIR]; !ok {
+				sourceStringMap[acquirer.BASE_DIR] = baseDir
+			}
+
 			acquirerImpl, err := acquirer.NewAcquirer(sourceStringMap)
 			if err != nil {
 				return errors.WithStack(err)
@@ -119,12 +229,12 @@ func parseKapps(kapps *[]Kapp, kappDefinitions map[interface{}]interface{}, shou
 }
 
 // Parses manifest YAML data and returns a list of kapps
-func parseManifestYaml(data map[string]interface{}) ([]Kapp, error) {
+func parseManifestYaml(data map[string]interface{}, baseDir string) ([]Kapp, error) {
 	kapps := make([]Kapp, 0)
 
 	presentKapps, ok := data[PRESENT_KEY]
 	if ok {
-		err := parseKapps(&kapps, presentKapps.(map[interface{}]interface{}), true)
+		err := parseKapps(&kapps, presentKapps.(map[interface{}]interface{}), true, baseDir)
 		if err != nil {
 			return nil, errors.Wrap(err, "Error parsing present kapps")
 		}
@@ -132,7 +242,7 @@ func parseManifestYaml(data map[string]interface{}) ([]Kapp, error) {
 
 	absentKapps, ok := data[ABSENT_KEY]
 	if ok {
-		err := parseKapps(&kapps, absentKapps.(map[interface{}]interface{}), false)
+		err := parseKapps(&kapps, absentKapps.(map[interface{}]interface{}), false, baseDir)
 		if err != nil {
 			return nil, errors.Wrap(err, "Error parsing absent kapps")
 		}
@@ -142,3 +252,40 @@ func parseManifestYaml(data map[string]interface{}) ([]Kapp, error) {
 
 	return kapps, nil
 }
+
+// Returns the kapp's installer settings, merging those in its manifest over
+// those in its descriptor
+func (k *Kapp) MergedInstallerConfig() InstallerConfig {
+	merged := InstallerConfig{
+		Params: make(map[string]string),
+	}
+
+	configs := []InstallerConfig{k.InstallerConfig}
+	if k.Descriptor != nil {
+		configs = []InstallerConfig{k.Descriptor.Installer, k.InstallerConfig}
+	}
+
+	for _, config := range configs {
+		if config.Name != "" {
+			merged.Name = config.Name
+		}
+
+		if config.Makefile != "" {
+			merged.Makefile = config.Makefile
+		}
+
+		if config.Image != "" {
+			merged.Image = config.Image
+		}
+
+		if len(config.SearchPaths) > 0 {
+			merged.SearchPaths = config.SearchPaths
+		}
+
+		for key, value := range config.Params {
+			merged.Params[key] = value
+		}
+	}
+
+	return merged
+}
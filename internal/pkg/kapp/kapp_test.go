@@ -21,6 +21,7 @@ import (
 	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
 	"gopkg.in/yaml.v2"
 	"testing"
+	"time"
 )
 
 func TestParseManifestYaml(t *testing.T) {
@@ -48,6 +49,17 @@ present:
       name: sampleNameB
 
   example2:
+    version: 0.1.0
+    depends_on:
+    - example1
+    - manifest2:example4
+    timeout: 10m
+    installer:
+      makefile: pathA
+      search_paths:
+      - pathA
+      params:
+        REPLICAS: 2
     sources:
     - uri: git@github.com:exampleA/repoA.git
       branch: branchA
@@ -80,6 +92,14 @@ absent:
 				{
 					Id:              "example2",
 					ShouldBePresent: true,
+					Version:         "0.1.0",
+					DependsOn:       []string{"example1", "manifest2:example4"},
+					Timeout:         10 * time.Minute,
+					InstallerConfig: InstallerConfig{
+						Makefile:    "pathA",
+						SearchPaths: []string{"pathA"},
+						Params:      map[string]string{"REPLICAS": "2"},
+					},
 					Sources: []acquirer.Acquirer{
 						acquirer.NewGitAcquirer(
 							"pathA",
@@ -102,6 +122,76 @@ absent:
 			},
 			expectedError: false,
 		},
+		{
+			name: "bad_depends_on",
+			desc: "check dependencies must be a list",
+			input: `
+present:
+  example1:
+    depends_on: example2
+    sources:
+    - uri: git@github.com:exampleA/repoA.git
+      branch: branchA
+      path: example/pathA
+`,
+			expectedError: true,
+		},
+		{
+			name: "installer_name",
+			desc: "check installers can be chosen by name",
+			input: `
+present:
+  example1:
+    installer: helm
+    sources:
+    - uri: git@github.com:exampleA/repoA.git
+      branch: branchA
+      path: example/pathA
+`,
+			expectValues: []Kapp{
+				{
+					Id:              "example1",
+					ShouldBePresent: true,
+					InstallerConfig: InstallerConfig{Name: "helm"},
+					Sources: []acquirer.Acquirer{
+						acquirer.NewGitAcquirer(
+							"pathA",
+							"git@github.com:exampleA/repoA.git",
+							"branchA",
+							"example/pathA"),
+					},
+				},
+			},
+		},
+		{
+			name: "bad_installer",
+			desc: "check unknown installer settings are errors",
+			input: `
+present:
+  example1:
+    installer:
+      makefiles: pathA
+    sources:
+    - uri: git@github.com:exampleA/repoA.git
+      branch: branchA
+      path: example/pathA
+`,
+			expectedError: true,
+		},
+		{
+			name: "bad_timeout",
+			desc: "check timeouts must be durations",
+			input: `
+present:
+  example1:
+    timeout: 10
+    sources:
+    - uri: git@github.com:exampleA/repoA.git
+      branch: branchA
+      path: example/pathA
+`,
+			expectedError: true,
+		},
 	}
 
 	for _, test := range tests {
@@ -109,7 +199,7 @@ absent:
 		err := yaml.Unmarshal([]byte(test.input), inputYaml)
 		assert.Nil(t, err)
 
-		result, err := parseManifestYaml(inputYaml)
+		result, err := parseManifestYaml(inputYaml, "")
 		if test.expectedError {
 			assert.NotNil(t, err)
 			assert.Nil(t, result)
@@ -119,3 +209,31 @@ absent:
 		}
 	}
 }
+
+func TestMergedInstallerConfig(t *testing.T) {
+	kappObj := Kapp{
+		InstallerConfig: InstallerConfig{
+			Makefile: "site1",
+			Params:   map[string]string{"REPLICAS": "3"},
+			Image:    "sugarkube/tools:1.1",
+		},
+		Descriptor: &Descriptor{
+			Installer: InstallerConfig{
+				Name:        "make",
+				Makefile:    "wordpress",
+				SearchPaths: []string{"wordpress"},
+				Params:      map[string]string{"REPLICAS": "1", "TIER": "web"},
+				Image:       "sugarkube/tools:1.0",
+			},
+		},
+	}
+
+	// manifest settings override the descriptor's
+	assert.Equal(t, InstallerConfig{
+		Name:        "make",
+		Makefile:    "site1",
+		SearchPaths: []string{"wordpress"},
+		Params:      map[string]string{"REPLICAS": "3", "TIER": "web"},
+		Image:       "sugarkube/tools:1.1",
+	}, kappObj.MergedInstallerConfig())
+}
@@ -19,18 +19,28 @@ package kapp
 import (
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"github.com/sugarkube/sugarkube/internal/pkg/vars"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
+const GIT_DEFAULT_BRANCH = "master"
+
+// key in a stack config's manifest settings for the manifest ID. All other
+// settings are passed to the manifest's acquirer.
+const MANIFEST_ID_KEY = "id"
+
 type Manifest struct {
 	// defaults to the file basename, but can be explicitly specified to avoid
 	// clashes. This is also used to namespace entries in the cache.
-	Id    string
-	Uri   string
-	Kapps []Kapp
+	Id     string
+	Uri    string
+	Source acquirer.Acquirer `yaml:"-"` // acquirer for the manifest file itself
+	Kapps  []Kapp
 }
 
 func newManifest(uri string) Manifest {
@@ -44,44 +54,122 @@ func newManifest(uri string) Manifest {
 
 // Sets fields to default values
 func SetManifestDefaults(manifest *Manifest) {
-	// use the basename after stripping the extension by default
-	// todo - get this from the acquirer for the manifest
-	defaultId := strings.Replace(filepath.Base(manifest.Uri), filepath.Ext(manifest.Uri), "", 1)
+	// use the name of the acquired manifest (or the URI basename if it hasn't
+	// been acquired) after stripping the extension by default
+	name := filepath.Base(manifest.Uri)
+	if manifest.Source != nil {
+		name = manifest.Source.Name()
+	}
+
+	defaultId := strings.TrimSuffix(name, filepath.Ext(name))
 
 	if manifest.Id == "" {
 		manifest.Id = defaultId
 	}
 }
 
-// Load a single manifest file and parse the kapps it defines
-// todo - change this to use an acquirer. Use the ID defined in the manifest
-// settings YAML, or default to the manifest file basename.
-func ParseManifestFile(path string) (*Manifest, error) {
-	log.Debugf("Parsing manifest: %s", path)
+// Parses a manifest URI given on the command line into acquirer settings.
+// Manifests in git repos are given as `<uri>.git//<path>[#<branch>]`, e.g.
+// `git@github.com:org/manifests.git//core/manifest.yaml#master`. Anything else
+// is treated as a local path. The branch defaults to `master`.
+func parseManifestUri(uri string) map[string]string {
+	parts := strings.SplitN(uri, ".git//", 2)
+	if len(parts) != 2 {
+		return map[string]string{
+			acquirer.URI: uri,
+		}
+	}
+
+	path := parts[1]
+	branch := GIT_DEFAULT_BRANCH
 
-	data, err := vars.LoadYamlFile(path)
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		branch = path[i+1:]
+		path = path[:i]
+	}
+
+	return map[string]string{
+		acquirer.ACQUIRER_KEY: acquirer.GIT,
+		acquirer.URI:          parts[0] + ".git",
+		acquirer.BRANCH:       branch,
+		acquirer.PATH:         path,
+	}
+}
+
+// Acquires a manifest file with an acquirer created from `settings` and
+// parses the kapps it defines. Relative URIs are resolved against `baseDir`
+// (or the current working directory if it's empty).
+func acquireManifest(id string, settings map[string]string, baseDir string) (*Manifest, error) {
+	manifest := Manifest{
+		Id:  id,
+		Uri: settings[acquirer.URI],
+	}
+
+	log.Debugf("Acquiring manifest: %s", manifest.Uri)
+
+	if _, ok := settings[acquirer.BASE_DIR]; !ok {
+		settings[acquirer.BASE_DIR] = baseDir
+	}
+
+	acquirerImpl, err := acquirer.NewAcquirer(settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error creating acquirer for manifest %s",
+			manifest.Uri)
+	}
+
+	tempDir, err := ioutil.TempDir("", "sugarkube-manifest-")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dest := filepath.Join(tempDir, acquirerImpl.Name())
+	err = acquirer.Acquire(acquirerImpl, dest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error acquiring manifest %s", manifest.Uri)
+	}
+
+	manifestPath := filepath.Join(dest, acquirerImpl.Path())
+
+	data, err := vars.LoadYamlFile(manifestPath)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
 	log.Debugf("Loaded manifest data: %#v", data)
 
-	kapps, err := parseManifestYaml(data)
+	// local kapp sources are relative to local manifests
+	kappsBaseDir := baseDir
+	if _, ok := acquirerImpl.(acquirer.FileAcquirer); ok {
+		realPath, err := filepath.EvalSymlinks(manifestPath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		kappsBaseDir = filepath.Dir(realPath)
+	}
 
-	manifest := newManifest(path)
+	kapps, err := parseManifestYaml(data, kappsBaseDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing manifest %s", manifest.Uri)
+	}
+
+	manifest.Source = acquirerImpl
 	manifest.Kapps = kapps
+	SetManifestDefaults(&manifest)
 
 	return &manifest, nil
 }
 
-// Parses manifest files and returns a list of manifests on success
-func ParseManifests(manifestPaths []string) ([]Manifest, error) {
-	log.Debugf("Parsing %d manifest(s)", len(manifestPaths))
+// Acquires manifest files and returns a list of manifests on success. Local
+// paths are relative to the current working directory. See parseManifestUri
+// for the syntax of manifests in git repos.
+func ParseManifests(manifestUris []string) ([]Manifest, error) {
+	log.Debugf("Parsing %d manifest(s)", len(manifestUris))
 
 	manifests := make([]Manifest, 0)
 
-	for _, manifestPath := range manifestPaths {
-		manifest, err := ParseManifestFile(manifestPath)
+	for _, manifestUri := range manifestUris {
+		manifest, err := acquireManifest("", parseManifestUri(manifestUri), "")
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -18,6 +18,10 @@ package kapp
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -74,6 +78,16 @@ func TestSetManifestDefaults(t *testing.T) {
 			input:    newManifest("example/manifest.yaml"),
 			expected: "manifest",
 		},
+		{
+			name: "acquired",
+			desc: "default IDs of acquired manifests should come from the acquirer",
+			input: Manifest{
+				Uri: "git@github.com:org/manifests.git",
+				Source: acquirer.NewGitAcquirer("", "git@github.com:org/manifests.git",
+					"master", "core/core-manifest.yaml"),
+			},
+			expected: "core-manifest",
+		},
 	}
 
 	for _, test := range tests {
@@ -81,3 +95,94 @@ func TestSetManifestDefaults(t *testing.T) {
 		assert.Equal(t, test.expected, test.input.Id)
 	}
 }
+
+func TestParseManifestUri(t *testing.T) {
+	tests := []struct {
+		name     string
+		desc     string
+		input    string
+		expected map[string]string
+	}{
+		{
+			name:  "local",
+			desc:  "local paths should just set the URI",
+			input: "manifests/manifest1.yaml",
+			expected: map[string]string{
+				"uri": "manifests/manifest1.yaml",
+			},
+		},
+		{
+			name:  "git_branch",
+			desc:  "git URIs should be split into the repo, path and branch",
+			input: "git@github.com:org/manifests.git//core/manifest.yaml#release/1.0",
+			expected: map[string]string{
+				"acquirer": "git",
+				"uri":      "git@github.com:org/manifests.git",
+				"path":     "core/manifest.yaml",
+				"branch":   "release/1.0",
+			},
+		},
+		{
+			name:  "git_default_branch",
+			desc:  "the branch should default to master",
+			input: "git@github.com:org/manifests.git//core/manifest.yaml",
+			expected: map[string]string{
+				"acquirer": "git",
+				"uri":      "git@github.com:org/manifests.git",
+				"path":     "core/manifest.yaml",
+				"branch":   "master",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, parseManifestUri(test.input),
+			"unexpected settings for %s", test.name)
+	}
+}
+
+func TestParseManifestsLocalSources(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "manifest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	manifestDir := filepath.Join(tempDir, "manifests")
+	err = os.MkdirAll(manifestDir, 0755)
+	assert.Nil(t, err)
+
+	manifestPath := filepath.Join(manifestDir, "local.yaml")
+	err = ioutil.WriteFile(manifestPath, []byte(`present:
+  kappA:
+    sources:
+    - uri: ../kapps
+      path: kappA
+`), 0644)
+	assert.Nil(t, err)
+
+	source, err := acquirer.NewFileAcquirer("", filepath.Join(tempDir, "kapps"),
+		"kappA", false, manifestDir)
+	assert.Nil(t, err)
+
+	manifestSource, err := acquirer.NewFileAcquirer("", manifestPath, "", false, "")
+	assert.Nil(t, err)
+
+	expected := []Manifest{
+		{
+			Id:     "local",
+			Uri:    manifestPath,
+			Source: manifestSource,
+			Kapps: []Kapp{
+				{
+					Id:              "kappA",
+					ShouldBePresent: true,
+					Sources:         []acquirer.Acquirer{source},
+				},
+			},
+		},
+	}
+
+	// local sources should be relative to the manifest
+	actual, err := ParseManifests([]string{manifestPath})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
@@ -19,6 +19,7 @@ package kapp
 import (
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/convert"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"github.com/sugarkube/sugarkube/internal/pkg/vars"
 	"gopkg.in/yaml.v2"
@@ -34,6 +35,8 @@ type ClusterStatus struct {
 	SleepBeforeReadyCheck uint32 // number of seconds to sleep before polling the cluster for readiness
 }
 
+const MANIFESTS_KEY = "manifests"
+
 type StackConfig struct {
 	Name          string
 	FilePath      string
@@ -43,11 +46,58 @@ type StackConfig struct {
 	Region        string
 	Profile       string
 	Cluster       string
-	VarsFilesDirs []string `yaml:"vars"`
-	Manifests     []Manifest
-	Status        ClusterStatus
-	OnlineTimeout uint32
-	ReadyTimeout  uint32
+	VarsFilesDirs []string   `yaml:"vars"`
+	Manifests     []Manifest `yaml:"-"`        // acquired from the raw settings in the stack file
+	KappSot       string     `yaml:"kapp_sot"` // name of the source-of-truth for installed kapps
+	// name of the installer for kapps that don't choose one. Defaults to make.
+	Installer string `yaml:"installer"`
+	// container image to run make in for kapps that don't choose one. Make
+	// is run on the host if neither sets one.
+	InstallerImage string `yaml:"installer_image"`
+	// binary used to run installer images, e.g. docker or podman
+	ContainerRuntime string `yaml:"container_runtime"`
+	// if true, all kapp sources must be git tags signed by a trusted GPG key
+	RequireSignedTags bool     `yaml:"require_signed_tags"`
+	TrustedGpgKeys    []string `yaml:"trusted_gpg_keys"`
+	// path to a file of kapp interface definitions to add to/override the
+	// defaults, relative to the stack config file
+	KappInterfaces string `yaml:"kapp_interfaces"`
+	Status         ClusterStatus
+	OnlineTimeout  uint32
+	ReadyTimeout   uint32
+}
+
+// Returns the settings for each manifest in a stack config. Each manifest is
+// a map of acquirer settings plus an optional ID.
+func parseStackManifests(rawManifests interface{}) ([]map[string]string, error) {
+	manifests := make([]map[string]string, 0)
+
+	if rawManifests == nil {
+		return manifests, nil
+	}
+
+	manifestList, ok := rawManifests.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Manifests must be a list, got: %#v",
+			rawManifests))
+	}
+
+	for _, rawManifest := range manifestList {
+		manifestMap, ok := rawManifest.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Manifests must be maps of "+
+				"acquirer settings, got: %#v", rawManifest))
+		}
+
+		settings, err := convert.MapInterfaceInterfaceToMapStringString(manifestMap)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		manifests = append(manifests, settings)
+	}
+
+	return manifests, nil
 }
 
 // Validates that there aren't multiple manifests in the stack config with the
@@ -109,29 +159,32 @@ func LoadStackConfig(name string, path string) (*StackConfig, error) {
 
 	log.Debugf("Loaded stack config: %#v", stack)
 
-	// at this point stack.Manifest only contains a list of URIs. We need to
-	// acquire and parse them.
+	// manifests are only defined by their acquirer settings at this point. We
+	// need to acquire and parse them.
 	log.Debug("Parsing manifests")
 
-	for i, manifest := range stack.Manifests {
-		// todo - convert these to be managed by acquirers. The file acquirer
-		// needs to convert relative paths to absolute.
-		uri := manifest.Uri
-		if !filepath.IsAbs(uri) {
-			uri = filepath.Join(stack.Dir(), uri)
-		}
+	stackConfigMap, ok := stackConfig.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Stack '%s' in stack file %s "+
+			"isn't a map", name, path))
+	}
+
+	manifests, err := parseStackManifests(stackConfigMap[MANIFESTS_KEY])
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing manifests for stack '%s'", name)
+	}
+
+	for _, settings := range manifests {
+		id := settings[MANIFEST_ID_KEY]
+		delete(settings, MANIFEST_ID_KEY)
 
-		// parse the manifests and add them back to the stack
-		parsedManifest, err := ParseManifestFile(uri)
+		// relative manifest URIs are relative to the stack config file
+		acquiredManifest, err := acquireManifest(id, settings, stack.Dir())
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 
-		// todo - remove this. It should be handled by an acquirer
-		SetManifestDefaults(&manifest)
-		parsedManifest.Id = manifest.Id
-
-		stack.Manifests[i] = *parsedManifest
+		stack.Manifests = append(stack.Manifests, *acquiredManifest)
 	}
 
 	return &stack, nil
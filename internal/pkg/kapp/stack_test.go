@@ -38,6 +38,14 @@ func TestLoadStackConfigDir(t *testing.T) {
 }
 
 func TestLoadStackConfig(t *testing.T) {
+	manifest1Source, err := acquirer.NewFileAcquirer("",
+		"manifests/manifest1.yaml", "", false, "../../testdata")
+	assert.Nil(t, err)
+
+	manifest2Source, err := acquirer.NewFileAcquirer("",
+		"manifests/manifest2.yaml", "", false, "../../testdata")
+	assert.Nil(t, err)
+
 	expected := &StackConfig{
 		Name:        "large",
 		FilePath:    "../../testdata/stacks.yaml",
@@ -50,8 +58,9 @@ func TestLoadStackConfig(t *testing.T) {
 		},
 		Manifests: []Manifest{
 			{
-				Id:  "manifest1",
-				Uri: "../../testdata/manifests/manifest1.yaml",
+				Id:     "manifest1",
+				Uri:    "manifests/manifest1.yaml",
+				Source: manifest1Source,
 				Kapps: []Kapp{
 					{
 						Id:              "kappA",
@@ -67,8 +76,9 @@ func TestLoadStackConfig(t *testing.T) {
 				},
 			},
 			{
-				Id:  "exampleManifest2",
-				Uri: "../../testdata/manifests/manifest2.yaml",
+				Id:     "exampleManifest2",
+				Uri:    "manifests/manifest2.yaml",
+				Source: manifest2Source,
 				Kapps: []Kapp{
 					{
 						Id:              "kappB",
@@ -21,44 +21,63 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
 	"gopkg.in/yaml.v2"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 // Uses Helm to determine which kapps are already installed in a target cluster
 type HelmKappSot struct {
-	charts HelmOutput
+	charts       HelmOutput
+	providerImpl provider.Provider
 }
 
 // Wrapper around Helm output
 type HelmOutput struct {
-	Next     string
-	Releases []HelmRelease
+	Next     string        `yaml:"Next"`
+	Releases []HelmRelease `yaml:"Releases"`
 }
 
 // struct returned by `helm list --output yaml`
 type HelmRelease struct {
-	AppVersion string
-	Chart      string
-	Name       string
-	Namespace  string
-	Revision   int
-	Status     string
-	Updated    string
+	AppVersion string `yaml:"AppVersion"`
+	Chart      string `yaml:"Chart"`
+	Name       string `yaml:"Name"`
+	Namespace  string `yaml:"Namespace"`
+	Revision   int    `yaml:"Revision"`
+	Status     string `yaml:"Status"`
+	Updated    string `yaml:"Updated"`
 }
 
+// todo - make configurable
+const HELM_PATH = "helm"
+const KUBE_CONTEXT_KEY = "kube_context"
+
 // Refreshes the list of Helm charts
-func (s HelmKappSot) refresh() error {
-	var stdout bytes.Buffer
-	// todo - add the --kube-context
-	cmd := exec.Command("helm", "list", "--all", "--output", "yaml")
+func (s *HelmKappSot) refresh() error {
+	var stdout, stderr bytes.Buffer
+
+	args := []string{"list", "--all", "--output", "yaml"}
+
+	// target the cluster in the stack if the provider knows its context
+	if s.providerImpl != nil {
+		providerVars := provider.GetVars(s.providerImpl)
+		if kubeContext, ok := providerVars[KUBE_CONTEXT_KEY].(string); ok {
+			args = append(args, "--kube-context", kubeContext)
+		}
+	}
+
+	cmd := exec.Command(HELM_PATH, args...)
 	cmd.Env = os.Environ()
 	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 
 	err := cmd.Run()
 	if err != nil {
-		return errors.Wrap(err, "Error running 'helm list'")
+		return errors.Wrapf(err, "Error running 'helm list'. Stderr: %s",
+			stderr.String())
 	}
 
 	// parse stdout
@@ -74,8 +93,10 @@ func (s HelmKappSot) refresh() error {
 	return nil
 }
 
-// Returns whether a helm chart is already successfully installed on the cluster
-func (s HelmKappSot) isInstalled(name string, version string) (bool, error) {
+// Returns whether a helm chart is already successfully installed on the cluster.
+// Releases are matched by name. If a version is given the chart must also have
+// been installed at that version.
+func (s *HelmKappSot) isInstalled(name string, version string) (bool, error) {
 
 	// todo - make sure we refresh this for each manifest to catch the same
 	// chart being installed by different manifests accidentally.
@@ -86,24 +107,35 @@ func (s HelmKappSot) isInstalled(name string, version string) (bool, error) {
 		}
 	}
 
-	chart := fmt.Sprintf("%s=%s", name, version)
+	chart := name
+	if version != "" {
+		chart = fmt.Sprintf("%s-%s", name, version)
+	}
 
 	for _, release := range s.charts.Releases {
-		if release.Chart == chart {
-			if release.Status == "DEPLOYED" {
-				log.Infof("Chart '%s' is already installed", chart)
-				return true, nil
-			}
-
-			if release.Status == "FAILED" {
-				log.Infof("The previous release of chart '%s' failed", chart)
-				return false, nil
-			}
-
-			if release.Status == "DELETED" {
-				log.Infof("Chart '%s' was installed but was deleted", chart)
-				return false, nil
-			}
+		if release.Name != name {
+			continue
+		}
+
+		if version != "" && !strings.HasSuffix(release.Chart, "-"+version) {
+			log.Infof("Release '%s' is installed with chart '%s' instead of "+
+				"version '%s'", name, release.Chart, version)
+			return false, nil
+		}
+
+		if release.Status == "DEPLOYED" {
+			log.Infof("Chart '%s' is already installed", chart)
+			return true, nil
+		}
+
+		if release.Status == "FAILED" {
+			log.Infof("The previous release of chart '%s' failed", chart)
+			return false, nil
+		}
+
+		if release.Status == "DELETED" {
+			log.Infof("Chart '%s' was installed but was deleted", chart)
+			return false, nil
 		}
 	}
 
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kappsot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHelmIsInstalled(t *testing.T) {
+	sot := HelmKappSot{
+		charts: HelmOutput{
+			Releases: []HelmRelease{
+				{Name: "nginx-ingress", Chart: "nginx-ingress-0.1.0", Status: "DEPLOYED"},
+				{Name: "wordpress", Chart: "wordpress-2.1.3", Status: "FAILED"},
+				{Name: "tiller", Chart: "tiller-0.2.0", Status: "DELETED"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		desc     string
+		release  string
+		version  string
+		expected bool
+	}{
+		{
+			name:     "deployed_any_version",
+			desc:     "deployed releases are installed if no version is given",
+			release:  "nginx-ingress",
+			expected: true,
+		},
+		{
+			name:     "deployed_matching_version",
+			desc:     "deployed releases are installed if the version matches",
+			release:  "nginx-ingress",
+			version:  "0.1.0",
+			expected: true,
+		},
+		{
+			name:     "deployed_other_version",
+			desc:     "deployed releases aren't installed if the version differs",
+			release:  "nginx-ingress",
+			version:  "0.2.0",
+			expected: false,
+		},
+		{
+			name:     "failed",
+			desc:     "failed releases aren't installed",
+			release:  "wordpress",
+			expected: false,
+		},
+		{
+			name:     "deleted",
+			desc:     "deleted releases aren't installed",
+			release:  "tiller",
+			expected: false,
+		},
+		{
+			name:     "missing",
+			desc:     "unknown releases aren't installed",
+			release:  "cert-manager",
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		actual, err := sot.isInstalled(test.release, test.version)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, actual, "unexpected result for %s", test.name)
+	}
+}
+
+func TestNewKappSotError(t *testing.T) {
+	actual, err := NewKappSot("nonsense", nil)
+	assert.NotNil(t, err)
+	assert.Nil(t, actual)
+}
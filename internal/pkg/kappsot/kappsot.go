@@ -16,11 +16,31 @@
 
 package kappsot
 
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+)
+
 type KappSot interface {
 	refresh() error
 	isInstalled(name string, version string) (bool, error)
 }
 
+// Implemented KappSot names
+const HELM = "helm"
+
+// Factory that creates KappSots
+func NewKappSot(name string, providerImpl provider.Provider) (KappSot, error) {
+	if name == HELM {
+		return &HelmKappSot{
+			providerImpl: providerImpl,
+		}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("KappSot '%s' doesn't exist", name))
+}
+
 // Delegate to an implementation
 func IsInstalled(k KappSot, name string, version string) (bool, error) {
 	return k.isInstalled(name, version)
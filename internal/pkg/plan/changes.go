@@ -0,0 +1,234 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/clusterdiff"
+	"github.com/sugarkube/sugarkube/internal/pkg/installer"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Name of the file in a run's log directory the change report is written to
+const CHANGE_REPORT_FILE = "changes.yaml"
+
+// Changes to resources a kapp's terraform plan would make, by resource address
+type ResourceChanges struct {
+	Creates  []string `yaml:"creates,omitempty"`
+	Updates  []string `yaml:"updates,omitempty"`
+	Destroys []string `yaml:"destroys,omitempty"`
+}
+
+// Resource changes planned by kapps keyed by fully-qualified kapp ID
+type ChangeReport map[string]ResourceChanges
+
+// The parts of terraform's JSON plan format we need
+type terraformPlan struct {
+	ResourceChanges []struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+}
+
+// Parses the output of 'terraform show -json <plan>'. Replacing a resource
+// counts as destroying it.
+func parseTerraformPlan(data []byte) (*ResourceChanges, error) {
+	plan := terraformPlan{}
+	err := json.Unmarshal(data, &plan)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing terraform plan JSON")
+	}
+
+	changes := ResourceChanges{}
+
+	for _, resourceChange := range plan.ResourceChanges {
+		actions := resourceChange.Change.Actions
+		address := resourceChange.Address
+
+		switch {
+		case contains(actions, "delete"):
+			changes.Destroys = append(changes.Destroys, address)
+		case contains(actions, "create"):
+			changes.Creates = append(changes.Creates, address)
+		case contains(actions, "update"):
+			changes.Updates = append(changes.Updates, address)
+		}
+	}
+
+	return &changes, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Aggregates the terraform plans exported by the kapps in the plan that will
+// be installed or destroyed. Kapps that haven't exported a plan are omitted.
+func (p *Plan) changeReport() (ChangeReport, error) {
+	report := ChangeReport{}
+
+	for _, id := range p.order {
+		task := p.tasks[id]
+		if task.action == clusterdiff.ACTION_IGNORE {
+			continue
+		}
+
+		manifestCacheDir := cacher.GetManifestCachePath(p.cacheDir, task.manifest)
+		planPath := installer.TerraformPlanPath(
+			cacher.GetKappRootPath(manifestCacheDir, task.kapp))
+
+		data, err := ioutil.ReadFile(planPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		changes, err := parseTerraformPlan(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading the terraform plan "+
+				"of kapp '%s' from '%s'", id, planPath)
+		}
+
+		report[id] = *changes
+	}
+
+	return report, nil
+}
+
+// Returns the IDs of kapps in the plan that implement the terraform interface
+// but haven't exported a plan, so their changes can't be checked before
+// they're applied
+func (p *Plan) unplannedTerraformKapps() ([]string, error) {
+	unplanned := make([]string, 0)
+
+	for _, id := range p.order {
+		task := p.tasks[id]
+		if task.action == clusterdiff.ACTION_IGNORE {
+			continue
+		}
+
+		manifestCacheDir := cacher.GetManifestCachePath(p.cacheDir, task.manifest)
+		kappRootDir := cacher.GetKappRootPath(manifestCacheDir, task.kapp)
+
+		// kapps missing from the cache fail when they're processed
+		if _, err := os.Stat(kappRootDir); err != nil {
+			continue
+		}
+
+		if _, err := os.Stat(installer.TerraformPlanPath(kappRootDir)); err == nil {
+			continue
+		}
+
+		kappObj := task.kapp
+		kappObj.RootDir = kappRootDir
+		implemented, err := installer.ImplementsInterface(&kappObj, p.stackConfig,
+			installer.IMPLEMENTS_TERRAFORM)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if implemented {
+			unplanned = append(unplanned, id)
+		}
+	}
+
+	return unplanned, nil
+}
+
+// Returns the resources that would be destroyed as `<kapp ID>: <address>`
+func (r ChangeReport) destroys() []string {
+	destroys := make([]string, 0)
+	for id, changes := range r {
+		for _, address := range changes.Destroys {
+			destroys = append(destroys, fmt.Sprintf("%s: %s", id, address))
+		}
+	}
+	sort.Strings(destroys)
+
+	return destroys
+}
+
+// Logs a summary of the report
+func (r ChangeReport) log() {
+	ids := make([]string, 0)
+	for id := range r {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		changes := r[id]
+		log.Infof("Kapp '%s' plans to create %d, update %d and destroy %d "+
+			"resource(s)", id, len(changes.Creates), len(changes.Updates),
+			len(changes.Destroys))
+	}
+
+	if destroys := r.destroys(); len(destroys) > 0 {
+		log.Warnf("%d resource(s) would be destroyed:\n  %s", len(destroys),
+			strings.Join(destroys, "\n  "))
+	}
+}
+
+// Writes the report as YAML into a run's log directory
+func (r ChangeReport) save(runDir string) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.MkdirAll(runDir, 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	path := filepath.Join(runDir, CHANGE_REPORT_FILE)
+	log.Infof("Writing change report to %s", path)
+
+	return errors.WithStack(ioutil.WriteFile(path, data, 0644))
+}
+
+// Returns an error if applying the plan would destroy resources unless
+// destroying them is allowed
+func (r ChangeReport) checkDestroys(allowDestroy bool) error {
+	destroys := r.destroys()
+	if len(destroys) == 0 || allowDestroy {
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("Refusing to apply changes that would "+
+		"destroy %d resource(s) without --allow-destroy:\n  %s", len(destroys),
+		strings.Join(destroys, "\n  ")))
+}
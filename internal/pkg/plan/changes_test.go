@@ -0,0 +1,133 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/installer"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testTerraformPlan = `{
+  "format_version": "0.1",
+  "resource_changes": [
+    {"address": "aws_s3_bucket.new", "change": {"actions": ["create"]}},
+    {"address": "aws_iam_role.changed", "change": {"actions": ["update"]}},
+    {"address": "aws_instance.replaced", "change": {"actions": ["delete", "create"]}},
+    {"address": "aws_db_instance.removed", "change": {"actions": ["delete"]}},
+    {"address": "aws_vpc.same", "change": {"actions": ["no-op"]}}
+  ]
+}`
+
+func TestParseTerraformPlan(t *testing.T) {
+	changes, err := parseTerraformPlan([]byte(testTerraformPlan))
+	assert.Nil(t, err)
+	assert.Equal(t, &ResourceChanges{
+		Creates:  []string{"aws_s3_bucket.new"},
+		Updates:  []string{"aws_iam_role.changed"},
+		Destroys: []string{"aws_instance.replaced", "aws_db_instance.removed"},
+	}, changes)
+
+	_, err = parseTerraformPlan([]byte("not json"))
+	assert.NotNil(t, err)
+}
+
+func TestChangeReport(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "plan-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	stackConfig := &kapp.StackConfig{
+		Manifests: []kapp.Manifest{
+			{Id: "m1", Kapps: []kapp.Kapp{
+				{Id: "a", ShouldBePresent: true},
+				{Id: "b", ShouldBePresent: true},
+			}},
+		},
+	}
+
+	p, err := Create(stackConfig, cacheDir)
+	assert.Nil(t, err)
+
+	// no kapps have exported plans
+	report, err := p.changeReport()
+	assert.Nil(t, err)
+	assert.Equal(t, ChangeReport{}, report)
+	assert.Nil(t, report.checkDestroys(false))
+
+	planPath := installer.TerraformPlanPath(filepath.Join(cacheDir, "m1", "b"))
+	err = os.MkdirAll(filepath.Dir(planPath), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(planPath, []byte(testTerraformPlan), 0644)
+	assert.Nil(t, err)
+
+	report, err = p.changeReport()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report))
+	assert.Equal(t, []string{"m1:b: aws_db_instance.removed",
+		"m1:b: aws_instance.replaced"}, report.destroys())
+
+	assert.NotNil(t, report.checkDestroys(false))
+	assert.Nil(t, report.checkDestroys(true))
+
+	runDir := filepath.Join(cacheDir, "run")
+	err = report.save(runDir)
+	assert.Nil(t, err)
+
+	saved, err := ioutil.ReadFile(filepath.Join(runDir, CHANGE_REPORT_FILE))
+	assert.Nil(t, err)
+	assert.Contains(t, string(saved), "aws_db_instance.removed")
+}
+
+func TestUnplannedTerraformKapps(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "plan-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	stackConfig := &kapp.StackConfig{
+		Manifests: []kapp.Manifest{
+			{Id: "m1", Kapps: []kapp.Kapp{
+				{Id: "chart", ShouldBePresent: true},
+				{Id: "planned", ShouldBePresent: true},
+				{Id: "unplanned", ShouldBePresent: true},
+			}},
+		},
+	}
+
+	// only kapps containing terraform configs implement the interface
+	for _, dir := range []string{"chart", "planned/terraform", "unplanned/terraform"} {
+		err = os.MkdirAll(filepath.Join(cacheDir, "m1", dir), 0755)
+		assert.Nil(t, err)
+	}
+
+	planPath := installer.TerraformPlanPath(filepath.Join(cacheDir, "m1", "planned"))
+	err = os.MkdirAll(filepath.Dir(planPath), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(planPath, []byte(testTerraformPlan), 0644)
+	assert.Nil(t, err)
+
+	p, err := Create(stackConfig, cacheDir)
+	assert.Nil(t, err)
+
+	unplanned, err := p.unplannedTerraformKapps()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"m1:unplanned"}, unplanned)
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/clusterdiff"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Journal file names for runs that plan and apply changes, under CACHE_DIR in
+// the root of a cache
+const JOURNAL_PLAN = "journal-plan.yaml"
+const JOURNAL_APPLY = "journal-apply.yaml"
+
+// Outcomes of kapps recorded in journals
+const JOURNAL_SUCCEEDED = "succeeded"
+const JOURNAL_FAILED = "failed"
+
+// Records the outcome of each kapp in a run so failed runs can be resumed
+type journal struct {
+	path  string
+	mutex sync.Mutex
+	// identifies the stack, manifests and cache the run was for
+	Fingerprint string `yaml:"fingerprint"`
+	// outcomes keyed by fully-qualified kapp ID
+	Kapps map[string]string `yaml:"kapps"`
+}
+
+// Returns the path to the journal for runs that plan or apply changes
+func journalPath(cacheDir string, approved bool) string {
+	name := JOURNAL_PLAN
+	if approved {
+		name = JOURNAL_APPLY
+	}
+
+	return filepath.Join(cacheDir, cacher.CACHE_DIR, name)
+}
+
+// Loads a journal from a file
+func loadJournal(path string) (*journal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading journal '%s'", path)
+	}
+
+	loaded := journal{}
+	err = yaml.Unmarshal(data, &loaded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing journal '%s'", path)
+	}
+
+	loaded.path = path
+	if loaded.Kapps == nil {
+		loaded.Kapps = make(map[string]string)
+	}
+
+	return &loaded, nil
+}
+
+// Writes the journal to its file. It's written to a temporary file first so
+// the journal is never left half-written.
+func (j *journal) save() error {
+	data, err := yaml.Marshal(j)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(j.path), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tempPath := j.path + ".tmp"
+	err = ioutil.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Error writing journal '%s'", tempPath)
+	}
+
+	return errors.WithStack(os.Rename(tempPath, j.path))
+}
+
+// Records the outcome of a kapp and saves the journal
+func (j *journal) record(id string, outcome string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.Kapps[id] = outcome
+	return j.save()
+}
+
+// Returns a hash identifying the stack, manifests and versions of sources in
+// the cache the plan is for. Kapps' actions aren't included since they
+// change as kapps are installed.
+func (p *Plan) fingerprint() (string, error) {
+	lines := []string{
+		fmt.Sprintf("stack name=%s provider=%s provisioner=%s account=%s "+
+			"region=%s profile=%s cluster=%s", p.stackConfig.Name,
+			p.stackConfig.Provider, p.stackConfig.Provisioner,
+			p.stackConfig.Account, p.stackConfig.Region,
+			p.stackConfig.Profile, p.stackConfig.Cluster),
+	}
+
+	for _, manifest := range p.stackConfig.Manifests {
+		manifestCacheDir := cacher.GetManifestCachePath(p.cacheDir, manifest)
+
+		for _, manifestKapp := range manifest.Kapps {
+			lines = append(lines, fmt.Sprintf("kapp %s present=%v version=%s "+
+				"depends_on=%s", fullyQualifiedId(manifest.Id, manifestKapp.Id),
+				manifestKapp.ShouldBePresent, manifestKapp.Version,
+				strings.Join(manifestKapp.DependsOn, ",")))
+
+			versions, err := cacher.SourceVersions(manifestCacheDir, manifestKapp)
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+
+			sourceIds := make([]string, 0)
+			for sourceId := range versions {
+				sourceIds = append(sourceIds, sourceId)
+			}
+			sort.Strings(sourceIds)
+
+			for _, sourceId := range sourceIds {
+				lines = append(lines, fmt.Sprintf("source %s=%s", sourceId,
+					versions[sourceId]))
+			}
+		}
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return fmt.Sprintf("%x", hash), nil
+}
+
+// Returns the journal to record a run in. If `resume` is true, the journal of
+// the previous run is loaded and a plan that skips kapps that succeeded in it
+// is returned. It's an error to resume if the stack, manifests or cache have
+// changed since the journal was written.
+func (p *Plan) resumable(approved bool, resume bool) (*Plan, *journal, error) {
+	fingerprint, err := p.fingerprint()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	path := journalPath(p.cacheDir, approved)
+
+	if !resume {
+		return p, &journal{
+			path:        path,
+			Fingerprint: fingerprint,
+			Kapps:       make(map[string]string),
+		}, nil
+	}
+
+	previous, err := loadJournal(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Can't resume without a journal "+
+			"from a previous run")
+	}
+
+	if previous.Fingerprint != fingerprint {
+		return nil, nil, errors.New(fmt.Sprintf("Can't resume from journal "+
+			"'%s' because the stack, manifests or cache have changed since "+
+			"it was written", path))
+	}
+
+	// ignore kapps that succeeded. Kapps that depend on them can start
+	// straight away.
+	resumed := *p
+	resumed.tasks = make(map[string]task)
+	for id, task := range p.tasks {
+		if previous.Kapps[id] == JOURNAL_SUCCEEDED {
+			log.Infof("Skipping kapp '%s' which succeeded in the previous run", id)
+			task.action = clusterdiff.ACTION_IGNORE
+		}
+		resumed.tasks[id] = task
+	}
+
+	return &resumed, previous, nil
+}
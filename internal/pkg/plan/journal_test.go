@@ -0,0 +1,77 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/clusterdiff"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestResumable(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "plan-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	stackConfig := &kapp.StackConfig{
+		Name: "stack",
+		Manifests: []kapp.Manifest{
+			{Id: "m1", Kapps: []kapp.Kapp{
+				{Id: "a", ShouldBePresent: true},
+				{Id: "b", ShouldBePresent: true},
+			}},
+		},
+	}
+
+	p, err := Create(stackConfig, cacheDir)
+	assert.Nil(t, err)
+
+	// there's nothing to resume from yet
+	_, _, err = p.resumable(true, true)
+	assert.NotNil(t, err)
+
+	runPlan, runJournal, err := p.resumable(true, false)
+	assert.Nil(t, err)
+	assert.Equal(t, p, runPlan)
+
+	err = runJournal.record("m1:a", JOURNAL_SUCCEEDED)
+	assert.Nil(t, err)
+	err = runJournal.record("m1:b", JOURNAL_FAILED)
+	assert.Nil(t, err)
+
+	// journals for runs that plan changes are separate
+	_, _, err = p.resumable(false, true)
+	assert.NotNil(t, err)
+
+	runPlan, resumedJournal, err := p.resumable(true, true)
+	assert.Nil(t, err)
+	assert.Equal(t, runJournal.Kapps, resumedJournal.Kapps)
+	assert.Equal(t, clusterdiff.ACTION_IGNORE, runPlan.tasks["m1:a"].action)
+	assert.Equal(t, clusterdiff.ACTION_INSTALL, runPlan.tasks["m1:b"].action)
+	assert.Equal(t, clusterdiff.ACTION_INSTALL, p.tasks["m1:a"].action)
+
+	// changing the manifests invalidates the journal
+	stackConfig.Manifests[0].Kapps[1].Version = "1.0.0"
+	p, err = Create(stackConfig, cacheDir)
+	assert.Nil(t, err)
+
+	_, _, err = p.resumable(true, true)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory under CACHE_DIR in the root of a cache to write kapp logs to
+const LOGS_DIR = "logs"
+
+// Returns the directory to write the logs of a run to. Runs are named after
+// when they started and whether they applied changes.
+func runLogDir(cacheDir string, approved bool, started time.Time) string {
+	phase := "plan"
+	if approved {
+		phase = "apply"
+	}
+
+	return filepath.Join(cacheDir, cacher.CACHE_DIR, LOGS_DIR,
+		started.Format("20060102-150405")+"-"+phase)
+}
+
+// Returns the path of a kapp's log file in a run's log directory
+func kappLogPath(runDir string, manifestId string, kappId string) string {
+	return filepath.Join(runDir, manifestId, kappId+".log")
+}
+
+// Serialises writes to streams so lines from different kapps aren't interleaved
+var streamMutex sync.Mutex
+
+// Writes a kapp's output to a log file and optionally streams it with each
+// line prefixed by the kapp's ID. It's safe for concurrent use so installers
+// can write stdout and stderr to it at the same time.
+type kappOutput struct {
+	mutex  sync.Mutex
+	file   *os.File
+	stream io.Writer
+	prefix []byte
+	// the last line written if it's incomplete, so it isn't streamed yet
+	partial []byte
+}
+
+// Returns output for a kapp. No log file is written if `path` is empty, and
+// nothing is streamed if `stream` is nil.
+func newKappOutput(path string, stream io.Writer, id string) (*kappOutput, error) {
+	output := &kappOutput{
+		stream: stream,
+		prefix: []byte("[" + id + "] "),
+	}
+
+	if path != "" {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		output.file, err = os.Create(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error creating log file '%s'", path)
+		}
+	}
+
+	return output, nil
+}
+
+func (o *kappOutput) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.file != nil {
+		_, err := o.file.Write(p)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+
+	if o.stream != nil {
+		o.partial = append(o.partial, p...)
+
+		end := bytes.LastIndexByte(o.partial, '\n')
+		if end >= 0 {
+			err := o.streamLines(o.partial[:end+1])
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+			o.partial = append([]byte{}, o.partial[end+1:]...)
+		}
+	}
+
+	return len(p), nil
+}
+
+// Streams complete lines with each one prefixed
+func (o *kappOutput) streamLines(lines []byte) error {
+	var buffer bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			buffer.Write(o.prefix)
+			buffer.Write(line)
+		}
+	}
+
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+
+	_, err := o.stream.Write(buffer.Bytes())
+	return err
+}
+
+// Streams any incomplete last line and closes the log file
+func (o *kappOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.stream != nil && len(o.partial) > 0 {
+		err := o.streamLines(append(o.partial, '\n'))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		o.partial = nil
+	}
+
+	if o.file != nil {
+		return errors.WithStack(o.file.Close())
+	}
+
+	return nil
+}
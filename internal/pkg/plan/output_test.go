@@ -0,0 +1,59 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKappOutput(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "plan-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	runDir := runLogDir(tempDir, false, time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC))
+	assert.Equal(t, filepath.Join(tempDir, ".sugarkube/logs/20190102-030405-plan"), runDir)
+
+	logPath := kappLogPath(runDir, "m1", "a")
+	var stream bytes.Buffer
+
+	output, err := newKappOutput(logPath, &stream, "m1:a")
+	assert.Nil(t, err)
+
+	for _, data := range []string{"first line\nsec", "ond line\n", "no newline"} {
+		_, err = output.Write([]byte(data))
+		assert.Nil(t, err)
+	}
+
+	// incomplete lines aren't streamed until the output is closed
+	assert.Equal(t, "[m1:a] first line\n[m1:a] second line\n", stream.String())
+
+	err = output.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "[m1:a] first line\n[m1:a] second line\n[m1:a] no newline\n",
+		stream.String())
+
+	logged, err := ioutil.ReadFile(logPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "first line\nsecond line\nno newline", string(logged))
+}
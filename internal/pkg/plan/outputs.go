@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/installer"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// File under CACHE_DIR in the root of a cache that kapp outputs are recorded in
+const OUTPUTS_FILE = "outputs.yaml"
+
+// Records the outputs of installed kapps so they can be passed to other kapps.
+// It's safe for concurrent use.
+type OutputStore struct {
+	path  string
+	mutex sync.Mutex
+	// outputs keyed by stack (see StackKey), fully-qualified kapp ID and name
+	Stacks map[string]map[string]map[string]string `yaml:"stacks"`
+}
+
+// Returns the key outputs of kapps in a stack are recorded under. Stack names
+// aren't used so outputs are shared with runs configured with CLI args.
+func StackKey(stackConfig *kapp.StackConfig) string {
+	parts := make([]string, 0)
+	for _, part := range []string{stackConfig.Provider, stackConfig.Account,
+		stackConfig.Region, stackConfig.Profile, stackConfig.Cluster} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// Loads the outputs recorded in a cache. It isn't an error if none have been.
+func LoadOutputs(cacheDir string) (*OutputStore, error) {
+	store := OutputStore{
+		path:   filepath.Join(cacheDir, cacher.CACHE_DIR, OUTPUTS_FILE),
+		Stacks: make(map[string]map[string]map[string]string),
+	}
+
+	data, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &store, nil
+		}
+		return nil, errors.Wrapf(err, "Error reading outputs '%s'", store.path)
+	}
+
+	err = yaml.Unmarshal(data, &store)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing outputs '%s'", store.path)
+	}
+
+	if store.Stacks == nil {
+		store.Stacks = make(map[string]map[string]map[string]string)
+	}
+
+	return &store, nil
+}
+
+// Returns a copy of the outputs recorded for a stack keyed by fully-qualified
+// kapp ID
+func (s *OutputStore) StackOutputs(stackKey string) map[string]map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stackOutputs := make(map[string]map[string]string)
+	for id, outputs := range s.Stacks[stackKey] {
+		stackOutputs[id] = make(map[string]string)
+		for name, value := range outputs {
+			stackOutputs[id][name] = value
+		}
+	}
+
+	return stackOutputs
+}
+
+// Records a kapp's outputs and saves the store. The kapp's previous outputs
+// are removed if `outputs` is nil.
+func (s *OutputStore) record(stackKey string, id string, outputs map[string]string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.Stacks[stackKey]; !ok {
+		s.Stacks[stackKey] = make(map[string]map[string]string)
+	}
+
+	if outputs == nil {
+		delete(s.Stacks[stackKey], id)
+	} else {
+		s.Stacks[stackKey][id] = outputs
+	}
+
+	return s.save()
+}
+
+// Writes the store to its file. It's written to a temporary file first so
+// it's never left half-written, and is only readable by the user since
+// outputs may be e.g. passwords written by kapps.
+func (s *OutputStore) save() error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tempPath := s.path + ".tmp"
+	err = ioutil.WriteFile(tempPath, data, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Error writing outputs '%s'", tempPath)
+	}
+
+	return errors.WithStack(os.Rename(tempPath, s.path))
+}
+
+// Returns the env vars to pass the outputs of a stack's kapps to another kapp
+// in. Only the outputs of the kapps with the given fully-qualified IDs (i.e.
+// the kapps it depends on) are passed.
+func OutputEnvVars(stackOutputs map[string]map[string]string, ids map[string]bool) map[string]string {
+	envVars := make(map[string]string)
+
+	for id, outputs := range stackOutputs {
+		if !ids[id] {
+			continue
+		}
+
+		manifestId := ""
+		kappId := id
+		if i := strings.Index(id, ID_SEPARATOR); i >= 0 {
+			manifestId = id[:i]
+			kappId = id[i+len(ID_SEPARATOR):]
+		}
+
+		for name, value := range outputs {
+			envVars[installer.OutputEnvVarName(manifestId, kappId, name)] = value
+		}
+	}
+
+	return envVars
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStackKey(t *testing.T) {
+	assert.Equal(t, "local/dev/standard", StackKey(&kapp.StackConfig{
+		Name: "local-standard", Provider: "local", Profile: "dev", Cluster: "standard"}))
+	assert.Equal(t, "aws/123/eu-west-1/prod/main", StackKey(&kapp.StackConfig{
+		Provider: "aws", Account: "123", Region: "eu-west-1", Profile: "prod",
+		Cluster: "main"}))
+}
+
+func TestOutputStore(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "outputs-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	// caches start without outputs
+	store, err := LoadOutputs(cacheDir)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[string]string{}, store.StackOutputs("local/dev"))
+
+	err = store.record("local/dev", "infra:rds", map[string]string{"db_host": "db.dev"})
+	assert.Nil(t, err)
+	err = store.record("local/dev", "infra:lb", map[string]string{"dns": "lb.dev"})
+	assert.Nil(t, err)
+	err = store.record("local/prod", "infra:rds", map[string]string{"db_host": "db.prod"})
+	assert.Nil(t, err)
+
+	// outputs are recorded per stack and persisted
+	store, err = LoadOutputs(cacheDir)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"infra:rds": {"db_host": "db.dev"},
+		"infra:lb":  {"dns": "lb.dev"},
+	}, store.StackOutputs("local/dev"))
+
+	// destroyed kapps' outputs are forgotten
+	err = store.record("local/dev", "infra:lb", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"infra:rds": {"db_host": "db.dev"},
+	}, store.StackOutputs("local/dev"))
+
+	// kapps are only passed the outputs of the kapps they depend on
+	envVars := OutputEnvVars(store.StackOutputs("local/dev"),
+		map[string]bool{"infra:rds": true, "infra:lb": true})
+	assert.Equal(t, map[string]string{"OUTPUT_INFRA_RDS_DB_HOST": "db.dev"}, envVars)
+
+	envVars = OutputEnvVars(store.StackOutputs("local/dev"), map[string]bool{})
+	assert.Equal(t, map[string]string{}, envVars)
+
+	// outputs may be secrets so only the user can read them
+	info, err := os.Stat(filepath.Join(cacheDir, cacher.CACHE_DIR, OUTPUTS_FILE))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
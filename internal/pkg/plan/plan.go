@@ -17,31 +17,36 @@
 package plan
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/clusterdiff"
 	"github.com/sugarkube/sugarkube/internal/pkg/installer"
 	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
 	"github.com/sugarkube/sugarkube/internal/pkg/log"
 	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io"
 	"os"
+	"strings"
+	"time"
 )
 
-type Tranche struct {
-	// The manifest associated with this tranche
+// A kapp to install, destroy or ignore
+type task struct {
 	manifest kapp.Manifest
-	// Kapps to install into the target cluster
-	installables []kapp.Kapp
-	// Kapps to destroy from the target cluster
-	destroyables []kapp.Kapp
-	// Kapps that are already in the target cluster so can be ignored
-	ignorables []kapp.Kapp
+	kapp     kapp.Kapp
+	// one of the clusterdiff actions
+	action string
 }
 
 type Plan struct {
-	// installation/destruction phases. Tranches will be run sequentially, but
-	// each kapp in the tranche will be processed in parallel
-	tranche []Tranche
+	// kapps to process keyed by their fully-qualified ID
+	tasks map[string]task
+	// fully-qualified kapp IDs in the order they're declared in manifests
+	order []string
+	// fully-qualified IDs of the kapps each kapp depends on
+	dependencies map[string][]string
 	// contains details of the target cluster
 	stackConfig *kapp.StackConfig
 	// a cache dir to run the (make) installer over. It should already have
@@ -49,93 +54,661 @@ type Plan struct {
 	cacheDir string
 }
 
-// create a plan containing all kapps in the stackConfig, then filter out the
-// ones that don't need running based on the current state of the target cluster
-// as described by SOTs
+// Separates manifest IDs from kapp IDs in fully-qualified kapp IDs
+const ID_SEPARATOR = ":"
+
+// Returns the fully-qualified ID of a kapp, i.e. `<manifest ID>:<kapp ID>`
+func fullyQualifiedId(manifestId string, kappId string) string {
+	return manifestId + ID_SEPARATOR + kappId
+}
+
+// Create a plan containing all kapps in the stackConfig regardless of the
+// current state of the target cluster. Use `FromDiff` to create a plan that only
+// processes kapps that need installing or destroying.
 func Create(stackConfig *kapp.StackConfig, cacheDir string) (*Plan, error) {
 
-	tranches := make([]Tranche, 0)
+	tasks := make([]task, 0)
 
 	for _, manifest := range stackConfig.Manifests {
-		installables := make([]kapp.Kapp, 0)
-		destroyables := make([]kapp.Kapp, 0)
-
 		for _, manifestKapp := range manifest.Kapps {
+			action := clusterdiff.ACTION_DESTROY
 			if manifestKapp.ShouldBePresent {
-				installables = append(installables, manifestKapp)
-			} else {
-				destroyables = append(destroyables, manifestKapp)
+				action = clusterdiff.ACTION_INSTALL
 			}
-		}
 
-		tranche := Tranche{
-			manifest:     manifest,
-			installables: installables,
-			destroyables: destroyables,
+			tasks = append(tasks, task{
+				manifest: manifest,
+				kapp:     manifestKapp,
+				action:   action,
+			})
 		}
+	}
+
+	return newPlan(tasks, stackConfig, cacheDir)
+}
+
+// Create a plan from a cluster diff. Only kapps the diff says need installing
+// or destroying will be processed. All others will be ignored.
+func FromDiff(clusterDiff *clusterdiff.ClusterDiff, stackConfig *kapp.StackConfig,
+	cacheDir string) (*Plan, error) {
+
+	tasks := make([]task, 0)
+
+	for _, manifest := range stackConfig.Manifests {
+		for _, manifestKapp := range manifest.Kapps {
+			kappDiff := clusterDiff.KappDiff(manifest.Id, manifestKapp.Id)
+			if kappDiff == nil {
+				return nil, errors.New(fmt.Sprintf("Kapp '%s' in manifest '%s' "+
+					"isn't in the cluster diff", manifestKapp.Id, manifest.Id))
+			}
+
+			switch kappDiff.Action {
+			case clusterdiff.ACTION_INSTALL, clusterdiff.ACTION_DESTROY,
+				clusterdiff.ACTION_IGNORE:
+			default:
+				return nil, errors.New(fmt.Sprintf("Unknown action '%s' for kapp "+
+					"'%s' in manifest '%s'", kappDiff.Action, manifestKapp.Id,
+					manifest.Id))
+			}
 
-		tranches = append(tranches, tranche)
+			tasks = append(tasks, task{
+				manifest: manifest,
+				kapp:     manifestKapp,
+				action:   kappDiff.Action,
+			})
+		}
 	}
 
+	return newPlan(tasks, stackConfig, cacheDir)
+}
+
+// Builds a dependency graph of tasks and returns a plan to process them, or
+// an error if any dependencies are unknown or cyclic
+func newPlan(tasks []task, stackConfig *kapp.StackConfig, cacheDir string) (*Plan, error) {
+
 	plan := Plan{
-		tranche:     tranches,
-		stackConfig: stackConfig,
-		cacheDir:    cacheDir,
+		tasks:        make(map[string]task),
+		order:        make([]string, 0),
+		dependencies: make(map[string][]string),
+		stackConfig:  stackConfig,
+		cacheDir:     cacheDir,
+	}
+
+	for _, task := range tasks {
+		id := fullyQualifiedId(task.manifest.Id, task.kapp.Id)
+		if _, ok := plan.tasks[id]; ok {
+			return nil, errors.New(fmt.Sprintf("Kapp '%s' is declared more "+
+				"than once", id))
+		}
+
+		// kapps can also declare metadata in the cache, e.g. dependencies
+		kappRootDir := cacher.GetKappRootPath(
+			cacher.GetManifestCachePath(cacheDir, task.manifest), task.kapp)
+		descriptor, err := kapp.LoadDescriptor(kappRootDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error loading descriptor of kapp '%s'", id)
+		}
+		task.kapp.Descriptor = descriptor
+
+		plan.tasks[id] = task
+		plan.order = append(plan.order, id)
 	}
 
-	// todo - use Sources of Truth (SOTs) to discover the current set of kapps installed
-	// todo - diff the cluster state with the desired state from the manifests to
-	// create a cluster diff
+	// kapps that don't declare any dependencies depend on all kapps in the
+	// previous manifest, so manifests are processed in order by default
+	previousManifestIds := make([]string, 0)
+	manifestIds := make([]string, 0)
+
+	for i, id := range plan.order {
+		task := plan.tasks[id]
+
+		if i > 0 && plan.tasks[plan.order[i-1]].manifest.Id != task.manifest.Id {
+			previousManifestIds = manifestIds
+			manifestIds = make([]string, 0)
+		}
+		manifestIds = append(manifestIds, id)
+
+		declared := append([]string{}, task.kapp.DependsOn...)
+		if task.kapp.Descriptor != nil {
+			declared = append(declared, task.kapp.Descriptor.DependsOn...)
+		}
+
+		if len(declared) == 0 {
+			plan.dependencies[id] = previousManifestIds
+			continue
+		}
+
+		dependencies := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, dependency := range declared {
+			// kapps in the same manifest can be referred to by their kapp ID
+			if !strings.Contains(dependency, ID_SEPARATOR) {
+				dependency = fullyQualifiedId(task.manifest.Id, dependency)
+			}
+
+			if _, ok := plan.tasks[dependency]; !ok {
+				return nil, errors.New(fmt.Sprintf("Kapp '%s' depends on "+
+					"unknown kapp '%s'", id, dependency))
+			}
+
+			// the manifest and descriptor may both declare a dependency
+			if seen[dependency] {
+				continue
+			}
+			seen[dependency] = true
+
+			dependencies = append(dependencies, dependency)
+		}
+
+		plan.dependencies[id] = dependencies
+	}
+
+	err := plan.checkCycles()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
 	return &plan, nil
 }
 
-// Run a plan to make a target cluster have the necessary kapps installed/
-// destroyed to match the input manifests. Each tranche is run sequentially,
-// and each kapp in each tranche is processed in parallel.
-func (p *Plan) Run(approved bool, dryRun bool) error {
+// Returns an error describing the first dependency cycle found, if any
+func (p *Plan) checkCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	states := make(map[string]int)
+	path := make([]string, 0)
+
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch states[id] {
+		case visited:
+			return nil
+		case visiting:
+			// report the cycle starting from the first kapp in it
+			for i, pathId := range path {
+				if pathId == id {
+					return errors.New(fmt.Sprintf("Kapp dependencies contain "+
+						"a cycle: %s", strings.Join(append(path[i:], id), " -> ")))
+				}
+			}
+		}
+
+		states[id] = visiting
+		path = append(path, id)
+
+		for _, dependency := range p.dependencies[id] {
+			err := visit(dependency)
+			if err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		states[id] = visited
 
-	if p.tranche == nil {
-		log.Info("No tranches in plan to process")
 		return nil
 	}
 
-	providerImpl, err := provider.NewProvider(p.stackConfig)
+	for _, id := range p.order {
+		err := visit(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the fully-qualified IDs of the kapps a kapp depends on, directly or
+// through other kapps
+func (p *Plan) transitiveDependencies(id string) map[string]bool {
+	dependencies := make(map[string]bool)
+
+	var walk func(from string)
+	walk = func(from string) {
+		for _, dependency := range p.dependencies[from] {
+			if !dependencies[dependency] {
+				dependencies[dependency] = true
+				walk(dependency)
+			}
+		}
+	}
+	walk(id)
+
+	return dependencies
+}
+
+// Returns a map of fully-qualified kapp IDs to the kapps that must be processed
+// before them. Kapps are installed after kapps they depend on that are also
+// being installed, and destroyed before kapps that depend on them that are
+// also being destroyed. Kapps with other actions (e.g. ignored ones) are
+// omitted but their dependencies are followed so ordering is preserved.
+func (p *Plan) prerequisites() map[string][]string {
+	dependents := make(map[string][]string)
+	for _, id := range p.order {
+		for _, dependency := range p.dependencies[id] {
+			dependents[dependency] = append(dependents[dependency], id)
+		}
+	}
+
+	prerequisites := make(map[string][]string)
+
+	for _, id := range p.order {
+		action := p.tasks[id].action
+
+		var edges map[string][]string
+		switch action {
+		case clusterdiff.ACTION_INSTALL:
+			edges = p.dependencies
+		case clusterdiff.ACTION_DESTROY:
+			edges = dependents
+		default:
+			continue
+		}
+
+		prerequisites[id] = make([]string, 0)
+		seen := make(map[string]bool)
+
+		var walk func(from string)
+		walk = func(from string) {
+			for _, next := range edges[from] {
+				if seen[next] {
+					continue
+				}
+				seen[next] = true
+
+				if p.tasks[next].action == action {
+					prerequisites[id] = append(prerequisites[id], next)
+				} else {
+					walk(next)
+				}
+			}
+		}
+
+		walk(id)
+	}
+
+	return prerequisites
+}
+
+// The result of processing a task
+type result struct {
+	id  string
+	err error
+	// true if the kapp's timeout expired
+	timedOut bool
+}
+
+// Fully-qualified IDs of kapps grouped by how processing them ended
+type Summary struct {
+	Succeeded []string
+	// kapps whose installers returned errors or timed out
+	Failed []string
+	// kapps that weren't processed because another kapp failed
+	Skipped []string
+	// kapps that were stopped or not processed because the run was cancelled
+	Cancelled []string
+}
+
+// Logs the summary
+func (s *Summary) log() {
+	log.Infof("%d kapp(s) succeeded: %s", len(s.Succeeded), strings.Join(s.Succeeded, ", "))
+
+	if len(s.Failed) > 0 {
+		log.Errorf("%d kapp(s) failed: %s", len(s.Failed), strings.Join(s.Failed, ", "))
+	}
+	if len(s.Skipped) > 0 {
+		log.Warnf("%d kapp(s) skipped: %s", len(s.Skipped), strings.Join(s.Skipped, ", "))
+	}
+	if len(s.Cancelled) > 0 {
+		log.Warnf("%d kapp(s) cancelled: %s", len(s.Cancelled), strings.Join(s.Cancelled, ", "))
+	}
+}
+
+// Calls `process` for each kapp that needs installing or destroying. Each kapp
+// is processed as soon as all its prerequisites have been, with at most
+// `parallelism` kapps processed at once (unlimited if less than 1). Kapps are
+// stopped if they run for longer than their timeout, or `defaultTimeout` if
+// they don't have one (no limit if zero). If any kapps fail or the context is
+// cancelled no more are started, and an error is returned once all running
+// kapps finish.
+func (p *Plan) schedule(ctx context.Context, parallelism int, defaultTimeout time.Duration,
+	process func(ctx context.Context, task task) error) (*Summary, error) {
+
+	prerequisites := p.prerequisites()
+
+	// the number of prerequisites each kapp is waiting for, and the kapps each
+	// kapp blocks
+	waiting := make(map[string]int)
+	blocks := make(map[string][]string)
+
+	for _, id := range p.order {
+		if _, ok := prerequisites[id]; !ok {
+			continue
+		}
+
+		waiting[id] = len(prerequisites[id])
+		for _, prerequisite := range prerequisites[id] {
+			blocks[prerequisite] = append(blocks[prerequisite], id)
+		}
+	}
+
+	// buffered so goroutines never block if we stop reading after an error
+	resultCh := make(chan result, len(waiting))
+	started := make(map[string]bool)
+	ready := make([]string, 0)
+	running := 0
+
+	start := func(id string) {
+		started[id] = true
+		running++
+
+		task := p.tasks[id]
+		timeout := task.kapp.Timeout
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+
+		go func() {
+			var kappCtx context.Context
+			var cancel context.CancelFunc
+			if timeout > 0 {
+				kappCtx, cancel = context.WithTimeout(ctx, timeout)
+			} else {
+				kappCtx, cancel = context.WithCancel(ctx)
+			}
+			defer cancel()
+
+			err := process(kappCtx, task)
+			resultCh <- result{
+				id:  id,
+				err: err,
+				// the run's context may have a deadline too
+				timedOut: err != nil && kappCtx.Err() == context.DeadlineExceeded &&
+					ctx.Err() == nil,
+			}
+		}()
+	}
+
+	for _, id := range p.order {
+		if count, ok := waiting[id]; ok && count == 0 {
+			ready = append(ready, id)
+		}
+	}
+
+	summary := Summary{
+		Succeeded: make([]string, 0),
+		Failed:    make([]string, 0),
+		Skipped:   make([]string, 0),
+		Cancelled: make([]string, 0),
+	}
+
+	var firstErr error
+
+	for {
+		// start as many ready kapps as we can unless we're stopping
+		for len(ready) > 0 && firstErr == nil && ctx.Err() == nil &&
+			(parallelism < 1 || running < parallelism) {
+			start(ready[0])
+			ready = ready[1:]
+		}
+
+		if running == 0 {
+			break
+		}
+
+		result := <-resultCh
+		running--
+
+		if result.err != nil {
+			if ctx.Err() != nil && !result.timedOut {
+				log.Warnf("Kapp '%s' was cancelled: %s", result.id, result.err)
+				summary.Cancelled = append(summary.Cancelled, result.id)
+				continue
+			}
+
+			if result.timedOut {
+				result.err = errors.Wrapf(result.err, "Kapp '%s' timed out", result.id)
+			}
+
+			log.Errorf("Error processing kapp '%s': %s", result.id, result.err)
+			summary.Failed = append(summary.Failed, result.id)
+
+			if firstErr == nil {
+				firstErr = errors.Wrapf(result.err, "Error processing kapp '%s'",
+					result.id)
+			}
+			continue
+		}
+
+		summary.Succeeded = append(summary.Succeeded, result.id)
+		log.Debugf("%d of %d kapp(s) successfully processed",
+			len(summary.Succeeded), len(waiting))
+
+		for _, next := range blocks[result.id] {
+			waiting[next]--
+			if waiting[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+
+	// account for kapps that were never started
+	for _, id := range p.order {
+		if _, ok := waiting[id]; !ok || started[id] {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			summary.Cancelled = append(summary.Cancelled, id)
+		} else {
+			summary.Skipped = append(summary.Skipped, id)
+		}
+	}
+
+	if firstErr != nil {
+		return &summary, firstErr
+	}
+
+	if ctx.Err() != nil {
+		return &summary, errors.Wrap(ctx.Err(), "Run cancelled")
+	}
+
+	return &summary, nil
+}
+
+// Settings for running plans
+type RunOptions struct {
+	// if false, kapps should only plan their changes
+	Approved bool
+	DryRun   bool
+	// maximum number of kapps to process at once. Unlimited if less than 1.
+	Parallelism int
+	// timeout for kapps that don't set one in their manifest. No limit if zero.
+	Timeout time.Duration
+	// if true, skip kapps that succeeded in the previous run
+	Resume bool
+	// if not nil, installer output is streamed here as well as written to
+	// log files, prefixed with kapp IDs
+	Stream io.Writer
+	// if false, refuse to apply changes if kapps' terraform plans would
+	// destroy any resources
+	AllowDestroy bool
+}
+
+// Run a plan to make a target cluster have the necessary kapps installed/
+// destroyed to match the input manifests. Kapps are processed in parallel
+// as soon as the kapps they depend on have been installed (or the kapps that
+// depend on them have been destroyed). Running installers are stopped if the
+// context is cancelled. The outcome of each kapp is recorded in a journal in
+// the cache so failed runs can be resumed, and each kapp's installer output is
+// written to a log file for the run. Terraform plans exported by kapps when
+// run unapproved are aggregated into a change report, and approved runs are
+// refused if they'd destroy resources unless that's explicitly allowed.
+func (p *Plan) Run(ctx context.Context, options RunOptions) error {
+
+	if len(p.order) == 0 {
+		log.Info("No kapps in plan to process")
+		return nil
+	}
+
+	runPlan, runJournal, err := p.resumable(options.Approved, options.Resume)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	doneCh := make(chan bool)
-	errCh := make(chan error)
+	if options.Approved {
+		report, err := runPlan.changeReport()
+		if err != nil {
+			return errors.WithStack(err)
+		}
 
-	log.Debugf("Applying plan: %#v", p)
+		report.log()
+
+		if !options.DryRun {
+			err = report.checkDestroys(options.AllowDestroy)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
 
-	for i, tranche := range p.tranche {
-		manifestCacheDir := cacher.GetManifestCachePath(p.cacheDir, tranche.manifest)
+		unplanned, err := runPlan.unplannedTerraformKapps()
+		if err != nil {
+			return errors.WithStack(err)
+		}
 
-		for _, installable := range tranche.installables {
-			go processKapp(installable, p.stackConfig, manifestCacheDir, true,
-				providerImpl, doneCh, errCh, approved, dryRun)
+		if len(unplanned) > 0 {
+			log.Warnf("No terraform plans were exported for %d kapp(s) so "+
+				"their changes can't be checked before they're applied. Run "+
+				"without --approved first to plan them:\n  %s", len(unplanned),
+				strings.Join(unplanned, "\n  "))
 		}
+	}
+
+	providerImpl, err := provider.NewProvider(p.stackConfig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-		for _, destroyable := range tranche.destroyables {
-			go processKapp(destroyable, p.stackConfig, manifestCacheDir, false,
-				providerImpl, doneCh, errCh, approved, dryRun)
+	if !options.DryRun {
+		err = runJournal.save()
+		if err != nil {
+			return errors.WithStack(err)
 		}
+	}
 
-		totalOperations := len(tranche.installables) + len(tranche.destroyables)
+	// outputs of kapps installed earlier are passed to the kapps that depend
+	// on them
+	outputStore, err := LoadOutputs(p.cacheDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stackKey := StackKey(p.stackConfig)
 
-		for success := 0; success < totalOperations; success++ {
-			select {
-			case err := <-errCh:
-				log.Fatalf("Error processing kapp in tranche %d of plan: %s", i+1, err)
-				close(doneCh)
-				return errors.Wrapf(err, "Error processing kapp goroutine "+
-					"in tranche %d of plan", i+1)
-			case <-doneCh:
-				log.Debugf("%d kapp(s) successfully processed in tranche %d",
-					success+1, i+1)
+	runDir := ""
+	if !options.DryRun {
+		runDir = runLogDir(p.cacheDir, options.Approved, time.Now())
+		log.Infof("Writing kapp logs to %s", runDir)
+	}
+
+	log.Debugf("Applying plan: %#v", runPlan)
+
+	summary, err := runPlan.schedule(ctx, options.Parallelism, options.Timeout,
+		func(ctx context.Context, task task) error {
+			id := fullyQualifiedId(task.manifest.Id, task.kapp.Id)
+
+			logPath := ""
+			if runDir != "" {
+				logPath = kappLogPath(runDir, task.manifest.Id, task.kapp.Id)
+			}
+
+			output, err := newKappOutput(logPath, options.Stream, id)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			manifestCacheDir := cacher.GetManifestCachePath(p.cacheDir, task.manifest)
+			kappRootDir := cacher.GetKappRootPath(manifestCacheDir, task.kapp)
+
+			// remove plans and outputs from previous runs so they aren't
+			// reported or recorded again
+			if !options.DryRun {
+				stalePath := installer.TerraformPlanPath(kappRootDir)
+				if options.Approved {
+					stalePath = installer.OutputsPath(kappRootDir)
+				}
+
+				err = removeIfExists(stalePath)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+
+			task.kapp.ManifestId = task.manifest.Id
+			task.kapp.Inputs = OutputEnvVars(outputStore.StackOutputs(stackKey),
+				runPlan.transitiveDependencies(id))
+
+			install := task.action == clusterdiff.ACTION_INSTALL
+			err = processKapp(ctx, task.kapp, p.stackConfig, manifestCacheDir,
+				install, providerImpl, options.Approved, options.DryRun, output)
+
+			if err == nil && options.Approved && !options.DryRun {
+				err = recordOutputs(outputStore, stackKey, id, task.kapp,
+					kappRootDir, install)
+
+				// plans have been applied so mustn't be checked by later runs
+				if err == nil {
+					err = removeIfExists(installer.TerraformPlanPath(kappRootDir))
+				}
+			}
+
+			closeErr := output.Close()
+			if closeErr != nil {
+				log.Errorf("Error closing the log for kapp '%s': %s", id, closeErr)
 			}
+
+			if err != nil && logPath != "" {
+				err = errors.Wrapf(err, "Output was logged to %s", logPath)
+			}
+
+			if !options.DryRun {
+				outcome := JOURNAL_SUCCEEDED
+				if err != nil {
+					outcome = JOURNAL_FAILED
+				}
+
+				journalErr := runJournal.record(id, outcome)
+				if journalErr != nil {
+					log.Errorf("Error recording kapp '%s' in the journal: %s",
+						id, journalErr)
+				}
+			}
+
+			return err
+		})
+	summary.log()
+	if err != nil {
+		if !options.DryRun {
+			log.Infof("Rerun with --resume to skip kapps that succeeded")
+		}
+		return errors.WithStack(err)
+	}
+
+	if !options.Approved && !options.DryRun {
+		report, err := runPlan.changeReport()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		report.log()
+
+		err = report.save(runDir)
+		if err != nil {
+			return errors.WithStack(err)
 		}
 	}
 
@@ -144,10 +717,47 @@ func (p *Plan) Run(approved bool, dryRun bool) error {
 	return nil
 }
 
+// Removes a file, ignoring it if it doesn't exist
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Records the outputs of a kapp that's been installed, or forgets them if it's
+// been destroyed
+func recordOutputs(outputStore *OutputStore, stackKey string, id string,
+	kappObj kapp.Kapp, kappRootDir string, install bool) error {
+
+	if !install {
+		return errors.WithStack(outputStore.record(stackKey, id, nil))
+	}
+
+	kappObj.RootDir = kappRootDir
+	outputs, err := installer.KappOutputs(&kappObj)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if len(outputs) > 0 {
+		log.Infof("Recording %d outputs of kapp '%s'", len(outputs), id)
+	}
+
+	err = outputStore.record(stackKey, id, outputs)
+	if err != nil {
+		return errors.Wrapf(err, "Error recording outputs of kapp '%s'", id)
+	}
+
+	return nil
+}
+
 // Installs or destroys a kapp using the appropriate Installer
-func processKapp(kappObj kapp.Kapp, stackConfig *kapp.StackConfig,
+func processKapp(ctx context.Context, kappObj kapp.Kapp, stackConfig *kapp.StackConfig,
 	manifestCacheDir string, install bool, providerImpl provider.Provider,
-	doneCh chan bool, errCh chan error, approved bool, dryRun bool) {
+	approved bool, dryRun bool, output io.Writer) error {
 
 	kappRootDir := cacher.GetKappRootPath(manifestCacheDir, kappObj)
 
@@ -158,30 +768,40 @@ func processKapp(kappObj kapp.Kapp, stackConfig *kapp.StackConfig,
 		msg := fmt.Sprintf("Kapp '%s' doesn't exist in the cache at '%s'",
 			kappObj.Id, kappRootDir)
 		log.Warn(msg)
-		errCh <- errors.Wrap(err, msg)
+		return errors.Wrap(err, msg)
 	}
 
 	kappObj.RootDir = kappRootDir
 
 	// kapp exists, run the appropriate installer method
-	installerImpl, err := installer.NewInstaller(installer.MAKE, providerImpl)
+	installerName := kappObj.MergedInstallerConfig().Name
+	if installerName == "" {
+		installerName = stackConfig.Installer
+	}
+	if installerName == "" {
+		installerName = installer.MAKE
+	}
+
+	installerImpl, err := installer.NewInstaller(installerName, providerImpl)
 	if err != nil {
-		errCh <- errors.Wrapf(err, "Error instantiating installer for "+
+		return errors.Wrapf(err, "Error instantiating installer for "+
 			"kapp '%s'", kappObj.Id)
 	}
 
 	// install the kapp
 	if install {
-		err := installer.Install(installerImpl, &kappObj, stackConfig, approved, dryRun)
+		err := installer.Install(ctx, installerImpl, &kappObj, stackConfig,
+			approved, dryRun, output)
 		if err != nil {
-			errCh <- errors.Wrapf(err, "Error installing kapp '%s'", kappObj.Id)
+			return errors.Wrapf(err, "Error installing kapp '%s'", kappObj.Id)
 		}
 	} else { // destroy the kapp
-		err := installer.Destroy(installerImpl, &kappObj, stackConfig, approved, dryRun)
+		err := installer.Destroy(ctx, installerImpl, &kappObj, stackConfig,
+			approved, dryRun, output)
 		if err != nil {
-			errCh <- errors.Wrapf(err, "Error destroying kapp '%s'", kappObj.Id)
+			return errors.Wrapf(err, "Error destroying kapp '%s'", kappObj.Id)
 		}
 	}
 
-	doneCh <- true
+	return nil
 }
@@ -0,0 +1,381 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plan
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/clusterdiff"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testStackConfig = &kapp.StackConfig{
+	Manifests: []kapp.Manifest{
+		{
+			Id: "manifest1",
+			Kapps: []kapp.Kapp{
+				{Id: "kappA", ShouldBePresent: true},
+				{Id: "kappB", ShouldBePresent: true},
+				{Id: "kappC", ShouldBePresent: false},
+			},
+		},
+	},
+}
+
+func TestFromDiff(t *testing.T) {
+	diff := &clusterdiff.ClusterDiff{
+		Manifests: []clusterdiff.ManifestDiff{
+			{
+				Id: "manifest1",
+				Kapps: []clusterdiff.KappDiff{
+					{Id: "kappA", Action: clusterdiff.ACTION_INSTALL},
+					{Id: "kappB", Action: clusterdiff.ACTION_IGNORE},
+					{Id: "kappC", Action: clusterdiff.ACTION_DESTROY},
+				},
+			},
+		},
+	}
+
+	actual, err := FromDiff(diff, testStackConfig, "/cache")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"manifest1:kappA", "manifest1:kappB",
+		"manifest1:kappC"}, actual.order)
+
+	kapps := testStackConfig.Manifests[0].Kapps
+	assert.Equal(t, kapps[0], actual.tasks["manifest1:kappA"].kapp)
+	assert.Equal(t, clusterdiff.ACTION_INSTALL, actual.tasks["manifest1:kappA"].action)
+	assert.Equal(t, clusterdiff.ACTION_IGNORE, actual.tasks["manifest1:kappB"].action)
+	assert.Equal(t, clusterdiff.ACTION_DESTROY, actual.tasks["manifest1:kappC"].action)
+}
+
+func TestFromDiffMissingKapp(t *testing.T) {
+	diff := &clusterdiff.ClusterDiff{
+		Manifests: []clusterdiff.ManifestDiff{
+			{
+				Id: "manifest1",
+				Kapps: []clusterdiff.KappDiff{
+					{Id: "kappA", Action: clusterdiff.ACTION_INSTALL},
+				},
+			},
+		},
+	}
+
+	actual, err := FromDiff(diff, testStackConfig, "/cache")
+	assert.NotNil(t, err)
+	assert.Nil(t, actual)
+}
+
+func TestDependencies(t *testing.T) {
+	tests := []struct {
+		name          string
+		desc          string
+		manifests     []kapp.Manifest
+		expectValues  map[string][]string
+		expectedError bool
+	}{
+		{
+			name: "implicit",
+			desc: "kapps without dependencies depend on the previous manifest",
+			manifests: []kapp.Manifest{
+				{Id: "m1", Kapps: []kapp.Kapp{{Id: "a"}, {Id: "b"}}},
+				{Id: "m2", Kapps: []kapp.Kapp{{Id: "c"}}},
+			},
+			expectValues: map[string][]string{
+				"m1:a": {},
+				"m1:b": {},
+				"m2:c": {"m1:a", "m1:b"},
+			},
+		},
+		{
+			name: "explicit",
+			desc: "declared dependencies replace implicit ones",
+			manifests: []kapp.Manifest{
+				{Id: "m1", Kapps: []kapp.Kapp{{Id: "a"}, {Id: "b", DependsOn: []string{"a"}}}},
+				{Id: "m2", Kapps: []kapp.Kapp{{Id: "c", DependsOn: []string{"m1:b"}}}},
+			},
+			expectValues: map[string][]string{
+				"m1:a": {},
+				"m1:b": {"m1:a"},
+				"m2:c": {"m1:b"},
+			},
+		},
+		{
+			name: "unknown",
+			desc: "dependencies on unknown kapps are errors",
+			manifests: []kapp.Manifest{
+				{Id: "m1", Kapps: []kapp.Kapp{{Id: "a", DependsOn: []string{"m2:a"}}}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "cycle",
+			desc: "cyclic dependencies are errors",
+			manifests: []kapp.Manifest{
+				{Id: "m1", Kapps: []kapp.Kapp{
+					{Id: "a", DependsOn: []string{"c"}},
+					{Id: "b", DependsOn: []string{"a"}},
+					{Id: "c", DependsOn: []string{"b"}},
+				}},
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		stackConfig := &kapp.StackConfig{Manifests: test.manifests}
+		result, err := Create(stackConfig, "/cache")
+		if test.expectedError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+			assert.Nil(t, result)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, test.expectValues, result.dependencies,
+				"unexpected dependencies for %s", test.name)
+		}
+	}
+}
+
+func TestTransitiveDependencies(t *testing.T) {
+	stackConfig := &kapp.StackConfig{Manifests: []kapp.Manifest{
+		{Id: "m1", Kapps: []kapp.Kapp{
+			{Id: "a"},
+			{Id: "b", DependsOn: []string{"a"}},
+			{Id: "c"},
+			{Id: "d", DependsOn: []string{"b"}},
+		}},
+	}}
+
+	p, err := Create(stackConfig, "/cache")
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]bool{"m1:a": true, "m1:b": true},
+		p.transitiveDependencies("m1:d"))
+	assert.Equal(t, map[string]bool{}, p.transitiveDependencies("m1:c"))
+}
+
+func TestDescriptorDependencies(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "plan-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	kappDir := filepath.Join(cacheDir, "m2", "d")
+	err = os.MkdirAll(kappDir, 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(kappDir, kapp.DESCRIPTOR_FILE),
+		[]byte("depends_on:\n- m1:a\n- c\n"), 0644)
+	assert.Nil(t, err)
+
+	// dependencies declared by kapps are merged with those in manifests
+	stackConfig := &kapp.StackConfig{Manifests: []kapp.Manifest{
+		{Id: "m1", Kapps: []kapp.Kapp{{Id: "a"}, {Id: "b"}}},
+		{Id: "m2", Kapps: []kapp.Kapp{{Id: "c"}, {Id: "d", DependsOn: []string{"c"}}}},
+	}}
+
+	result, err := Create(stackConfig, cacheDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"m2:c", "m1:a"}, result.dependencies["m2:d"])
+	assert.NotNil(t, result.tasks["m2:d"].kapp.Descriptor)
+	assert.Nil(t, result.tasks["m2:c"].kapp.Descriptor)
+}
+
+// Runs a plan with a fake processor and returns the order kapps were processed
+func scheduledOrder(p *Plan, failId string) ([]string, error) {
+	var mutex sync.Mutex
+	processed := make([]string, 0)
+
+	_, err := p.schedule(context.Background(), 0, 0, func(ctx context.Context, task task) error {
+		id := fullyQualifiedId(task.manifest.Id, task.kapp.Id)
+		if id == failId {
+			return errors.New("failed")
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		processed = append(processed, id)
+		return nil
+	})
+
+	return processed, err
+}
+
+func TestSchedule(t *testing.T) {
+	stackConfig := &kapp.StackConfig{
+		Manifests: []kapp.Manifest{
+			{Id: "m1", Kapps: []kapp.Kapp{
+				{Id: "a", ShouldBePresent: true},
+				{Id: "b", ShouldBePresent: true, DependsOn: []string{"a"}},
+			}},
+			{Id: "m2", Kapps: []kapp.Kapp{
+				{Id: "c", ShouldBePresent: true, DependsOn: []string{"m1:b"}},
+			}},
+		},
+	}
+
+	p, err := Create(stackConfig, "/cache")
+	assert.Nil(t, err)
+
+	processed, err := scheduledOrder(p, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"m1:a", "m1:b", "m2:c"}, processed)
+
+	// kapps that depend on failed kapps aren't processed
+	processed, err = scheduledOrder(p, "m1:b")
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"m1:a"}, processed)
+
+	// destroys run in reverse dependency order
+	for i := range stackConfig.Manifests {
+		for j := range stackConfig.Manifests[i].Kapps {
+			stackConfig.Manifests[i].Kapps[j].ShouldBePresent = false
+		}
+	}
+
+	p, err = Create(stackConfig, "/cache")
+	assert.Nil(t, err)
+
+	processed, err = scheduledOrder(p, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"m2:c", "m1:b", "m1:a"}, processed)
+}
+
+func TestScheduleIgnored(t *testing.T) {
+	stackConfig := &kapp.StackConfig{
+		Manifests: []kapp.Manifest{
+			{Id: "m1", Kapps: []kapp.Kapp{{Id: "a"}}},
+			{Id: "m2", Kapps: []kapp.Kapp{{Id: "b"}}},
+			{Id: "m3", Kapps: []kapp.Kapp{{Id: "c"}}},
+		},
+	}
+
+	diff := &clusterdiff.ClusterDiff{
+		Manifests: []clusterdiff.ManifestDiff{
+			{Id: "m1", Kapps: []clusterdiff.KappDiff{{Id: "a", Action: clusterdiff.ACTION_INSTALL}}},
+			{Id: "m2", Kapps: []clusterdiff.KappDiff{{Id: "b", Action: clusterdiff.ACTION_IGNORE}}},
+			{Id: "m3", Kapps: []clusterdiff.KappDiff{{Id: "c", Action: clusterdiff.ACTION_INSTALL}}},
+		},
+	}
+
+	p, err := FromDiff(diff, stackConfig, "/cache")
+	assert.Nil(t, err)
+
+	// ordering is preserved through ignored kapps
+	assert.Equal(t, map[string][]string{
+		"m1:a": {},
+		"m3:c": {"m1:a"},
+	}, p.prerequisites())
+
+	processed, err := scheduledOrder(p, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"m1:a", "m3:c"}, processed)
+}
+
+func TestScheduleSummary(t *testing.T) {
+	stackConfig := &kapp.StackConfig{
+		Manifests: []kapp.Manifest{
+			{Id: "m1", Kapps: []kapp.Kapp{
+				{Id: "a", ShouldBePresent: true},
+				{Id: "b", ShouldBePresent: true, Timeout: 10 * time.Millisecond},
+				{Id: "c", ShouldBePresent: true},
+			}},
+			{Id: "m2", Kapps: []kapp.Kapp{
+				{Id: "d", ShouldBePresent: true},
+			}},
+		},
+	}
+
+	p, err := Create(stackConfig, "/cache")
+	assert.Nil(t, err)
+
+	// kapps block until they're stopped except 'a'
+	process := func(ctx context.Context, task task) error {
+		if task.kapp.Id == "a" {
+			return nil
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	// 'b' times out, 'c' uses the default timeout and 'd' depends on them
+	summary, err := p.schedule(context.Background(), 0, 20*time.Millisecond, process)
+	assert.NotNil(t, err)
+	assert.Equal(t, &Summary{
+		Succeeded: []string{"m1:a"},
+		Failed:    []string{"m1:b", "m1:c"},
+		Skipped:   []string{"m2:d"},
+		Cancelled: []string{},
+	}, summary)
+
+	// with no timeouts, cancelling the run cancels running and pending kapps
+	stackConfig.Manifests[0].Kapps[1].Timeout = 0
+	p, err = Create(stackConfig, "/cache")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	summary, err = p.schedule(ctx, 1, 0, process)
+	assert.NotNil(t, err)
+	assert.Equal(t, &Summary{
+		Succeeded: []string{"m1:a"},
+		Failed:    []string{},
+		Skipped:   []string{},
+		Cancelled: []string{"m1:b", "m1:c", "m2:d"},
+	}, summary)
+}
+
+func TestScheduleParallelism(t *testing.T) {
+	kapps := make([]kapp.Kapp, 0)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		kapps = append(kapps, kapp.Kapp{Id: id, ShouldBePresent: true})
+	}
+
+	p, err := Create(&kapp.StackConfig{
+		Manifests: []kapp.Manifest{{Id: "m1", Kapps: kapps}},
+	}, "/cache")
+	assert.Nil(t, err)
+
+	var mutex sync.Mutex
+	running := 0
+	maxRunning := 0
+
+	summary, err := p.schedule(context.Background(), 2, 0,
+		func(ctx context.Context, task task) error {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return nil
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(summary.Succeeded))
+	assert.Equal(t, 2, maxRunning)
+}
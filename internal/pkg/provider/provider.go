@@ -85,6 +85,22 @@ func NewProvider(stackConfig *kapp.StackConfig) (Provider, error) {
 	return providerImpl, nil
 }
 
+// Returns the vars a provider would load for a stack without instantiating
+// the provider. Unlike NewProvider, it isn't an error if no vars are found.
+func LoadVars(stackConfig *kapp.StackConfig) (Values, error) {
+	providerImpl, err := newProviderImpl(stackConfig.Provider)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	stackConfigVars, err := stackConfigVars(providerImpl, stackConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return stackConfigVars, nil
+}
+
 // Searches for values.yaml files in configured directories and returns the
 // result of merging them.
 func stackConfigVars(p Provider, sc *kapp.StackConfig) (Values, error) {
@@ -0,0 +1,273 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package templater
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/log"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// Prefix of files rendered from templates that don't declare a destination
+const GENERATED_PREFIX = acquirer.GENERATED_FILE_PREFIX
+
+// Extension removed from the names of templates when working out where to
+// render them to
+const TEMPLATE_EXTENSION = ".tpl"
+
+// Keys templates can access data under, e.g. `{{ .vars.kube_context }}`,
+// `{{ .kapp.Id }}` or `{{ .stack.Cluster }}`
+const VARS_KEY = "vars"
+const KAPP_KEY = "kapp"
+const STACK_KEY = "stack"
+
+// Helper functions available in templates in addition to the text/template
+// builtins. Names and argument orders follow sprig's so they can be piped.
+var funcMap = template.FuncMap{
+	"default":    defaultValue,
+	"required":   required,
+	"empty":      empty,
+	"env":        os.Getenv,
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      strings.Title,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old string, new string, s string) string { return strings.Replace(s, old, new, -1) },
+	"split":      func(sep string, s string) []string { return strings.Split(s, sep) },
+	"join":       join,
+	"quote":      func(value interface{}) string { return fmt.Sprintf("%q", fmt.Sprint(value)) },
+	"squote":     func(value interface{}) string { return "'" + fmt.Sprint(value) + "'" },
+	"indent":     indent,
+	"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+	"toYaml":     toYaml,
+	"toJson":     toJson,
+}
+
+// Renders a template with the given data
+func Render(name string, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Funcs(funcMap).Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error parsing template '%s'", name)
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error rendering template '%s'", name)
+	}
+
+	return rendered.String(), nil
+}
+
+// Returns the data templates for a kapp are rendered with
+func kappData(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	vars provider.Values) map[string]interface{} {
+	return map[string]interface{}{
+		VARS_KEY:  vars,
+		KAPP_KEY:  kappObj,
+		STACK_KEY: stackConfig,
+	}
+}
+
+// Returns the path a template should be rendered to, relative to the kapp
+// root dir
+func destPath(kappTemplate kapp.Template) string {
+	if kappTemplate.Dest != "" {
+		return kappTemplate.Dest
+	}
+
+	name := strings.TrimSuffix(filepath.Base(kappTemplate.Source), TEMPLATE_EXTENSION)
+	return filepath.Join(filepath.Dir(kappTemplate.Source), GENERATED_PREFIX+name)
+}
+
+// Renders the templates declared in a kapp's descriptor against the stack's
+// vars and returns the paths of the rendered files. On dry runs nothing is
+// written and the rendered output is written to `out` instead.
+func RenderKapp(kappObj *kapp.Kapp, stackConfig *kapp.StackConfig,
+	vars provider.Values, dryRun bool, out io.Writer) ([]string, error) {
+
+	paths := make([]string, 0)
+
+	if kappObj.Descriptor == nil {
+		return paths, nil
+	}
+
+	data := kappData(kappObj, stackConfig, vars)
+
+	for _, kappTemplate := range kappObj.Descriptor.Templates {
+		sourcePath := filepath.Join(kappObj.RootDir, kappTemplate.Source)
+		text, err := ioutil.ReadFile(sourcePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading template '%s' of "+
+				"kapp '%s'", kappTemplate.Source, kappObj.Id)
+		}
+
+		rendered, err := Render(kappTemplate.Source, string(text), data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error rendering kapp '%s'", kappObj.Id)
+		}
+
+		path := filepath.Join(kappObj.RootDir, destPath(kappTemplate))
+		paths = append(paths, path)
+
+		if dryRun {
+			_, err = fmt.Fprintf(out, "# Kapp '%s': %s\n%s\n", kappObj.Id,
+				path, rendered)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		err = ioutil.WriteFile(path, []byte(rendered), 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error writing rendered template "+
+				"to '%s'", path)
+		}
+
+		log.Debugf("Rendered template '%s' of kapp '%s' to '%s'",
+			kappTemplate.Source, kappObj.Id, path)
+	}
+
+	return paths, nil
+}
+
+// Returns true if a value is nil or its type's zero value, or an empty
+// slice or map
+func empty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+		return reflected.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return reflected.IsNil()
+	}
+
+	return reflect.DeepEqual(value, reflect.Zero(reflected.Type()).Interface())
+}
+
+// Returns the given value unless it's empty, in which case the default is
+// returned. Used like `{{ .vars.replicas | default 1 }}`.
+func defaultValue(fallback interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || empty(given[0]) {
+		return fallback
+	}
+
+	return given[0]
+}
+
+// Returns an error if a value is empty so templates can't silently render
+// without it
+func required(message string, value interface{}) (interface{}, error) {
+	if empty(value) {
+		return nil, errors.New(message)
+	}
+
+	return value, nil
+}
+
+// Joins a list of values into a string
+func join(sep string, values interface{}) string {
+	reflected := reflect.ValueOf(values)
+	if reflected.Kind() != reflect.Slice && reflected.Kind() != reflect.Array {
+		return fmt.Sprint(values)
+	}
+
+	strs := make([]string, reflected.Len())
+	for i := 0; i < reflected.Len(); i++ {
+		strs[i] = fmt.Sprint(reflected.Index(i).Interface())
+	}
+
+	return strings.Join(strs, sep)
+}
+
+// Indents each line of a string
+func indent(spaces int, s string) string {
+	padding := strings.Repeat(" ", spaces)
+	return padding + strings.Replace(s, "\n", "\n"+padding, -1)
+}
+
+// Marshals a value to YAML without a trailing newline
+func toYaml(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// Marshals a value to JSON. Maps parsed from YAML are converted to maps
+// with string keys first since they can't be marshalled otherwise.
+func toJson(value interface{}) (string, error) {
+	data, err := json.Marshal(jsonValue(value))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return string(data), nil
+}
+
+// Recursively converts maps with interface keys to maps with string keys
+func jsonValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(typed))
+		for k, v := range typed {
+			converted[fmt.Sprint(k)] = jsonValue(v)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(typed))
+		for k, v := range typed {
+			converted[k] = jsonValue(v)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(typed))
+		for i, v := range typed {
+			converted[i] = jsonValue(v)
+		}
+		return converted
+	}
+
+	return value
+}
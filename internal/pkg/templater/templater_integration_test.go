@@ -0,0 +1,99 @@
+// +build integration
+
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package templater
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Templates rendered into kapps cached from git by `kapps init` mustn't make
+// the cache look modified, otherwise installing them would fail
+func TestRenderKappGitSource(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "templater-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	repoDir := filepath.Join(tempDir, "repo")
+	err = os.MkdirAll(filepath.Join(repoDir, "wordpress"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(repoDir, "wordpress", kapp.DESCRIPTOR_FILE),
+		[]byte("templates:\n- source: wordpress/values.yaml.tpl\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(repoDir, "wordpress/values.yaml.tpl"),
+		[]byte("context: {{ .vars.kube_context }}\n"), 0644)
+	assert.Nil(t, err)
+
+	for _, args := range [][]string{
+		{"init"},
+		{"checkout", "-b", "master"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com",
+			"commit", "-m", "initial"},
+	} {
+		gitCmd := exec.Command("git", args...)
+		gitCmd.Dir = repoDir
+		out, err := gitCmd.CombinedOutput()
+		assert.Nil(t, err, string(out))
+	}
+
+	manifest := kapp.Manifest{
+		Id: "manifest",
+		Kapps: []kapp.Kapp{
+			{
+				Id:              "wordpress",
+				ShouldBePresent: true,
+				Sources: []acquirer.Acquirer{
+					acquirer.NewGitAcquirer("wordpress", "file://"+repoDir,
+						"master", "wordpress"),
+				},
+			},
+		},
+	}
+
+	cacheDir := filepath.Join(tempDir, "cache")
+	err = cacher.CacheManifest(manifest, cacheDir, nil, false)
+	assert.Nil(t, err)
+
+	kappObj := manifest.Kapps[0]
+	kappObj.RootDir = cacher.GetKappRootPath(
+		cacher.GetManifestCachePath(cacheDir, manifest), kappObj)
+	kappObj.Descriptor, err = kapp.LoadDescriptor(kappObj.RootDir)
+	assert.Nil(t, err)
+
+	var output bytes.Buffer
+	paths, err := RenderKapp(&kappObj, &kapp.StackConfig{},
+		provider.Values{"kube_context": "minikube"}, false, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(kappObj.RootDir,
+		"wordpress/_generated_values.yaml")}, paths)
+
+	diff, err := cacher.DiffCache([]kapp.Manifest{manifest}, cacheDir)
+	assert.Nil(t, err)
+	assert.True(t, diff.IsEmpty(), "rendering templates modified the cache: %#v", diff)
+}
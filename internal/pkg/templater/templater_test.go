@@ -0,0 +1,223 @@
+/*
+ * Copyright 2018 The Sugarkube Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package templater
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/sugarkube/sugarkube/internal/pkg/acquirer"
+	"github.com/sugarkube/sugarkube/internal/pkg/cacher"
+	"github.com/sugarkube/sugarkube/internal/pkg/kapp"
+	"github.com/sugarkube/sugarkube/internal/pkg/provider"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	data := map[string]interface{}{
+		VARS_KEY: provider.Values{
+			"kube_context": "minikube",
+			"replicas":     0,
+			"hosts":        []interface{}{"a.example.com", "b.example.com"},
+			"ingress": map[interface{}]interface{}{
+				"class": "nginx",
+			},
+		},
+		KAPP_KEY:  &kapp.Kapp{Id: "wordpress"},
+		STACK_KEY: &kapp.StackConfig{Cluster: "dev1"},
+	}
+
+	tests := []struct {
+		name          string
+		desc          string
+		input         string
+		expectValue   string
+		expectedError bool
+	}{
+		{
+			name:        "fields",
+			desc:        "check vars, kapp and stack fields can be used",
+			input:       "{{ .vars.kube_context }}-{{ .kapp.Id }}-{{ .stack.Cluster }}",
+			expectValue: "minikube-wordpress-dev1",
+		},
+		{
+			name:        "nested_vars",
+			desc:        "check nested vars parsed from YAML can be used",
+			input:       "{{ .vars.ingress.class }}",
+			expectValue: "nginx",
+		},
+		{
+			name:        "default",
+			desc:        "check defaults are used for missing or empty values",
+			input:       "{{ .vars.missing | default \"x\" }} {{ .vars.replicas | default 1 }} {{ .vars.kube_context | default \"x\" }}",
+			expectValue: "x 1 minikube",
+		},
+		{
+			name:          "required",
+			desc:          "check required values must be set",
+			input:         "{{ .vars.hosted_zone | required \"hosted_zone is required\" }}",
+			expectedError: true,
+		},
+		{
+			name:        "strings",
+			desc:        "check string helpers",
+			input:       "{{ .kapp.Id | upper | quote }} {{ .vars.hosts | join \",\" }} {{ \"v1.tpl\" | trimSuffix \".tpl\" }}",
+			expectValue: "\"WORDPRESS\" a.example.com,b.example.com v1",
+		},
+		{
+			name:        "toYaml",
+			desc:        "check values can be rendered as indented YAML",
+			input:       "hosts:{{ .vars.hosts | toYaml | nindent 2 }}",
+			expectValue: "hosts:\n  - a.example.com\n  - b.example.com",
+		},
+		{
+			name:        "toJson",
+			desc:        "check maps parsed from YAML can be rendered as JSON",
+			input:       "{{ .vars.ingress | toJson }}",
+			expectValue: "{\"class\":\"nginx\"}",
+		},
+		{
+			name:          "bad_syntax",
+			desc:          "check parse errors are returned",
+			input:         "{{ .vars.kube_context ",
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := Render(test.name, test.input, data)
+		if test.expectedError {
+			assert.NotNil(t, err, "expected an error for %s", test.name)
+		} else {
+			assert.Nil(t, err, "unexpected error for %s", test.name)
+			assert.Equal(t, test.expectValue, result, "unexpected result for %s", test.name)
+		}
+	}
+}
+
+func TestRenderKapp(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "templater-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	err = os.MkdirAll(filepath.Join(tempDir, "chart"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(tempDir, "chart/values.yaml.tpl"),
+		[]byte("context: {{ .vars.kube_context }}\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(tempDir, "backend.tf"),
+		[]byte("region = \"{{ .stack.Region }}\"\n"), 0644)
+	assert.Nil(t, err)
+
+	kappObj := &kapp.Kapp{
+		Id:      "wordpress",
+		RootDir: tempDir,
+		Descriptor: &kapp.Descriptor{Templates: []kapp.Template{
+			{Source: "chart/values.yaml.tpl"},
+			{Source: "backend.tf", Dest: "terraform/_generated_backend.tf"},
+		}},
+	}
+	stackConfig := &kapp.StackConfig{Region: "eu-west-1"}
+	vars := provider.Values{"kube_context": "minikube"}
+
+	valuesPath := filepath.Join(tempDir, "chart/_generated_values.yaml")
+	backendPath := filepath.Join(tempDir, "terraform/_generated_backend.tf")
+
+	// dry runs print rendered templates without writing them
+	var output bytes.Buffer
+	paths, err := RenderKapp(kappObj, stackConfig, vars, true, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{valuesPath, backendPath}, paths)
+	assert.Contains(t, output.String(), "context: minikube")
+	assert.Contains(t, output.String(), "region = \"eu-west-1\"")
+
+	_, err = os.Stat(valuesPath)
+	assert.True(t, os.IsNotExist(err))
+
+	paths, err = RenderKapp(kappObj, stackConfig, vars, false, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{valuesPath, backendPath}, paths)
+
+	rendered, err := ioutil.ReadFile(valuesPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "context: minikube\n", string(rendered))
+
+	rendered, err = ioutil.ReadFile(backendPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "region = \"eu-west-1\"\n", string(rendered))
+
+	// kapps without descriptors have nothing to render
+	paths, err = RenderKapp(&kapp.Kapp{Id: "empty"}, stackConfig, vars, false, &output)
+	assert.Nil(t, err)
+	assert.Empty(t, paths)
+}
+
+// Templates rendered into kapps copied into the cache from local sources
+// mustn't make the cache look modified, otherwise installing them would fail
+func TestRenderKappCopiedSource(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "templater-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	srcDir := filepath.Join(tempDir, "src")
+	err = os.MkdirAll(filepath.Join(srcDir, "wordpress"), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(srcDir, "wordpress", kapp.DESCRIPTOR_FILE),
+		[]byte("templates:\n- source: wordpress/values.yaml.tpl\n"), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(srcDir, "wordpress/values.yaml.tpl"),
+		[]byte("context: {{ .vars.kube_context }}\n"), 0644)
+	assert.Nil(t, err)
+
+	source, err := acquirer.NewFileAcquirer("wordpress",
+		filepath.Join(srcDir, "wordpress"), "", true, "")
+	assert.Nil(t, err)
+
+	manifest := kapp.Manifest{
+		Id: "manifest",
+		Kapps: []kapp.Kapp{
+			{
+				Id:              "wordpress",
+				ShouldBePresent: true,
+				Sources:         []acquirer.Acquirer{source},
+			},
+		},
+	}
+
+	cacheDir := filepath.Join(tempDir, "cache")
+	err = cacher.CacheManifest(manifest, cacheDir, nil, false)
+	assert.Nil(t, err)
+
+	kappObj := manifest.Kapps[0]
+	kappObj.RootDir = cacher.GetKappRootPath(
+		cacher.GetManifestCachePath(cacheDir, manifest), kappObj)
+	kappObj.Descriptor, err = kapp.LoadDescriptor(kappObj.RootDir)
+	assert.Nil(t, err)
+
+	var output bytes.Buffer
+	paths, err := RenderKapp(&kappObj, &kapp.StackConfig{},
+		provider.Values{"kube_context": "minikube"}, false, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(kappObj.RootDir,
+		"wordpress/_generated_values.yaml")}, paths)
+
+	diff, err := cacher.DiffCache([]kapp.Manifest{manifest}, cacheDir)
+	assert.Nil(t, err)
+	assert.True(t, diff.IsEmpty(), "rendering templates modified the cache: %#v", diff)
+}